@@ -0,0 +1,295 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	ComBat removes additive and multiplicative batch effects with the
+	parametric empirical Bayes method of Johnson, Li and Rabinovic (2007), as
+	implemented in sva::ComBat. Each gene is standardized against a model of
+	the batches (and, optionally, the conditions, so that their differences
+	are protected), the batch location and scale estimates are shrunk towards
+	priors pooled over all genes, and the data is rescaled.
+*/
+
+// combatConvergence is the relative change at which the empirical Bayes
+// iteration stops, as in sva
+const combatConvergence = 0.0001
+
+// BatchCorrectionOptions controls ComBat batch correction
+type BatchCorrectionOptions struct {
+	Enabled          bool
+	ProtectCondition bool // keep the condition in the ComBat model
+}
+
+// BatchSummary describes the samples of one batch before or after correction
+type BatchSummary struct {
+	Stage            string
+	Batch            string
+	Samples          int
+	Mean             float64 // mean expression of the batch
+	GeneSD           float64 // mean standard deviation of the genes within the batch
+	CentroidDistance float64 // RMS distance of the batch gene means from the overall gene means
+}
+
+// ComBat corrects the batch effects of data (genes by samples). batches holds
+// the batch of every sample; conditions, if not nil, holds the condition of
+// every sample, whose differences are protected. It returns the corrected
+// data and the number of genes left unadjusted because they are constant
+// within a batch.
+func ComBat(data *mat.Dense, batches, conditions []string) (*mat.Dense, int, error) {
+	genes, samples := data.Dims()
+	if len(batches) != samples || (conditions != nil && len(conditions) != samples) {
+		return nil, 0, fmt.Errorf("need a batch and condition for each of the %d samples", samples)
+	}
+	for i := 0; i < genes; i++ {
+		for j := 0; j < samples; j++ {
+			if isMissing(data.At(i, j)) {
+				return nil, 0, fmt.Errorf("batch correction needs complete data, impute missing values first")
+			}
+		}
+	}
+
+	batchLevels, batchIndex := factorLevels(batches)
+	if len(batchLevels) < 2 {
+		return nil, 0, fmt.Errorf("found only one batch")
+	}
+	batchSamples := make([][]int, len(batchLevels))
+	for j, b := range batchIndex {
+		batchSamples[b] = append(batchSamples[b], j)
+	}
+	for b, members := range batchSamples {
+		if len(members) < 2 {
+			return nil, 0, fmt.Errorf("batch %s has only one sample", batchLevels[b])
+		}
+	}
+
+	// Design: one indicator per batch, then one per non-reference condition
+	columns := len(batchLevels)
+	var conditionIndex []int
+	if conditions != nil {
+		var conditionLevels []string
+		conditionLevels, conditionIndex = factorLevels(conditions)
+		columns += len(conditionLevels) - 1
+	}
+	design := mat.NewDense(samples, columns, nil)
+	for j := 0; j < samples; j++ {
+		design.Set(j, batchIndex[j], 1)
+		if conditionIndex != nil && conditionIndex[j] > 0 {
+			design.Set(j, len(batchLevels)+conditionIndex[j]-1, 1)
+		}
+	}
+
+	// Least squares fit of every gene: B = (X'X)^-1 X'Y'
+	var xtx, xty, coefficients mat.Dense
+	xtx.Mul(design.T(), design)
+	xty.Mul(design.T(), data.T())
+	if err := coefficients.Solve(&xtx, &xty); err != nil {
+		return nil, 0, fmt.Errorf("the condition is confounded with the batches: %v", err)
+	}
+
+	// Standardize the data against the grand mean and pooled variance
+	var fitted mat.Dense
+	fitted.Mul(design, &coefficients)
+	standMean := mat.NewDense(genes, samples, nil)
+	varPooled := make([]float64, genes)
+	standardized := mat.NewDense(genes, samples, nil)
+	for i := 0; i < genes; i++ {
+		grandMean := 0.0
+		for b, members := range batchSamples {
+			grandMean += float64(len(members)) / float64(samples) * coefficients.At(b, i)
+		}
+		for j := 0; j < samples; j++ {
+			residual := data.At(i, j) - fitted.At(j, i)
+			varPooled[i] += residual * residual / float64(samples)
+
+			mean := grandMean
+			for k := len(batchLevels); k < columns; k++ {
+				mean += design.At(j, k) * coefficients.At(k, i)
+			}
+			standMean.Set(i, j, mean)
+		}
+		for j := 0; j < samples; j++ {
+			standardized.Set(i, j, (data.At(i, j)-standMean.At(i, j))/math.Sqrt(varPooled[i]))
+		}
+	}
+
+	// Batch location and scale estimates of the genes that vary in every batch
+	gammaHat := make([][]float64, len(batchLevels))
+	deltaHat := make([][]float64, len(batchLevels))
+	var adjusted []int
+	for i := 0; i < genes; i++ {
+		usable := varPooled[i] > 0
+		for _, members := range batchSamples {
+			values := make([]float64, len(members))
+			for k, j := range members {
+				values[k] = standardized.At(i, j)
+			}
+			if _, sd := nanMeanSD(values); !(sd > 0) {
+				usable = false
+			}
+		}
+		if usable {
+			adjusted = append(adjusted, i)
+		}
+	}
+	if len(adjusted) < 2 {
+		return nil, 0, fmt.Errorf("fewer than 2 genes vary within every batch")
+	}
+	for b, members := range batchSamples {
+		gammaHat[b] = make([]float64, len(adjusted))
+		deltaHat[b] = make([]float64, len(adjusted))
+		for g, i := range adjusted {
+			values := make([]float64, len(members))
+			for k, j := range members {
+				values[k] = standardized.At(i, j)
+			}
+			mean, sd := nanMeanSD(values)
+			gammaHat[b][g] = mean
+			deltaHat[b][g] = sd * sd
+		}
+	}
+
+	// Empirical Bayes estimates, batch by batch
+	result := mat.DenseCopyOf(data)
+	for b, members := range batchSamples {
+		gammaBar, gammaSD := nanMeanSD(gammaHat[b])
+		t2 := gammaSD * gammaSD
+		aPrior, bPrior := inverseGammaPrior(deltaHat[b])
+		gammaStar, deltaStar := combatIterate(standardized, adjusted, members, gammaHat[b], deltaHat[b], gammaBar, t2, aPrior, bPrior)
+
+		for g, i := range adjusted {
+			scale := math.Sqrt(varPooled[i])
+			for _, j := range members {
+				corrected := (standardized.At(i, j) - gammaStar[g]) / math.Sqrt(deltaStar[g])
+				result.Set(i, j, corrected*scale+standMean.At(i, j))
+			}
+		}
+	}
+	return result, genes - len(adjusted), nil
+}
+
+// combatIterate alternates the posterior means of the batch location and
+// scale of each gene until they converge (sva's it.sol)
+func combatIterate(standardized *mat.Dense, genes, members []int, gammaHat, deltaHat []float64,
+	gammaBar, t2, aPrior, bPrior float64) ([]float64, []float64) {
+	n := float64(len(members))
+	gammaOld := append([]float64{}, gammaHat...)
+	deltaOld := append([]float64{}, deltaHat...)
+	gammaNew := make([]float64, len(genes))
+	deltaNew := make([]float64, len(genes))
+
+	for change := 1.0; change > combatConvergence; {
+		change = 0
+		for g, i := range genes {
+			gammaNew[g] = (t2*n*gammaHat[g] + deltaOld[g]*gammaBar) / (t2*n + deltaOld[g])
+			sum2 := 0.0
+			for _, j := range members {
+				d := standardized.At(i, j) - gammaNew[g]
+				sum2 += d * d
+			}
+			deltaNew[g] = (0.5*sum2 + bPrior) / (n/2 + aPrior - 1)
+
+			if gammaOld[g] != 0 {
+				change = math.Max(change, math.Abs(gammaNew[g]-gammaOld[g])/math.Abs(gammaOld[g]))
+			}
+			change = math.Max(change, math.Abs(deltaNew[g]-deltaOld[g])/deltaOld[g])
+		}
+		copy(gammaOld, gammaNew)
+		copy(deltaOld, deltaNew)
+	}
+	return gammaNew, deltaNew
+}
+
+// inverseGammaPrior estimates the inverse gamma prior of the batch variances
+// by the method of moments (sva's aprior and bprior)
+func inverseGammaPrior(deltaHat []float64) (float64, float64) {
+	m, sd := nanMeanSD(deltaHat)
+	s2 := sd * sd
+	return (2*s2 + m*m) / s2, (m*s2 + m*m*m) / s2
+}
+
+// factorLevels returns the distinct values in order of first appearance and
+// the level index of every value
+func factorLevels(values []string) ([]string, []int) {
+	var levels []string
+	index := make([]int, len(values))
+	seen := make(map[string]int)
+	for j, value := range values {
+		level, ok := seen[value]
+		if !ok {
+			level = len(levels)
+			seen[value] = level
+			levels = append(levels, value)
+		}
+		index[j] = level
+	}
+	return levels, index
+}
+
+// SummarizeBatches describes each batch of data for the batch summary file
+func SummarizeBatches(stage string, data *mat.Dense, batches []string) []BatchSummary {
+	genes, samples := data.Dims()
+	levels, index := factorLevels(batches)
+
+	overall := make([]float64, genes)
+	for i := 0; i < genes; i++ {
+		overall[i], _ = nanMeanSD(mat.Row(nil, i, data))
+	}
+
+	summaries := make([]BatchSummary, len(levels))
+	for b, level := range levels {
+		var members []int
+		for j := 0; j < samples; j++ {
+			if index[j] == b {
+				members = append(members, j)
+			}
+		}
+		summary := BatchSummary{Stage: stage, Batch: level, Samples: len(members)}
+		squared := 0.0
+		for i := 0; i < genes; i++ {
+			values := make([]float64, len(members))
+			for k, j := range members {
+				values[k] = data.At(i, j)
+			}
+			mean, sd := nanMeanSD(values)
+			summary.Mean += mean / float64(genes)
+			summary.GeneSD += sd / float64(genes)
+			squared += (mean - overall[i]) * (mean - overall[i])
+		}
+		summary.CentroidDistance = math.Sqrt(squared / float64(genes))
+		summaries[b] = summary
+	}
+	return summaries
+}
+
+// writeBatchSummary writes batch summaries as a tab-separated file
+func writeBatchSummary(summaries []BatchSummary, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating batch summary: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, "stage\tbatch\tsamples\tmean\tgene_sd\tcentroid_distance")
+	for _, s := range summaries {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%.6g\t%.6g\t%.6g\n", s.Stage, s.Batch, s.Samples, s.Mean, s.GeneSD, s.CentroidDistance)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,140 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	Besides the heatmap of 50 genes, the tool can compute the DiffCoEx
+	adjacency difference of clustering.R for every pair of genes, which does
+	not fit in memory for genome-scale conditions:
+
+		adjacency    sign(r)·r² of the correlation r in each condition
+		difference   (|adjacency1 - adjacency2| / 2)^(beta/2), 0 for a gene
+		             with itself
+
+	The differences are computed tile by tile into adjacency_difference.tiles,
+	in float32 or float64, which DiffCoEx steps can read with random access.
+	The connectivity of every gene, the sum of its differences, is then
+	streamed from the file into adjacency_connectivity.tsv and, given a
+	threshold, the pairs of genes whose difference reaches it into
+	adjacency_edges.tsv.
+*/
+
+// adjacencyDifferenceTile returns the tiles of the adjacency difference of
+// two conditions with the same genes
+func adjacencyDifferenceTile(condition1, condition2 *diffcoex.CorrelationEngine, beta float64) diffcoex.TileFunc {
+	return func(a, b []int) *mat.Dense {
+		tile := condition1.Block(a, b)
+		corr2 := condition2.Block(a, b)
+		for k, i := range a {
+			for l, j := range b {
+				if i == j {
+					tile.Set(k, l, 0)
+					continue
+				}
+				r1, r2 := tile.At(k, l), corr2.At(k, l)
+				difference := math.Abs(diffcoex.Sign(r1)*r1*r1-diffcoex.Sign(r2)*r2*r2) / 2
+				tile.Set(k, l, math.Pow(difference, beta/2))
+			}
+		}
+		return tile
+	}
+}
+
+// writeAdjacencyDifference writes the adjacency difference of two conditions
+// with the same genes, its connectivity and, if threshold is above 0, its
+// pairs of genes reaching threshold
+func writeAdjacencyDifference(outputDir string, condition1, condition2 *diffcoex.CorrelationEngine, precision string,
+	beta, threshold float64) error {
+	genes := condition1.Genes()
+	tilesPath := filepath.Join(outputDir, "adjacency_difference.tiles")
+	description := fmt.Sprintf("DiffCoEx adjacency difference (%s correlation, beta=%s)",
+		condition1.Method(), strconv.FormatFloat(beta, 'g', -1, 64))
+	if err := diffcoex.WriteTiledMatrix(tilesPath, genes, description, precision,
+		adjacencyDifferenceTile(condition1, condition2, beta)); err != nil {
+		return err
+	}
+	diffcoex.RecordOutput(tilesPath)
+
+	tiles, err := diffcoex.OpenTiledMatrix(tilesPath)
+	if err != nil {
+		return err
+	}
+	defer tiles.Close()
+
+	// Connectivity of every gene
+	connectivityPath := filepath.Join(outputDir, "adjacency_connectivity.tsv")
+	connectivity := tiles.RowSums(func(v float64) float64 { return v })
+	err = writeTSV(connectivityPath, []string{"Gene", "Connectivity"}, func(writer *bufio.Writer) error {
+		for i, gene := range tiles.Genes {
+			fmt.Fprintf(writer, "%s\t%s\n", gene, strconv.FormatFloat(connectivity[i], 'g', -1, 64))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	diffcoex.RecordOutput(connectivityPath)
+
+	// Pairs of genes whose difference reaches the threshold
+	if threshold <= 0 {
+		return nil
+	}
+	edgesPath := filepath.Join(outputDir, "adjacency_edges.tsv")
+	err = writeTSV(edgesPath, []string{"Gene1", "Gene2", "Difference"}, func(writer *bufio.Writer) error {
+		return tiles.Threshold(threshold, func(i, j int, value float64) error {
+			_, err := fmt.Fprintf(writer, "%s\t%s\t%s\n", tiles.Genes[i], tiles.Genes[j],
+				strconv.FormatFloat(value, 'g', -1, 64))
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	diffcoex.RecordOutput(edgesPath)
+	return nil
+}
+
+// writeTSV writes a tab-separated file of a header and the lines written by
+// body
+func writeTSV(filename string, header []string, body func(*bufio.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for i, field := range header {
+		if i > 0 {
+			writer.WriteString("\t")
+		}
+		writer.WriteString(field)
+	}
+	writer.WriteString("\n")
+	if err := body(writer); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	return nil
+}
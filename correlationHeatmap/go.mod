@@ -2,6 +2,12 @@ module correlationHeatmap
 
 go 1.23.0
 
+require (
+	diffcoex v0.0.0
+	gonum.org/v1/gonum v0.15.1
+	gonum.org/v1/plot v0.15.0
+)
+
 require (
 	git.sr.ht/~sbinet/gg v0.6.0 // indirect
 	github.com/ajstarks/svgo v0.0.0-20211024235047-1546f124cd8b // indirect
@@ -13,6 +19,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/image v0.21.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
-	gonum.org/v1/gonum v0.15.1 // indirect
-	gonum.org/v1/plot v0.15.0 // indirect
 )
+
+replace diffcoex => ../diffcoex
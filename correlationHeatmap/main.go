@@ -1,266 +1,335 @@
-// Jason Hyun (jasonhyu)
-// Siddharth Sabata (ssabata)
-// Darrick Lo (ddlo)
-// Katie Wang (kcw2)
-
-// Dec 1, 2024
-
-// NOTE: Generative AI used to produce following code:
-
-package main
-
-import (
-	"encoding/csv"
-	"math"
-	"sort"
-
-	"log"
-	"os"
-	"path/filepath"
-	"strconv"
-
-	"math/rand"
-	"time"
-
-	"gonum.org/v1/gonum/mat"
-	"gonum.org/v1/gonum/stat"
-	"gonum.org/v1/plot"
-	"gonum.org/v1/plot/palette/moreland"
-	"gonum.org/v1/plot/plotter"
-	"gonum.org/v1/plot/vg"
-	"gonum.org/v1/plot/vg/draw"
-)
-
-// MatrixGrid wraps a *mat.Dense and implements the plotter.GridXYZ interface
-type MatrixGrid struct {
-	*mat.Dense
-}
-
-func (m MatrixGrid) Dims() (c, r int) {
-	return m.Dense.Dims()
-}
-
-func (m MatrixGrid) Z(c, r int) float64 {
-	return m.At(r, c)
-}
-
-func (m MatrixGrid) X(c int) float64 {
-	return float64(c)
-}
-
-func (m MatrixGrid) Y(r int) float64 {
-	return float64(r)
-}
-
-// ReadCSV reads a CSV file, excluding the first row and first column, and returns a 2D array of float64 and the first column as an array of strings.
-func ReadCSV(fileName string) ([][]float64, []string, error) {
-	file, err := os.Open(fileName)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer file.Close()
-
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var data [][]float64
-	var genes []string
-
-	// Process all rows including header
-	for _, row := range records {
-		var rowData []float64
-		for j, value := range row {
-			if j == 0 {
-				// Save the first column as genes (including the header)
-				genes = append(genes, value)
-				continue
-			}
-
-			floatValue, err := strconv.ParseFloat(value, 64)
-			if err != nil {
-				return nil, nil, err
-			}
-			rowData = append(rowData, floatValue)
-		}
-		data = append(data, rowData)
-	}
-
-	return data, genes, nil // Return all genes including the header
-}
-
-// MergeMatrices merges two 2D arrays such that the upper triangular part (including the diagonal) comes from the first matrix and the lower triangular part comes from the second matrix.
-func MergeMatrices(matrix1, matrix2 [][]float64) [][]float64 {
-	rows := len(matrix1)
-	cols := len(matrix1[0])
-	merged := make([][]float64, rows)
-	for i := range merged {
-		merged[i] = make([]float64, cols)
-		for j := 0; j < cols; j++ {
-			if i <= j {
-				merged[i][j] = matrix1[i][j]
-			} else {
-				merged[i][j] = matrix2[i][j]
-			}
-		}
-	}
-
-	return merged
-}
-
-func main() {
-	// ./correlationHeatmap condition1Data condition2Data
-	// Check if correct number of arguments are provided
-	if len(os.Args) != 3 {
-		log.Fatalf("Usage: %s condition1Data condition2Data\n", os.Args[0])
-	}
-
-	// Get file names from command line arguments
-	condition1File := os.Args[1]
-	condition2File := os.Args[2]
-
-	// Read the CSV files
-	matrix1, genes, err := ReadCSV(condition1File)
-	if err != nil {
-		log.Fatalf("Error reading %s: %v", condition1File, err)
-	}
-
-	matrix2, _, err := ReadCSV(condition2File)
-	if err != nil {
-		log.Fatalf("Error reading %s: %v", condition2File, err)
-	}
-
-	// Find minimum number of columns between the two matrices
-	minCols := len(matrix1[0])
-	if len(matrix2[0]) < minCols {
-		minCols = len(matrix2[0])
-	}
-
-	// Create output/plotting directory if it doesn't exist
-	outputDir := "output/plotting"
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		log.Fatalf("Error creating output directory: %v", err)
-	}
-
-	// Create a color palette
-	palette := moreland.Kindlmann().Palette(256)
-
-	var mergedMatrix [][]float64
-	n := len(matrix1)
-
-	if n > 50 {
-		// Create a list of indices and shuffle it
-		rand.Seed(time.Now().UnixNano())
-		indices := make([]int, n)
-		for i := range indices {
-			indices[i] = i
-		}
-		rand.Shuffle(len(indices), func(i, j int) {
-			indices[i], indices[j] = indices[j], indices[i]
-		})
-
-		// Take first 50 indices and sort them
-		indices = indices[:50]
-		sort.Ints(indices)
-
-		// Create matrices with selected genes
-		matrix1Dense := mat.NewDense(50, minCols, nil)
-		matrix2Dense := mat.NewDense(50, minCols, nil)
-
-		// Fill the dense matrices using selected genes
-		for i := 0; i < 50; i++ {
-			idx := indices[i]
-			for j := 0; j < minCols; j++ {
-				matrix1Dense.Set(i, j, matrix1[idx][j])
-				matrix2Dense.Set(i, j, matrix2[idx][j])
-			}
-		}
-
-		// Update genes list to match selected indices
-		newGenes := make([]string, 50)
-		for i, idx := range indices {
-			newGenes[i] = genes[idx]
-		}
-		genes = newGenes
-
-		// Calculate correlations for the 50 selected genes
-		matrix1Corr := mat.NewDense(50, 50, nil)
-		matrix2Corr := mat.NewDense(50, 50, nil)
-
-		// Calculate correlations for condition 1
-		for i := 0; i < 50; i++ {
-			row1i := mat.Row(nil, i, matrix1Dense)
-			for j := 0; j < 50; j++ {
-				row1j := mat.Row(nil, j, matrix1Dense)
-				corr := stat.Correlation(row1i, row1j, nil)
-				matrix1Corr.Set(i, j, corr)
-			}
-		}
-
-		// Calculate correlations for condition 2
-		for i := 0; i < 50; i++ {
-			row2i := mat.Row(nil, i, matrix2Dense)
-			for j := 0; j < 50; j++ {
-				row2j := mat.Row(nil, j, matrix2Dense)
-				corr := stat.Correlation(row2i, row2j, nil)
-				matrix2Corr.Set(i, j, corr)
-			}
-		}
-
-		// Convert mat.Dense to [][]float64 for merging
-		matrix1CorrSlice := make([][]float64, 50)
-		matrix2CorrSlice := make([][]float64, 50)
-		for i := 0; i < 50; i++ {
-			matrix1CorrSlice[i] = make([]float64, 50)
-			matrix2CorrSlice[i] = make([]float64, 50)
-			for j := 0; j < 50; j++ {
-				matrix1CorrSlice[i][j] = matrix1Corr.At(i, j)
-				matrix2CorrSlice[i][j] = matrix2Corr.At(i, j)
-			}
-		}
-
-		mergedMatrix = MergeMatrices(matrix1CorrSlice, matrix2CorrSlice)
-		n = 50 // Update n for plotting
-	} else {
-		// For small matrices, trim to minimum columns and merge directly
-		matrix1Trimmed := make([][]float64, n)
-		matrix2Trimmed := make([][]float64, n)
-		for i := 0; i < n; i++ {
-			matrix1Trimmed[i] = matrix1[i][:minCols]
-			matrix2Trimmed[i] = matrix2[i][:minCols]
-		}
-		mergedMatrix = MergeMatrices(matrix1Trimmed, matrix2Trimmed)
-	}
-
-	// Flatten the merged matrix for mat.Dense
-	flattenedMatrix := make([]float64, n*n)
-	for i := range mergedMatrix {
-		for j := range mergedMatrix[i] {
-			flattenedMatrix[i*n+j] = mergedMatrix[i][j]
-		}
-	}
-
-	// Create merged heatmap
-	pMerged := plot.New()
-	pMerged.Title.Text = "Merged Heat Map"
-	pMerged.X.Label.Text = "Genes"
-	pMerged.Y.Label.Text = "Genes"
-
-	gridMerged := MatrixGrid{mat.NewDense(n, n, flattenedMatrix)}
-	hMerged := plotter.NewHeatMap(gridMerged, palette)
-	pMerged.Add(hMerged)
-
-	// Add gene labels
-	pMerged.NominalX(genes...)
-	pMerged.NominalY(genes...)
-	pMerged.X.Tick.Label.Rotation = math.Pi * -0.5
-	pMerged.X.Tick.Label.YAlign = draw.YCenter
-	pMerged.X.Tick.Label.XAlign = draw.XRight
-
-	// Save the merged heatmap to output/plotting directory
-	if err := pMerged.Save(10*vg.Inch, 10*vg.Inch, filepath.Join(outputDir, "heatmap_merged.png")); err != nil {
-		panic(err)
-	}
-}
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+
+	"log"
+	"os"
+	"path/filepath"
+
+	"math/rand"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/moreland"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// MatrixGrid wraps a *mat.Dense and implements the plotter.GridXYZ interface
+type MatrixGrid struct {
+	*mat.Dense
+}
+
+func (m MatrixGrid) Dims() (c, r int) {
+	return m.Dense.Dims()
+}
+
+func (m MatrixGrid) Z(c, r int) float64 {
+	return m.At(r, c)
+}
+
+func (m MatrixGrid) X(c int) float64 {
+	return float64(c)
+}
+
+func (m MatrixGrid) Y(r int) float64 {
+	return float64(r)
+}
+
+// ReadCSV reads an expression matrix file and returns its values as a 2D array of float64, NaN where missing, and the gene IDs as an array of strings.
+func ReadCSV(fileName string) ([][]float64, []string, error) {
+	matrix, err := diffcoex.ReadExpressionMatrix(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return matrix.Values, matrix.GeneIDs, nil
+}
+
+// MergeMatrices merges two 2D arrays such that the upper triangular part (including the diagonal) comes from the first matrix and the lower triangular part comes from the second matrix.
+func MergeMatrices(matrix1, matrix2 [][]float64) [][]float64 {
+	rows := len(matrix1)
+	cols := len(matrix1[0])
+	merged := make([][]float64, rows)
+	for i := range merged {
+		merged[i] = make([]float64, cols)
+		for j := 0; j < cols; j++ {
+			if i <= j {
+				merged[i][j] = matrix1[i][j]
+			} else {
+				merged[i][j] = matrix2[i][j]
+			}
+		}
+	}
+
+	return merged
+}
+
+// checkSameGenes returns an error unless the two conditions list the same
+// genes in the same order
+func checkSameGenes(genes1, genes2 []string) error {
+	if len(genes1) != len(genes2) {
+		return fmt.Errorf("condition 1 has %d genes and condition 2 has %d", len(genes1), len(genes2))
+	}
+	for i := range genes1 {
+		if genes1[i] != genes2[i] {
+			return fmt.Errorf("gene %d is %s in condition 1 and %s in condition 2", i+1, genes1[i], genes2[i])
+		}
+	}
+	return nil
+}
+
+// indicesUpTo returns the indices 0 to n-1
+func indicesUpTo(n int) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+func main() {
+	// ./correlationHeatmap [options] condition1Data condition2Data
+	strict := flag.Bool("strict", false,
+		"fail on any input problem (duplicate IDs, ragged rows, non-numeric, NaN/Inf or empty values)")
+	warningsPath := flag.String("warnings", "",
+		"tab-separated file listing the input problems found in lenient mode (default: <output>/plotting/validation_warnings.tsv)")
+	output := flag.String("output", "output",
+		"output directory shared with preprocess; heatmaps go to its plotting directory")
+	configPath := flag.String("config", "",
+		"JSON config file shared with preprocess; its heatmap section gives condition1 and condition2")
+	correlation := flag.String("correlation", diffcoex.CorrelationPearson,
+		"correlation measure: 'pearson', 'spearman' (as clustering.R), 'bicor' (biweight midcorrelation) or 'kendall' (tau-b)")
+	maxPOutliers := flag.Float64("max-p-outliers", 1,
+		"bicor only: the largest fraction of each side of the median treated as outliers (1 keeps the plain biweight)")
+	adjacency := flag.String("adjacency", diffcoex.CacheNone,
+		"also write the DiffCoEx adjacency difference of every pair of genes as a tiled file: 'float32', 'float64' or 'none'")
+	beta := flag.Float64("beta", 6,
+		"soft threshold of the adjacency difference, as beta1 in clustering.R")
+	adjacencyThreshold := flag.Float64("adjacency-threshold", 0,
+		"also list the pairs of genes whose adjacency difference is at least this in adjacency_edges.tsv (0 lists none)")
+	minSamples := flag.Int("min-samples", 3,
+		"fewest samples observed in both genes for a pair to have a correlation; missing values are left out pair by pair")
+	seed := flag.Int64("seed", 0,
+		"seed choosing the 50 genes shown when there are more, any value including 0 (default: taken from the clock, and recorded in the manifest)")
+	verifyPath := flag.String("verify", "",
+		"check the input and output files of a provenance manifest against the files on disk, then exit")
+	flag.Parse()
+	if *verifyPath != "" {
+		os.Exit(diffcoex.RunVerify(*verifyPath))
+	}
+	manifest := diffcoex.NewManifest("correlationHeatmap")
+
+	// Read the settings missing from the command line from the config
+	config := diffcoex.Config{}
+	arguments := map[string]string{}
+	if *configPath != "" {
+		var err error
+		if config, err = diffcoex.ReadConfig(*configPath); err != nil {
+			log.Fatalf("Error reading config: %v", err)
+		}
+		if arguments, err = diffcoex.ApplyConfig(config, "heatmap", []string{"condition1", "condition2"}); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		pairs, err := config.ConditionPairs()
+		if err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		if len(pairs) > 0 && arguments["condition1"] == "" && arguments["condition2"] == "" {
+			arguments["condition1"], arguments["condition2"] = pairs[0][0], pairs[0][1]
+		}
+	}
+
+	// Get file names from command line arguments
+	if flag.NArg() == 2 {
+		arguments["condition1"], arguments["condition2"] = flag.Arg(0), flag.Arg(1)
+	} else if flag.NArg() != 0 || arguments["condition1"] == "" || arguments["condition2"] == "" {
+		log.Fatalf("Usage: %s [options] condition1Data condition2Data\n       %s -config <config.json> [options]\n", os.Args[0], os.Args[0])
+	}
+	condition1File := diffcoex.ResolveCondition(arguments["condition1"], *output)
+	condition2File := diffcoex.ResolveCondition(arguments["condition2"], *output)
+	diffcoex.StrictValidation = *strict
+	if !diffcoex.FlagGiven("seed") {
+		*seed = diffcoex.NewSeed()
+	}
+	method, err := diffcoex.ParseCorrelationMethod(*correlation, *maxPOutliers, *minSamples)
+	if err != nil {
+		log.Fatalf("Invalid -correlation: %v", err)
+	}
+	if *adjacency != diffcoex.CacheNone {
+		if _, err := diffcoex.CacheValueSize(*adjacency); err != nil {
+			log.Fatalf("Invalid -adjacency: %v", err)
+		}
+	}
+	runConfig, err := diffcoex.EffectiveConfig(config, "heatmap", arguments)
+	if err != nil {
+		log.Fatalf("Error recording config: %v", err)
+	}
+
+	// Read the CSV files
+	matrix1, genes, err := ReadCSV(condition1File)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", condition1File, err)
+	}
+
+	matrix2, genes2, err := ReadCSV(condition2File)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", condition2File, err)
+	}
+
+	// The rows of the two conditions are paired by index, so they must be
+	// the same genes in the same order
+	if len(matrix1) == 0 || len(matrix2) == 0 {
+		log.Fatalf("Error: %s has %d genes and %s has %d; both conditions need genes",
+			condition1File, len(matrix1), condition2File, len(matrix2))
+	}
+	if err := checkSameGenes(genes, genes2); err != nil {
+		log.Fatalf("Error: %s and %s must list the same genes in the same order: %v",
+			condition1File, condition2File, err)
+	}
+
+	// Create output/plotting directory if it doesn't exist
+	outputDir := filepath.Join(*output, "plotting")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		log.Fatalf("Error creating output directory: %v", err)
+	}
+	warningsFile := *warningsPath
+	if warningsFile == "" {
+		warningsFile = filepath.Join(outputDir, "validation_warnings.tsv")
+	}
+
+	if len(diffcoex.ValidationWarnings) > 0 {
+		if err := diffcoex.WriteValidationWarnings(warningsFile); err != nil {
+			log.Fatalf("Error writing validation warnings: %v", err)
+		}
+		diffcoex.RecordOutput(warningsFile)
+		fmt.Printf("%d input problems were found, see %s\n", len(diffcoex.ValidationWarnings), warningsFile)
+	}
+
+	// Compute the adjacency difference of every gene from the whole matrices,
+	// before the genes shown are chosen
+	if *adjacency != diffcoex.CacheNone {
+		fmt.Printf("Writing the adjacency difference of %d genes...\n", len(genes))
+		condition1 := diffcoex.NewCorrelationEngineFromRows(genes, matrix1, len(matrix1[0]), method)
+		condition2 := diffcoex.NewCorrelationEngineFromRows(genes, matrix2, len(matrix2[0]), method)
+		if err := writeAdjacencyDifference(outputDir, condition1, condition2, *adjacency, *beta, *adjacencyThreshold); err != nil {
+			log.Fatalf("Error writing the adjacency difference: %v", err)
+		}
+	}
+
+	// Create a color palette
+	palette := moreland.Kindlmann().Palette(256)
+
+	// Show every gene, or 50 random genes of larger matrices
+	n := len(matrix1)
+	indices := indicesUpTo(n)
+	if n > 50 {
+		// Shuffle the indices, take the first 50 and sort them
+		r := rand.New(rand.NewSource(*seed))
+		r.Shuffle(len(indices), func(i, j int) {
+			indices[i], indices[j] = indices[j], indices[i]
+		})
+		indices = indices[:50]
+		sort.Ints(indices)
+		n = 50 // Update n for plotting
+	}
+
+	// Select the rows of the chosen genes
+	rows1 := make([][]float64, n)
+	rows2 := make([][]float64, n)
+	newGenes := make([]string, n)
+	for i, idx := range indices {
+		rows1[i] = matrix1[idx]
+		rows2[i] = matrix2[idx]
+		newGenes[i] = genes[idx]
+	}
+	genes = newGenes
+
+	// Calculate the correlations of the chosen genes in each condition, each
+	// over its own samples
+	all := indicesUpTo(n)
+	matrix1Corr := diffcoex.NewCorrelationEngineFromRows(genes, rows1, len(matrix1[0]), method).Block(all, all)
+	matrix2Corr := diffcoex.NewCorrelationEngineFromRows(genes, rows2, len(matrix2[0]), method).Block(all, all)
+
+	// Convert mat.Dense to [][]float64 for merging
+	matrix1CorrSlice := make([][]float64, n)
+	matrix2CorrSlice := make([][]float64, n)
+	for i := 0; i < n; i++ {
+		matrix1CorrSlice[i] = mat.Row(nil, i, matrix1Corr)
+		matrix2CorrSlice[i] = mat.Row(nil, i, matrix2Corr)
+	}
+	mergedMatrix := MergeMatrices(matrix1CorrSlice, matrix2CorrSlice)
+
+	// Flatten the merged matrix for mat.Dense
+	flattenedMatrix := make([]float64, n*n)
+	for i := range mergedMatrix {
+		for j := range mergedMatrix[i] {
+			flattenedMatrix[i*n+j] = mergedMatrix[i][j]
+		}
+	}
+
+	// Create merged heatmap
+	pMerged := plot.New()
+	pMerged.Title.Text = fmt.Sprintf("Merged Heat Map (%s correlation)", method)
+	pMerged.X.Label.Text = "Genes"
+	pMerged.Y.Label.Text = "Genes"
+
+	gridMerged := MatrixGrid{mat.NewDense(n, n, flattenedMatrix)}
+	hMerged := plotter.NewHeatMap(gridMerged, palette)
+	pMerged.Add(hMerged)
+
+	// Add gene labels
+	pMerged.NominalX(genes...)
+	pMerged.NominalY(genes...)
+	pMerged.X.Tick.Label.Rotation = math.Pi * -0.5
+	pMerged.X.Tick.Label.YAlign = draw.YCenter
+	pMerged.X.Tick.Label.XAlign = draw.XRight
+
+	// Save the merged heatmap to output/plotting directory
+	if err := pMerged.Save(10*vg.Inch, 10*vg.Inch, filepath.Join(outputDir, "heatmap_merged.png")); err != nil {
+		panic(err)
+	}
+	diffcoex.RecordOutput(filepath.Join(outputDir, "heatmap_merged.png"))
+
+	// Record the config next to the heatmaps so that the run can be repeated
+	configFile := filepath.Join(outputDir, "heatmap_config.json")
+	if err := diffcoex.WriteEffectiveConfig(runConfig, configFile); err != nil {
+		log.Fatalf("Error writing config: %v", err)
+	}
+	diffcoex.RecordOutput(configFile)
+
+	// Record the provenance of the heatmaps
+	manifest.SetConfig(runConfig)
+	if err := manifest.AddInputs(*configPath, condition1File, condition2File); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+	if err := manifest.AddInputs(diffcoex.MatrixCachesRead...); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+	if err := manifest.AddOutputs(diffcoex.OutputFiles...); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+	manifest.Counts["genes"] = len(matrix1)
+	manifest.Counts["genes shown"] = len(genes)
+	manifest.Counts["condition1 samples"] = len(matrix1[0])
+	manifest.Counts["condition2 samples"] = len(matrix2[0])
+	manifest.Seeds["genes shown"] = *seed
+	if err := manifest.Write(filepath.Join(outputDir, "heatmap_manifest.json")); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+}
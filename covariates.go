@@ -0,0 +1,187 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	Covariate regression fits, for every gene, a linear model of its
+	expression on the sample sheet covariates and keeps the residuals. A
+	covariate whose values are all numbers is used as is; any other covariate
+	is categorical and coded with one indicator per level after the first.
+	Covariate columns are centered, so the residuals keep each gene's mean.
+	When the model is fitted jointly over all conditions, the condition is
+	part of the model, so that covariate effects are not confused with
+	condition effects, but only the covariate effects are removed.
+*/
+
+// Covariate regression modes
+const (
+	RegressJoint  = "joint"  // one model over all conditions
+	RegressWithin = "within" // one model per condition
+)
+
+// CovariateOptions selects the covariates to regress out
+type CovariateOptions struct {
+	Names []string
+	Mode  string
+}
+
+// covariateDesign builds the centered design columns of the named covariates
+// for the given samples and returns them with their column names
+func covariateDesign(samples []SampleInfo, names []string) (*mat.Dense, []string, error) {
+	var columns [][]float64
+	var columnNames []string
+	for _, name := range names {
+		values := make([]string, len(samples))
+		numeric := true
+		for j, sample := range samples {
+			value, ok := sample.Covariates[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("covariate %s is not in the sample sheet", name)
+			}
+			if diffcoex.IsMissingToken(value) {
+				return nil, nil, fmt.Errorf("sample %s has no value for covariate %s", sample.SampleID, name)
+			}
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				numeric = false
+			}
+			values[j] = value
+		}
+
+		if numeric {
+			column := make([]float64, len(samples))
+			for j, value := range values {
+				column[j], _ = strconv.ParseFloat(value, 64)
+			}
+			columns = append(columns, column)
+			columnNames = append(columnNames, name)
+			continue
+		}
+		levels, index := factorLevels(values)
+		for level := 1; level < len(levels); level++ {
+			column := make([]float64, len(samples))
+			for j := range samples {
+				if index[j] == level {
+					column[j] = 1
+				}
+			}
+			columns = append(columns, column)
+			columnNames = append(columnNames, name+"="+levels[level])
+		}
+	}
+	if len(columns) == 0 {
+		return nil, nil, fmt.Errorf("covariates %s have no variation", strings.Join(names, ", "))
+	}
+
+	design := mat.NewDense(len(samples), len(columns), nil)
+	for k, column := range columns {
+		mean, _ := nanMeanSD(column)
+		for j, v := range column {
+			design.Set(j, k, v-mean)
+		}
+	}
+	return design, columnNames, nil
+}
+
+// RegressCovariates removes the covariate effects from data (genes by
+// samples). The model has an intercept, the optional protected columns
+// (such as condition indicators), whose effects are kept, and the covariate
+// columns, whose fitted effects are subtracted.
+func RegressCovariates(data, protected, covariates *mat.Dense) (*mat.Dense, error) {
+	genes, samples := data.Dims()
+	for i := 0; i < genes; i++ {
+		for j := 0; j < samples; j++ {
+			if isMissing(data.At(i, j)) {
+				return nil, fmt.Errorf("covariate regression needs complete data, impute missing values first")
+			}
+		}
+	}
+
+	// Design: intercept, protected columns, covariate columns
+	kept := 1
+	if protected != nil {
+		_, p := protected.Dims()
+		kept += p
+	}
+	_, covariateColumns := covariates.Dims()
+	columns := kept + covariateColumns
+	if columns >= samples {
+		return nil, fmt.Errorf("the model has %d terms but only %d samples", columns, samples)
+	}
+	design := mat.NewDense(samples, columns, nil)
+	for j := 0; j < samples; j++ {
+		design.Set(j, 0, 1)
+		for k := 1; k < kept; k++ {
+			design.Set(j, k, protected.At(j, k-1))
+		}
+		for k := 0; k < covariateColumns; k++ {
+			design.Set(j, kept+k, covariates.At(j, k))
+		}
+	}
+
+	// Least squares fit of every gene: B = (X'X)^-1 X'Y'
+	var xtx, xty, coefficients mat.Dense
+	xtx.Mul(design.T(), design)
+	xty.Mul(design.T(), data.T())
+	if err := coefficients.Solve(&xtx, &xty); err != nil {
+		return nil, fmt.Errorf("the covariates are collinear: %v", err)
+	}
+
+	// Subtract the fitted covariate effects
+	var effects mat.Dense
+	effects.Mul(design.Slice(0, samples, kept, columns), coefficients.Slice(kept, columns, 0, genes))
+	residuals := mat.NewDense(genes, samples, nil)
+	residuals.Sub(data, effects.T())
+	return residuals, nil
+}
+
+// conditionDesign returns one indicator column per condition after the first
+func conditionDesign(samples []SampleInfo) *mat.Dense {
+	conditions := make([]string, len(samples))
+	for j, sample := range samples {
+		conditions[j] = sample.Condition
+	}
+	levels, index := factorLevels(conditions)
+	if len(levels) < 2 {
+		return nil
+	}
+	design := mat.NewDense(len(samples), len(levels)-1, nil)
+	for j := range samples {
+		if index[j] > 0 {
+			design.Set(j, index[j]-1, 1)
+		}
+	}
+	return design
+}
+
+// sheetSamples returns the sample sheet rows of the given samples, in order
+func sheetSamples(sheet *SampleSheet, sampleIDs []string) ([]SampleInfo, error) {
+	rows := make(map[string]SampleInfo, len(sheet.Samples))
+	for _, sample := range sheet.Samples {
+		rows[sample.SampleID] = sample
+	}
+	samples := make([]SampleInfo, len(sampleIDs))
+	for j, id := range sampleIDs {
+		sample, ok := rows[id]
+		if !ok {
+			return nil, fmt.Errorf("sample %s is not in the sample sheet", id)
+		}
+		samples[j] = sample
+	}
+	return samples, nil
+}
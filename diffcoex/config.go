@@ -0,0 +1,321 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	A JSON config file (-config) can replace the command line of every tool.
+	Its top-level keys are the preprocess flags without the dash, plus:
+
+		"dataset", "input"   the preprocess arguments
+		"output"             the output directory shared by every tool
+		"condition-pairs"    pairs of conditions compared downstream
+		"significance", "plotting", "heatmap"
+		                     sections holding the keys of the other tools
+
+	For example:
+
+		{
+			"dataset": "matrix",
+			"input": "data/expression.txt",
+			"samples": "data/samples.tsv",
+			"normalize": "auto-log,quantile",
+			"top": 5000,
+			"output": "results",
+			"condition-pairs": [["AML", "ALL"]],
+			"significance": {"modules": "results/modules.csv"}
+		}
+
+	Values may be strings, numbers, booleans or lists, which are joined with
+	commas. Flags given on the command line win over the config. Each tool
+	embeds the config it actually ran with in its outputs, so that passing
+	that config back reproduces the run.
+*/
+
+// configSections are the keys holding the settings of one downstream tool
+var configSections = []string{"significance", "plotting", "heatmap"}
+
+// sharedConfigKeys are the top-level keys every tool reads
+var sharedConfigKeys = []string{"output", "strict", "condition-pairs"}
+
+// ConditionManifestName is the file, in the output directory, mapping each
+// condition written by preprocess to its file in every profile
+const ConditionManifestName = "conditions.tsv"
+
+// Config is a parsed config file, keyed by its top-level keys
+type Config map[string]json.RawMessage
+
+// ReadConfig reads a JSON config file
+func ReadConfig(filename string) (Config, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %v", err)
+	}
+	config := Config{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// settings returns the keys a tool reads: every top-level key except the
+// sections for preprocess (section ""), or the shared top-level keys and the
+// keys of its section for the other tools
+func (c Config) settings(section string) (map[string]json.RawMessage, error) {
+	settings := make(map[string]json.RawMessage)
+	if section == "" {
+		for key, value := range c {
+			if !slices.Contains(configSections, key) {
+				settings[key] = value
+			}
+		}
+		return settings, nil
+	}
+
+	for _, key := range sharedConfigKeys {
+		if value, ok := c[key]; ok {
+			settings[key] = value
+		}
+	}
+	if raw, ok := c[section]; ok {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, fmt.Errorf("config section %s is not an object: %v", section, err)
+		}
+		for key, value := range values {
+			settings[key] = value
+		}
+	}
+	return settings, nil
+}
+
+// ConfigString converts a config value to a flag value. Lists are joined
+// with commas.
+func ConfigString(raw json.RawMessage) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			encoded, _ := json.Marshal(item)
+			text, err := ConfigString(encoded)
+			if err != nil {
+				return "", err
+			}
+			items[i] = text
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %s", string(raw))
+}
+
+// ApplyConfig sets the flags not given on the command line from the settings
+// of a tool, and returns the settings named in arguments as strings. Any
+// other setting of the tool that is not a flag is an error.
+func ApplyConfig(c Config, section string, arguments []string) (map[string]string, error) {
+	settings, err := c.settings(section)
+	if err != nil {
+		return nil, err
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	values := make(map[string]string)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "condition-pairs" {
+			continue
+		}
+		value, err := ConfigString(settings[key])
+		if err != nil {
+			return nil, fmt.Errorf("config key %s: %v", key, err)
+		}
+		switch {
+		case slices.Contains(arguments, key):
+			values[key] = value
+		case flag.Lookup(key) != nil:
+			if given[key] {
+				continue
+			}
+			if err := flag.Set(key, value); err != nil {
+				return nil, fmt.Errorf("config key %s: %v", key, err)
+			}
+		case section != "" && slices.Contains(sharedConfigKeys, key):
+			// A shared key this tool does not use
+		default:
+			return nil, fmt.Errorf("unknown config key %q", key)
+		}
+	}
+	return values, nil
+}
+
+// FlagGiven reports whether a flag was set, on the command line or by
+// ApplyConfig, so that its zero value can be told from its default
+func FlagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// ConditionPairs returns the condition pairs of the config
+func (c Config) ConditionPairs() ([][2]string, error) {
+	raw, ok := c["condition-pairs"]
+	if !ok {
+		return nil, nil
+	}
+	var pairs [][2]string
+	if err := json.Unmarshal(raw, &pairs); err != nil {
+		return nil, fmt.Errorf("condition-pairs must be a list of [condition1, condition2] pairs: %v", err)
+	}
+	return pairs, nil
+}
+
+// EffectiveConfig returns the config a tool ran with as JSON: the original
+// config with the keys of the tool's section (or the top level for section
+// "") set to every flag value, except -config and -verify, and the given
+// arguments
+func EffectiveConfig(c Config, section string, arguments map[string]string) (string, error) {
+	values := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "verify" {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	for key, value := range arguments {
+		values[key] = value
+	}
+
+	result := make(map[string]json.RawMessage, len(c))
+	for key, value := range c {
+		result[key] = value
+	}
+	target := result
+	if section != "" {
+		target = make(map[string]json.RawMessage)
+		if raw, ok := c[section]; ok {
+			if err := json.Unmarshal(raw, &target); err != nil {
+				return "", fmt.Errorf("config section %s is not an object: %v", section, err)
+			}
+		}
+	}
+	for key, value := range values {
+		encoded, _ := json.Marshal(value)
+		if section != "" && slices.Contains(sharedConfigKeys, key) {
+			// Shared keys live at the top level, where every tool reads them
+			result[key] = encoded
+			delete(target, key)
+			continue
+		}
+		target[key] = encoded
+	}
+	if section != "" {
+		encoded, _ := json.Marshal(target)
+		result[section] = encoded
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("error encoding config: %v", err)
+	}
+	return string(encoded), nil
+}
+
+// WriteEffectiveConfig writes the config a tool ran with, indented, to a file
+func WriteEffectiveConfig(config, filename string) error {
+	var indented strings.Builder
+	var value interface{}
+	if err := json.Unmarshal([]byte(config), &value); err != nil {
+		return fmt.Errorf("error encoding config: %v", err)
+	}
+	encoder := json.NewEncoder(&indented)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Errorf("error encoding config: %v", err)
+	}
+	if err := os.WriteFile(filename, []byte(indented.String()), 0644); err != nil {
+		return fmt.Errorf("error writing config: %v", err)
+	}
+	return nil
+}
+
+// readConditionManifest reads the conditions written by preprocess and
+// returns the file of each condition in the diffcoex profile, or in the first
+// profile if there is no diffcoex profile
+func readConditionManifest(outputDir string) (map[string]string, error) {
+	file, err := os.Open(filepath.Join(outputDir, ConditionManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("error opening condition manifest: %v", err)
+	}
+	defer file.Close()
+
+	files := make(map[string]string)
+	column := 1
+	scanner := bufio.NewScanner(file)
+	for first := true; scanner.Scan(); first = false {
+		fields := strings.Split(scanner.Text(), "\t")
+		if first {
+			for i, name := range fields {
+				if name == "diffcoex" {
+					column = i
+				}
+			}
+			continue
+		}
+		if len(fields) > column {
+			files[fields[0]] = fields[column]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading condition manifest: %v", err)
+	}
+	return files, nil
+}
+
+// ResolveCondition returns the DiffCoEx file of a condition written by
+// preprocess, or the value itself if it is not a known condition
+func ResolveCondition(value, outputDir string) string {
+	files, err := readConditionManifest(outputDir)
+	if err != nil {
+		return value
+	}
+	if file, ok := files[value]; ok {
+		return file
+	}
+	return value
+}
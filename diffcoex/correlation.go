@@ -0,0 +1,546 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	The correlation engine standardizes every gene once: its expression is
+	centered and scaled to unit length, so the Pearson correlation of two
+	genes is the dot product of their rows. A block of correlations between
+	two gene sets is then one product Z_a·Z_bᵀ, computed by gonum with BLAS,
+	instead of one stat.Correlation call per pair. Genes with constant
+	expression have no correlation (NaN), which module correlations leave
+	out.
+
+	Expression stays aligned by sample, with NaN where a value is missing.
+	Correlations involving a gene with missing values are computed pair by
+	pair on the samples observed in both genes (pairwise-complete), and every
+	correlation comes with that number of samples. Pairs observed together in
+	fewer than MinSamples samples have no correlation.
+
+	The correlation measure is selectable, so the tests can measure what
+	clustering.R used to find the modules:
+
+		pearson    Pearson correlation
+		spearman   Pearson correlation of the ranks, ties getting their
+		           average rank
+		bicor      WGCNA's biweight midcorrelation: values are weighted by
+		           their distance to the median in units of 9 MADs, so
+		           outliers count less. maxPOutliers (below 1) widens the
+		           weight function so that at most that fraction of each side
+		           of the median is an outlier. Genes with a MAD of zero fall
+		           back to Pearson, as in WGCNA.
+		kendall    Kendall's tau-b, which accounts for ties. It is not a dot
+		           product, so it is computed pair by pair.
+*/
+
+// Correlation measures, as given to -correlation
+const (
+	CorrelationPearson  = "pearson"
+	CorrelationSpearman = "spearman"
+	CorrelationBicor    = "bicor"
+	CorrelationKendall  = "kendall"
+)
+
+// CorrelationBlockSize is the number of module genes whose correlations are
+// computed in one product, which bounds the memory of large modules
+const CorrelationBlockSize = 512
+
+// CorrelationMethod is a correlation measure and its parameters
+type CorrelationMethod struct {
+	Name         string
+	MaxPOutliers float64 // bicor only; 1 leaves the weight function as is
+	MinSamples   int     // fewest samples observed in both genes of a pair
+}
+
+// ParseCorrelationMethod checks a correlation measure and its parameters
+func ParseCorrelationMethod(name string, maxPOutliers float64, minSamples int) (CorrelationMethod, error) {
+	switch name {
+	case CorrelationPearson, CorrelationSpearman, CorrelationBicor, CorrelationKendall:
+	default:
+		return CorrelationMethod{}, fmt.Errorf("unknown correlation %q: use 'pearson', 'spearman', 'bicor' or 'kendall'", name)
+	}
+	if maxPOutliers <= 0 || maxPOutliers > 1 {
+		return CorrelationMethod{}, fmt.Errorf("maxPOutliers %v must be above 0 and at most 1", maxPOutliers)
+	}
+	if minSamples < 2 {
+		return CorrelationMethod{}, fmt.Errorf("minimum number of samples %d must be at least 2", minSamples)
+	}
+	return CorrelationMethod{Name: name, MaxPOutliers: maxPOutliers, MinSamples: minSamples}, nil
+}
+
+// String names the method as written in the results, e.g.
+// "bicor(maxPOutliers=0.05)"
+func (m CorrelationMethod) String() string {
+	if m.Name == CorrelationBicor && m.MaxPOutliers < 1 {
+		return fmt.Sprintf("bicor(maxPOutliers=%s)", strconv.FormatFloat(m.MaxPOutliers, 'g', -1, 64))
+	}
+	return m.Name
+}
+
+// CorrelationEngine holds the standardized expression of every gene of a
+// condition
+type CorrelationEngine struct {
+	method   CorrelationMethod
+	genes    []string
+	index    map[string]int
+	samples  int
+	z        *mat.Dense  // genes x samples, complete rows of zero mean and unit length
+	raw      [][]float64 // the expression itself, NaN where missing
+	complete []bool      // the gene has a value in every sample
+	constant []bool      // a complete gene with constant expression
+	missing  bool        // some gene is not complete
+}
+
+// NewCorrelationEngine standardizes the expression of every gene, whose
+// values are aligned by sample with NaN where missing. A gene with fewer
+// values than the others is missing the last samples. Genes are kept in
+// sorted order.
+func NewCorrelationEngine(data map[string][]float64, method CorrelationMethod) *CorrelationEngine {
+	genes := make([]string, 0, len(data))
+	samples := 0
+	for gene, expr := range data {
+		genes = append(genes, gene)
+		if len(expr) > samples {
+			samples = len(expr)
+		}
+	}
+	sort.Strings(genes)
+
+	rows := make([][]float64, len(genes))
+	for i, gene := range genes {
+		rows[i] = data[gene]
+	}
+	return NewCorrelationEngineFromRows(genes, rows, samples, method)
+}
+
+// NewCorrelationEngineFromRows standardizes the first samples values of each
+// row, in order. Rows with fewer values are missing the last samples.
+func NewCorrelationEngineFromRows(genes []string, rows [][]float64, samples int, method CorrelationMethod) *CorrelationEngine {
+	if samples < 0 {
+		samples = 0
+	}
+	e := &CorrelationEngine{
+		method:   method,
+		genes:    genes,
+		index:    make(map[string]int, len(genes)),
+		samples:  samples,
+		raw:      make([][]float64, len(rows)),
+		complete: make([]bool, len(rows)),
+		constant: make([]bool, len(rows)),
+	}
+	for i, gene := range genes {
+		e.index[gene] = i
+	}
+	for i, row := range rows {
+		if len(row) >= samples {
+			e.raw[i] = row[:samples]
+		} else {
+			e.raw[i] = make([]float64, samples)
+			copy(e.raw[i], row)
+			for j := len(row); j < samples; j++ {
+				e.raw[i][j] = math.NaN()
+			}
+		}
+		e.complete[i] = true
+		for _, v := range e.raw[i] {
+			if math.IsNaN(v) {
+				e.complete[i] = false
+				e.missing = true
+				break
+			}
+		}
+	}
+	if len(rows) == 0 || samples == 0 {
+		for i := range e.constant {
+			e.constant[i] = true
+		}
+		return e
+	}
+
+	if method.Name == CorrelationKendall {
+		for i := range rows {
+			e.constant[i] = e.complete[i] && !varies(e.raw[i])
+		}
+		return e
+	}
+
+	e.z = mat.NewDense(len(rows), samples, nil)
+	standardized := make([]float64, samples)
+	for i := range rows {
+		if !e.complete[i] {
+			continue
+		}
+		if !standardizeFor(method, e.raw[i], standardized) {
+			e.constant[i] = true
+			continue
+		}
+		e.z.SetRow(i, standardized)
+	}
+	return e
+}
+
+// standardizeFor standardizes values for a correlation measure into dst, so
+// that the correlation of two genes is the dot product of their rows. It
+// reports false if the values are constant or not finite.
+func standardizeFor(method CorrelationMethod, values, dst []float64) bool {
+	switch method.Name {
+	case CorrelationSpearman:
+		return standardize(ranks(values), dst)
+	case CorrelationBicor:
+		return standardizeBiweight(values, method.MaxPOutliers, dst)
+	}
+	return standardize(values, dst)
+}
+
+// Method returns the correlation measure of the engine
+func (e *CorrelationEngine) Method() CorrelationMethod {
+	return e.method
+}
+
+// standardize centers values and scales them to unit length into dst. It
+// reports false if the values are constant or not finite.
+func standardize(values, dst []float64) bool {
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	for i, v := range values {
+		dst[i] = v - mean
+	}
+	return normalize(dst)
+}
+
+// normalize scales values to unit length, reporting false if they are all
+// zero or not finite
+func normalize(values []float64) bool {
+	norm := 0.0
+	for _, v := range values {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 || math.IsNaN(norm) || math.IsInf(norm, 0) {
+		return false
+	}
+	for i := range values {
+		values[i] /= norm
+	}
+	return true
+}
+
+// ranks returns the ranks of values, starting at 1, tied values getting the
+// average of their ranks
+func ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return values[order[a]] < values[order[b]] })
+
+	ranked := make([]float64, len(values))
+	for start := 0; start < len(order); {
+		end := start + 1
+		for end < len(order) && values[order[end]] == values[order[start]] {
+			end++
+		}
+		rank := float64(start+end+1) / 2 // average of ranks start+1..end
+		for k := start; k < end; k++ {
+			ranked[order[k]] = rank
+		}
+		start = end
+	}
+	return ranked
+}
+
+// standardizeBiweight writes the biweight midcorrelation weights of values,
+// scaled to unit length, into dst, so that bicor is their dot product. A
+// MAD of zero falls back to Pearson.
+func standardizeBiweight(values []float64, maxPOutliers float64, dst []float64) bool {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	median := quantile(sorted, 0.5)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	sort.Float64s(deviations)
+	mad := quantile(deviations, 0.5)
+	if mad == 0 || math.IsNaN(mad) {
+		return standardize(values, dst)
+	}
+
+	// Widen each side of the weight function so that at most maxPOutliers
+	// of the values on that side have |u| above 1
+	lowScale, highScale := 1.0, 1.0
+	if maxPOutliers < 1 {
+		if low := (quantile(sorted, maxPOutliers) - median) / (9 * mad); low < -1 {
+			lowScale = -low
+		}
+		if high := (quantile(sorted, 1-maxPOutliers) - median) / (9 * mad); high > 1 {
+			highScale = high
+		}
+	}
+
+	for i, v := range values {
+		u := (v - median) / (9 * mad)
+		if u < 0 {
+			u /= lowScale
+		} else {
+			u /= highScale
+		}
+		weight := 0.0
+		if math.Abs(u) < 1 {
+			weight = (1 - u*u) * (1 - u*u)
+		}
+		dst[i] = (v - median) * weight
+	}
+	return normalize(dst)
+}
+
+// quantile returns the q quantile of sorted values, interpolating linearly
+// between order statistics as R's default quantile does
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	position := q * float64(len(sorted)-1)
+	lower := int(math.Floor(position))
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	fraction := position - float64(lower)
+	return sorted[lower] + fraction*(sorted[lower+1]-sorted[lower])
+}
+
+// varies reports whether values are finite and not all equal
+func varies(values []float64) bool {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// kendallTauB returns Kendall's tau-b of two series of the same length
+func kendallTauB(x, y []float64) float64 {
+	var score, tiedX, tiedY, pairs float64
+	for i := 0; i < len(x); i++ {
+		for j := i + 1; j < len(x); j++ {
+			dx := Sign(x[i] - x[j])
+			dy := Sign(y[i] - y[j])
+			score += dx * dy
+			if dx == 0 {
+				tiedX++
+			}
+			if dy == 0 {
+				tiedY++
+			}
+			pairs++
+		}
+	}
+	denominator := math.Sqrt((pairs - tiedX) * (pairs - tiedY))
+	if denominator == 0 {
+		return math.NaN()
+	}
+	return score / denominator
+}
+
+// pairCorrelation returns the correlation of two series of the same length
+// without missing values, or NaN if either is constant
+func pairCorrelation(method CorrelationMethod, x, y []float64) float64 {
+	if len(x) < 2 {
+		return math.NaN()
+	}
+	if method.Name == CorrelationKendall {
+		return kendallTauB(x, y)
+	}
+	zx := make([]float64, len(x))
+	zy := make([]float64, len(y))
+	if !standardizeFor(method, x, zx) || !standardizeFor(method, y, zy) {
+		return math.NaN()
+	}
+	corr := 0.0
+	for s := range zx {
+		corr += zx[s] * zy[s]
+	}
+	return corr
+}
+
+// Sign returns -1, 0 or 1
+func Sign(v float64) float64 {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// Genes returns the genes of the engine, in sorted order
+func (e *CorrelationEngine) Genes() []string {
+	return e.genes
+}
+
+// Indices returns the rows of the known genes among genes, in order
+func (e *CorrelationEngine) Indices(genes []string) []int {
+	indices := make([]int, 0, len(genes))
+	for _, gene := range genes {
+		if i, ok := e.index[gene]; ok {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// gather copies the standardized rows of a set of genes into a matrix
+func (e *CorrelationEngine) gather(rows []int) *mat.Dense {
+	_, samples := e.z.Dims()
+	gathered := mat.NewDense(len(rows), samples, nil)
+	for k, i := range rows {
+		gathered.SetRow(k, e.z.RawRowView(i))
+	}
+	return gathered
+}
+
+// HasMissing reports whether some gene has missing values, so that its
+// correlations have fewer samples than the condition
+func (e *CorrelationEngine) HasMissing() bool {
+	return e.missing
+}
+
+// observedPair appends the values of the samples observed in both genes i
+// and j to x and y
+func (e *CorrelationEngine) observedPair(i, j int, x, y []float64) ([]float64, []float64) {
+	for s, v := range e.raw[i] {
+		if w := e.raw[j][s]; !math.IsNaN(v) && !math.IsNaN(w) {
+			x = append(x, v)
+			y = append(y, w)
+		}
+	}
+	return x, y
+}
+
+// PairSamples returns the number of samples observed in both genes i and j
+func (e *CorrelationEngine) PairSamples(i, j int) int {
+	if e.complete[i] && e.complete[j] {
+		return e.samples
+	}
+	n := 0
+	for s, v := range e.raw[i] {
+		if !math.IsNaN(v) && !math.IsNaN(e.raw[j][s]) {
+			n++
+		}
+	}
+	return n
+}
+
+// Block returns the correlations between the genes of rows a and rows b, as
+// a len(a) x len(b) matrix. Pairs with a constant gene, or observed together
+// in fewer than MinSamples samples, are NaN.
+func (e *CorrelationEngine) Block(a, b []int) *mat.Dense {
+	if len(a) == 0 || len(b) == 0 {
+		return &mat.Dense{}
+	}
+	block := mat.NewDense(len(a), len(b), nil)
+	if e.z != nil {
+		block.Mul(e.gather(a), e.gather(b).T())
+	}
+	var x, y []float64
+	for k, i := range a {
+		for l, j := range b {
+			corr := block.At(k, l)
+			n := e.samples
+			switch {
+			case e.z == nil || !e.complete[i] || !e.complete[j]:
+				// Pairwise-complete, or kendall
+				x, y = e.observedPair(i, j, x[:0], y[:0])
+				n = len(x)
+				corr = pairCorrelation(e.method, x, y)
+			case e.constant[i] || e.constant[j]:
+				corr = math.NaN()
+			}
+			switch {
+			case n < e.method.MinSamples:
+				corr = math.NaN()
+			case corr > 1:
+				corr = 1
+			case corr < -1:
+				corr = -1
+			}
+			block.Set(k, l, corr)
+		}
+	}
+	return block
+}
+
+// Samples returns the number of samples observed in both genes of every pair
+// of rows a and rows b, as a len(a) x len(b) matrix
+func (e *CorrelationEngine) Samples(a, b []int) *mat.Dense {
+	if len(a) == 0 || len(b) == 0 {
+		return &mat.Dense{}
+	}
+	samples := mat.NewDense(len(a), len(b), nil)
+	for k, i := range a {
+		for l, j := range b {
+			samples.Set(k, l, float64(e.PairSamples(i, j)))
+		}
+	}
+	return samples
+}
+
+// Matrix returns the correlation matrix of the known genes among genes
+func (e *CorrelationEngine) Matrix(genes []string) *mat.Dense {
+	rows := e.Indices(genes)
+	return e.Block(rows, rows)
+}
+
+// ModuleCorrelations returns the correlation of every pair of known genes of
+// a module, row by row over the upper triangle, and the number of samples of
+// each, leaving out pairs without a correlation
+func (e *CorrelationEngine) ModuleCorrelations(genes []string) ([]float64, []int) {
+	rows := e.Indices(genes)
+	n := len(rows)
+	correlations := make([]float64, 0, n*(n-1)/2)
+	samples := make([]int, 0, n*(n-1)/2)
+	for start := 0; start < n; start += CorrelationBlockSize {
+		end := start + CorrelationBlockSize
+		if end > n {
+			end = n
+		}
+		// The rows of this block against themselves and every later gene
+		block := e.Block(rows[start:end], rows[start:])
+		for k := 0; k < end-start; k++ {
+			for l := k + 1; l < n-start; l++ {
+				if corr := block.At(k, l); !math.IsNaN(corr) {
+					correlations = append(correlations, corr)
+					samples = append(samples, e.PairSamples(rows[start+k], rows[start+l]))
+				}
+			}
+		}
+	}
+	return correlations, samples
+}
@@ -0,0 +1,154 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+/*
+	The correlation store holds the correlation of every pair of genes of a
+	condition, computed once by the correlation engine as a tiled matrix. The
+	module test and the random modules of the null distributions then look
+	their correlations up instead of computing them again. When some gene
+	has missing values, the number of samples of every correlation is kept
+	in a second tiled matrix, in float32, which holds counts exactly.
+
+	A store of up to the memory limit is kept in memory. A larger one, such as
+	the store of a genome-scale condition, is written as a tiled file in the
+	given directory and memory-mapped, so the operating system pages in the
+	tiles that are looked up. The files are removed when the store is closed.
+*/
+
+// correlationStoreSuffix ends the name of the tiled file of a store on disk
+const correlationStoreSuffix = ".tiles"
+
+// CorrelationStore holds the correlations of every pair of genes of a
+// condition
+type CorrelationStore struct {
+	engine  *CorrelationEngine
+	tiles   *TiledMatrix
+	samples *TiledMatrix // nil when every correlation has every sample
+	paths   []string     // the tiled files of a store on disk
+}
+
+// NewCorrelationStore computes the correlations of every pair of genes of an
+// engine, in the precision given as to -cache. Matrices larger than
+// memoryLimit bytes are written to tiled files named after name in dir.
+func NewCorrelationStore(engine *CorrelationEngine, precision string, memoryLimit int64, dir, name string) (*CorrelationStore, error) {
+	s := &CorrelationStore{engine: engine}
+	var err error
+	description := fmt.Sprintf("%s correlation", engine.Method())
+	if s.tiles, err = s.compute(name, description, precision, memoryLimit, dir, engine.Block); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if engine.HasMissing() {
+		s.samples, err = s.compute(name+"_samples", "samples of the "+description, CacheFloat32, memoryLimit, dir, engine.Samples)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// compute computes a tiled matrix of the store, in memory if it fits in
+// memoryLimit bytes and in a tiled file otherwise
+func (s *CorrelationStore) compute(name, description, precision string, memoryLimit int64, dir string,
+	tile TileFunc) (*TiledMatrix, error) {
+	valueSize, err := CacheValueSize(precision)
+	if err != nil {
+		return nil, err
+	}
+	genes := s.engine.Genes()
+	if TiledMatrixSize(len(genes), valueSize) <= memoryLimit {
+		tiles, err := ComputeTiledMatrix(genes, description, precision, tile)
+		if err != nil {
+			return nil, fmt.Errorf("error computing correlation store: %v", err)
+		}
+		return tiles, nil
+	}
+
+	path := filepath.Join(dir, name+correlationStoreSuffix)
+	s.paths = append(s.paths, path)
+	if err := WriteTiledMatrix(path, genes, description, precision, tile); err != nil {
+		return nil, fmt.Errorf("error writing correlation store: %v", err)
+	}
+	tiles, err := OpenTiledMatrix(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading correlation store: %v", err)
+	}
+	return tiles, nil
+}
+
+// At returns the correlation of the genes of rows i and j of the engine
+func (s *CorrelationStore) At(i, j int) float64 {
+	return s.tiles.At(i, j)
+}
+
+// PairSamples returns the number of samples of the correlation of the genes
+// of rows i and j of the engine
+func (s *CorrelationStore) PairSamples(i, j int) int {
+	if s.samples == nil {
+		return s.engine.PairSamples(i, j)
+	}
+	return int(s.samples.At(i, j))
+}
+
+// Genes returns the genes of the store, in sorted order
+func (s *CorrelationStore) Genes() []string {
+	return s.engine.Genes()
+}
+
+// Method returns the correlation measure of the store
+func (s *CorrelationStore) Method() CorrelationMethod {
+	return s.engine.Method()
+}
+
+// ModuleCorrelations returns the correlation of every pair of known genes of
+// a module and the number of samples of each, in the order of the engine's
+// ModuleCorrelations
+func (s *CorrelationStore) ModuleCorrelations(genes []string) ([]float64, []int) {
+	rows := s.engine.Indices(genes)
+	n := len(rows)
+	correlations := make([]float64, 0, n*(n-1)/2)
+	samples := make([]int, 0, n*(n-1)/2)
+	for k := 0; k < n; k++ {
+		for l := k + 1; l < n; l++ {
+			if corr := s.tiles.At(rows[k], rows[l]); !math.IsNaN(corr) {
+				correlations = append(correlations, corr)
+				samples = append(samples, s.PairSamples(rows[k], rows[l]))
+			}
+		}
+	}
+	return correlations, samples
+}
+
+// Close releases the store and removes its tiled files
+func (s *CorrelationStore) Close() error {
+	var err error
+	for _, tiles := range []*TiledMatrix{s.tiles, s.samples} {
+		if tiles != nil {
+			if closeErr := tiles.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	for _, path := range s.paths {
+		if removeErr := os.Remove(path); err == nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+// Package diffcoex holds the code shared by preprocess and the
+// significanceTesting, plotSignificanceTesting and correlationHeatmap tools:
+// the config file, provenance manifests, input validation, the expression
+// matrix reader and its binary cache, the correlation engine, tiled
+// correlation files and correlation stores. Every tool requires it through
+// a replace directive in its go.mod, so a change here reaches all of them.
+package diffcoex
@@ -0,0 +1,231 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Expression matrices are shared between every tool in the same format:
+
+		#diffcoex-matrix 1
+		#key=value            (optional metadata lines)
+		Gene,S1,S2,...
+		gene1,0.5,1.2,...
+
+	The format line and metadata lines are optional, but the header row of
+	sample IDs is always written. Files without a format line are also read
+	in the looser formats preprocess accepts as input: tab-separated values
+	(any file not named .csv whose header has a tab), an annotation column
+	such as "Description" between the gene IDs and the samples, and legacy
+	headerless matrices whose first row is entirely numeric. A fresh binary
+	cache of the file written by preprocess (see matrixCache.go) is read in
+	its place.
+*/
+
+const (
+	MatrixFormatName    = "#diffcoex-matrix"
+	MatrixFormatVersion = 1
+)
+
+// descriptionColumnNames are second-column headers that hold gene annotations
+// rather than samples
+var descriptionColumnNames = []string{"description", "identifier", "name"}
+
+// ExpressionMatrix holds an expression matrix file: one row of values per gene
+// and one column per sample. Unparsable values are stored as NaN.
+type ExpressionMatrix struct {
+	GeneIDs   []string
+	SampleIDs []string
+	Values    [][]float64
+	Metadata  map[string]string
+}
+
+// ReadExpressionMatrix reads an expression matrix file
+func ReadExpressionMatrix(filename string) (*ExpressionMatrix, error) {
+	if cache := ReadFreshMatrixCache(filename); cache != nil {
+		matrix := &ExpressionMatrix{GeneIDs: cache.GeneIDs, SampleIDs: cache.SampleIDs, Metadata: cache.Metadata}
+		samples := len(cache.SampleIDs)
+		for i := range cache.GeneIDs {
+			matrix.Values = append(matrix.Values, cache.Values[i*samples:(i+1)*samples:(i+1)*samples])
+		}
+		return matrix, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	matrix := &ExpressionMatrix{Metadata: make(map[string]string)}
+
+	// Read the format line and metadata lines
+	hasFormat, preambleLines, err := ReadMatrixPreamble(buffered, matrix.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	// Read the header line first to pick the separator
+	headerLine, err := buffered.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	reader := csv.NewReader(io.MultiReader(strings.NewReader(headerLine), buffered))
+	if !strings.HasSuffix(strings.ToLower(filename), ".csv") && strings.Contains(headerLine, "\t") {
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	validator := NewValidator(filename)
+	lineOf := func() int {
+		line, _ := reader.FieldPos(0)
+		return line + preambleLines
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: missing header row: %v", filename, err)
+	}
+	firstLine := lineOf()
+
+	var firstRow []string
+	firstSample := 1
+	switch {
+	case hasFormat:
+		// Files written by preprocess have neither legacy form
+	case isNumericRow(header):
+		// Legacy file without a header: the first row is data
+		log.Printf("Warning: %s has no sample header, numbering samples", filename)
+		firstRow = header
+		header = make([]string, len(firstRow))
+		header[0] = "Gene"
+		for j := 1; j < len(header); j++ {
+			header[j] = fmt.Sprintf("S%d", j)
+		}
+	case len(header) > 2 && isDescriptionColumn(header[1]):
+		// Skip an annotation column between the gene IDs and the samples
+		firstSample = 2
+	}
+	for _, sample := range header[firstSample:] {
+		matrix.SampleIDs = append(matrix.SampleIDs, strings.TrimSpace(sample))
+	}
+	if len(matrix.SampleIDs) == 0 {
+		return nil, fmt.Errorf("%s: header does not list any samples", filename)
+	}
+
+	addRow := func(line int, record []string) {
+		if !validator.CheckFields(line, record, len(header), firstSample) {
+			return
+		}
+		validator.CheckID(line, record[0])
+		values := make([]float64, len(matrix.SampleIDs))
+		for j := range values {
+			values[j] = math.NaN()
+			if j+firstSample < len(record) {
+				values[j] = validator.ParseValue(line, matrix.SampleIDs[j], record[j+firstSample])
+			}
+		}
+		matrix.GeneIDs = append(matrix.GeneIDs, record[0])
+		matrix.Values = append(matrix.Values, values)
+	}
+
+	if firstRow != nil {
+		addRow(firstLine, firstRow)
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if len(record) == 0 || record[0] == "" {
+			validator.Add(lineOf(), IssueEmptyRow, "row without a gene ID")
+			continue
+		}
+		addRow(lineOf(), record)
+	}
+	if err := validator.Finish(); err != nil {
+		return nil, err
+	}
+
+	return matrix, nil
+}
+
+// ReadMatrixPreamble consumes the leading "#" lines of a matrix file, storing
+// "#key=value" lines in metadata. It reports whether a format line was found
+// and how many lines were consumed.
+func ReadMatrixPreamble(reader *bufio.Reader, metadata map[string]string) (bool, int, error) {
+	hasFormat := false
+	lines := 0
+	for {
+		next, err := reader.Peek(1)
+		if err != nil || next[0] != '#' {
+			return hasFormat, lines, nil
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return hasFormat, lines, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines++
+
+		if strings.HasPrefix(line, MatrixFormatName) {
+			version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, MatrixFormatName)))
+			if err != nil {
+				return hasFormat, lines, fmt.Errorf("invalid format line %q", line)
+			}
+			if version > MatrixFormatVersion {
+				return hasFormat, lines, fmt.Errorf("matrix format version %d is newer than supported version %d",
+					version, MatrixFormatVersion)
+			}
+			hasFormat = true
+			continue
+		}
+		if key, value, ok := strings.Cut(strings.TrimPrefix(line, "#"), "="); ok {
+			metadata[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+}
+
+// isDescriptionColumn reports whether a header names a gene annotation column
+func isDescriptionColumn(column string) bool {
+	for _, name := range descriptionColumnNames {
+		if strings.EqualFold(strings.TrimSpace(column), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNumericRow reports whether every field after the first parses as a number
+func isNumericRow(record []string) bool {
+	if len(record) < 2 {
+		return false
+	}
+	for _, field := range record[1:] {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(field), 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
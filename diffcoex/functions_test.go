@@ -0,0 +1,445 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/stat"
+)
+
+// readDirectory returns the files of a test directory
+func readDirectory(dir string) []fs.DirEntry {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		panic(err)
+	}
+	return files
+}
+
+// readLines returns the lines of a test file
+func readLines(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return lines
+}
+
+func TestReadExpressionMatrixValidation(t *testing.T) {
+	defer func() { StrictValidation, ValidationWarnings = false, nil }()
+
+	tests := []struct {
+		inputFile  string
+		outputFile string
+	}{
+		{"tests/Validation/Input/input1.txt", "tests/Validation/Output/output1.txt"},
+		{"tests/Validation/Input/input2.txt", "tests/Validation/Output/output2.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.inputFile, func(t *testing.T) {
+			content, err := os.ReadFile(tt.outputFile)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+			expected := strings.TrimSpace(string(content))
+
+			// Lenient mode collects every issue as a warning
+			StrictValidation, ValidationWarnings = false, nil
+			if _, err := ReadExpressionMatrix(tt.inputFile); err != nil {
+				t.Fatalf("ReadExpressionMatrix() error: %v", err)
+			}
+			var got []string
+			for _, issue := range ValidationWarnings {
+				got = append(got, strconv.Itoa(issue.Line)+": "+issue.Kind+": "+issue.Detail)
+			}
+			if strings.Join(got, "\n") != expected {
+				t.Errorf("issues =\n%s\nwant\n%s", strings.Join(got, "\n"), expected)
+			}
+
+			// Strict mode fails exactly when there are issues
+			StrictValidation = true
+			if _, err := ReadExpressionMatrix(tt.inputFile); (err != nil) != (expected != "") {
+				t.Errorf("strict ReadExpressionMatrix() error = %v", err)
+			}
+		})
+	}
+}
+
+// TestCorrelationEngine tests that engine correlations match stat.Correlation
+// and that constant genes are left out of module correlations
+func TestCorrelationEngine(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	data := make(map[string][]float64)
+	var genes []string
+	for i := 0; i < 30; i++ {
+		gene := fmt.Sprintf("g%02d", i)
+		genes = append(genes, gene)
+		data[gene] = make([]float64, 12)
+		for j := range data[gene] {
+			data[gene][j] = r.NormFloat64() * float64(i+1)
+		}
+	}
+	data["constant"] = []float64{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+
+	engine := NewCorrelationEngine(data, CorrelationMethod{Name: CorrelationPearson, MaxPOutliers: 1})
+	correlations := engine.Matrix(genes)
+	for i, gene1 := range genes {
+		for j, gene2 := range genes {
+			want := stat.Correlation(data[gene1], data[gene2], nil)
+			if math.Abs(correlations.At(i, j)-want) > 1e-12 {
+				t.Errorf("correlation of %s and %s = %v, want %v", gene1, gene2, correlations.At(i, j), want)
+			}
+		}
+	}
+
+	module := append([]string{"constant", "unknown"}, genes[:10]...)
+	if correlations, _ := engine.ModuleCorrelations(module); len(correlations) != 45 {
+		t.Errorf("got %d module correlations, want 45", len(correlations))
+	}
+}
+
+// TestCorrelationMethods tests Spearman and Kendall correlations with ties
+// and bicor against hand-computed values
+func TestCorrelationMethods(t *testing.T) {
+	correlate := func(name string, maxPOutliers float64, x, y []float64) float64 {
+		method, err := ParseCorrelationMethod(name, maxPOutliers, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		engine := NewCorrelationEngine(map[string][]float64{"x": x, "y": y}, method)
+		return engine.Matrix([]string{"x", "y"}).At(0, 1)
+	}
+
+	x := []float64{1, 2, 3, 4, 5}
+	y := []float64{5, 6, 7, 8, 7}
+	tests := []struct {
+		name string
+		want float64
+	}{
+		{CorrelationSpearman, 8 / math.Sqrt(95)}, // ranks of y are 1 2 3.5 5 3.5
+		{CorrelationKendall, 7 / math.Sqrt(90)},  // 8 concordant, 1 discordant, 1 tied in y
+	}
+	for _, test := range tests {
+		if got := correlate(test.name, 1, x, y); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("%s = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	outlier := []float64{1, 2, 3, 4, 5, 6, 7, 100}
+	linear := []float64{1, 2, 3, 4, 5, 6, 7, 8}
+	pearson := correlate(CorrelationPearson, 1, outlier, linear)
+	bicor := correlate(CorrelationBicor, 1, outlier, linear)
+	// The outlier gets weight 0 in x, leaving sqrt(26.9/37.4) from the
+	// weights of the other values
+	if pearson > 0.7 || math.Abs(bicor-0.848) > 1e-3 {
+		t.Errorf("with an outlier: pearson = %v, bicor = %v; want bicor 0.848", pearson, bicor)
+	}
+	if bicor := correlate(CorrelationBicor, 1, x, x); math.Abs(bicor-1) > 1e-12 {
+		t.Errorf("bicor of a gene with itself = %v, want 1", bicor)
+	}
+
+	method, _ := ParseCorrelationMethod(CorrelationBicor, 0.05, 3)
+	if method.String() != "bicor(maxPOutliers=0.05)" {
+		t.Errorf("method name = %q", method.String())
+	}
+	if _, err := ParseCorrelationMethod("cosine", 1, 3); err == nil {
+		t.Errorf("unknown correlation was accepted")
+	}
+}
+
+// TestCorrelationStore tests that stored correlations match the engine across
+// several tiles, in memory and on disk
+func TestCorrelationStore(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	data := make(map[string][]float64)
+	for i := 0; i < CorrelationBlockSize+100; i++ {
+		gene := fmt.Sprintf("g%04d", i)
+		data[gene] = make([]float64, 8)
+		for j := range data[gene] {
+			data[gene][j] = r.NormFloat64()
+		}
+	}
+	data["g0003"] = []float64{1, 1, 1, 1, 1, 1, 1, 1}
+	engine := NewCorrelationEngine(data, CorrelationMethod{Name: CorrelationPearson, MaxPOutliers: 1})
+	genes := engine.Genes()
+	module := []string{"g0001", "g0003", "g0300", "g0520", "g0611", "unknown"}
+
+	dir := t.TempDir()
+	for _, memoryLimit := range []int64{1 << 30, 0} {
+		store, err := NewCorrelationStore(engine, CacheFloat64, memoryLimit, dir, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range [][2]int{{0, 1}, {5, 2}, {10, 600}, {530, 611}, {511, 512}, {3, 400}} {
+			want := engine.Matrix([]string{genes[pair[0]], genes[pair[1]]}).At(0, 1)
+			got := store.At(pair[0], pair[1])
+			if math.IsNaN(want) != math.IsNaN(got) || math.Abs(got-want) > 1e-12 {
+				t.Errorf("limit %d: correlation of %s and %s = %v, want %v", memoryLimit,
+					genes[pair[0]], genes[pair[1]], got, want)
+			}
+		}
+		want, _ := engine.ModuleCorrelations(module)
+		got, _ := store.ModuleCorrelations(module)
+		if len(got) != len(want) || len(got) != 6 {
+			t.Fatalf("limit %d: got %d module correlations, want %d", memoryLimit, len(got), len(want))
+		}
+		for k := range want {
+			if math.Abs(got[k]-want[k]) > 1e-12 {
+				t.Errorf("limit %d: module correlation %d = %v, want %v", memoryLimit, k, got[k], want[k])
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("the tiled file was not removed")
+	}
+
+}
+
+// TestTiledMatrix tests a tiled file of several tiles in float32 against the
+// engine, with its row sums and thresholded pairs
+func TestTiledMatrix(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	data := make(map[string][]float64)
+	for i := 0; i < CorrelationBlockSize+40; i++ {
+		gene := fmt.Sprintf("g%04d", i)
+		data[gene] = make([]float64, 6)
+		for j := range data[gene] {
+			data[gene][j] = r.NormFloat64()
+		}
+	}
+	engine := NewCorrelationEngine(data, CorrelationMethod{Name: CorrelationPearson, MaxPOutliers: 1})
+	genes := engine.Genes()
+	path := t.TempDir() + "/test.tiles"
+	if err := WriteTiledMatrix(path, genes, "test", CacheFloat32, engine.Block); err != nil {
+		t.Fatal(err)
+	}
+	tiles, err := OpenTiledMatrix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiles.Close()
+	if tiles.Description != "test" || len(tiles.Genes) != len(genes) || tiles.Genes[530] != genes[530] {
+		t.Fatalf("read description %q and %d genes", tiles.Description, len(tiles.Genes))
+	}
+
+	all := make([]int, len(genes))
+	for i := range all {
+		all[i] = i
+	}
+	want := engine.Block(all, all)
+	sums := make([]float64, len(genes))
+	pairs := 0
+	for i := range genes {
+		for j := range genes {
+			if math.Abs(tiles.At(i, j)-want.At(i, j)) > 1e-6 {
+				t.Fatalf("value of genes %d and %d = %v, want %v", i, j, tiles.At(i, j), want.At(i, j))
+			}
+			if i != j {
+				sums[i] += math.Abs(want.At(i, j))
+			}
+			if i < j && math.Abs(float64(float32(want.At(i, j)))) >= 0.9 {
+				pairs++
+			}
+		}
+	}
+	if row := tiles.Row(530, nil); math.Abs(row[3]-want.At(530, 3)) > 1e-6 {
+		t.Errorf("row 530 has %v for gene 3, want %v", row[3], want.At(530, 3))
+	}
+	for i, sum := range tiles.RowSums(math.Abs) {
+		if math.Abs(sum-sums[i]) > 1e-4 {
+			t.Fatalf("row sum of gene %d = %v, want %v", i, sum, sums[i])
+		}
+	}
+	visited := 0
+	tiles.Threshold(0.9, func(i, j int, value float64) error {
+		if i >= j || math.Abs(value) < 0.9 {
+			t.Errorf("visited genes %d and %d with %v", i, j, value)
+		}
+		visited++
+		return nil
+	})
+	if visited != pairs {
+		t.Errorf("visited %d pairs, want %d", visited, pairs)
+	}
+}
+
+// TestPairwiseCompleteCorrelations tests that missing values stay aligned by
+// sample and are left out pair by pair, with the samples of every correlation
+func TestPairwiseCompleteCorrelations(t *testing.T) {
+	nan := math.NaN()
+	data := map[string][]float64{
+		"a": {1, 2, nan, 4, 5, 6},
+		"b": {2, 4, 100, 8, 10, 12},
+		"c": {6, 5, 4, 3, 2, 1},
+		"d": {nan, nan, 1, 2, nan, nan},
+	}
+	method, err := ParseCorrelationMethod(CorrelationPearson, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewCorrelationEngine(data, method)
+	if !engine.HasMissing() {
+		t.Fatalf("missing values were not found")
+	}
+
+	// a and b are proportional on the samples they share; d shares too few
+	// samples with any gene
+	want := map[[2]string][2]float64{
+		{"a", "b"}: {1, 5},
+		{"a", "c"}: {-1, 5},
+		{"b", "c"}: {stat.Correlation(data["b"], data["c"], nil), 6},
+		{"a", "d"}: {nan, 1},
+		{"c", "d"}: {nan, 2},
+	}
+	dir := t.TempDir()
+	store, err := NewCorrelationStore(engine, CacheFloat64, 0, dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for pair, expected := range want {
+		rows := engine.Indices([]string{pair[0], pair[1]})
+		for name, got := range map[string][2]float64{
+			"engine": {engine.Block(rows[:1], rows[1:]).At(0, 0), float64(engine.PairSamples(rows[0], rows[1]))},
+			"store":  {store.At(rows[0], rows[1]), float64(store.PairSamples(rows[0], rows[1]))},
+		} {
+			if math.IsNaN(got[0]) != math.IsNaN(expected[0]) || math.Abs(got[0]-expected[0]) > 1e-12 || got[1] != expected[1] {
+				t.Errorf("%s: %s and %s have correlation %v of %v samples, want %v of %v",
+					name, pair[0], pair[1], got[0], got[1], expected[0], expected[1])
+			}
+		}
+	}
+
+	correlations, samples := store.ModuleCorrelations([]string{"a", "b", "c", "d"})
+	if len(correlations) != 3 || len(samples) != 3 || samples[0]+samples[1]+samples[2] != 16 {
+		t.Errorf("module correlations %v of %v samples, want 3 correlations of 16 samples", correlations, samples)
+	}
+}
+
+// TestConfigSettings tests reading the settings of preprocess and of the
+// significance section from a config file. The output lists the preprocess
+// settings, a blank line, then the significance settings.
+func TestConfigSettings(t *testing.T) {
+	inputFiles := readDirectory("tests/ConfigSettings/input")
+	for _, inputFile := range inputFiles {
+		index := strings.TrimSuffix(strings.TrimPrefix(inputFile.Name(), "config_"), filepath.Ext(inputFile.Name()))
+		want := readLines("tests/ConfigSettings/output/output_" + index + ".txt")
+
+		config, err := ReadConfig("tests/ConfigSettings/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadConfig failed: %v", inputFile.Name(), err)
+			continue
+		}
+		var got []string
+		for i, section := range []string{"", "significance"} {
+			if i > 0 {
+				got = append(got, "")
+			}
+			lines, err := formatSettings(config, section)
+			if err != nil {
+				lines = []string{"error"}
+			}
+			got = append(got, lines...)
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// formatSettings returns the settings of a config section as sorted
+// "key<TAB>value" lines
+func formatSettings(config Config, section string) ([]string, error) {
+	settings, err := config.settings(section)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for key, raw := range settings {
+		value, err := ConfigString(raw)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, key+"\t"+value)
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// TestVerifyManifest tests that a written manifest verifies against its files
+// and that changed and missing files are reported
+func TestVerifyManifest(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.csv")
+	output := filepath.Join(dir, "output.csv")
+	if err := os.WriteFile(input, []byte("gene,s1\nA,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(output, []byte("gene,s1\nA,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := NewManifest("preprocess")
+	if err := manifest.AddInputs("", input); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.AddOutputs(output); err != nil {
+		t.Fatal(err)
+	}
+	manifestFile := filepath.Join(dir, "manifest.json")
+	if err := manifest.Write(manifestFile); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Inputs) != 1 || len(read.Outputs) != 1 {
+		t.Fatalf("got %d inputs and %d outputs, want 1 and 1", len(read.Inputs), len(read.Outputs))
+	}
+	if problems := VerifyManifest(read); len(problems) != 0 {
+		t.Errorf("unchanged files: got problems %v", problems)
+	}
+
+	if err := os.WriteFile(output, []byte("gene,s1\nA,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(input); err != nil {
+		t.Fatal(err)
+	}
+	problems := VerifyManifest(read)
+	if len(problems) != 2 || !strings.HasSuffix(problems[0], ": missing") ||
+		!strings.Contains(problems[1], ": changed") {
+		t.Errorf("changed files: got problems %v", problems)
+	}
+}
@@ -0,0 +1,5 @@
+module diffcoex
+
+go 1.22.4
+
+require gonum.org/v1/gonum v0.15.1
@@ -0,0 +1,296 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"os"
+	"sort"
+)
+
+/*
+	Next to every expression matrix CSV, preprocess writes a binary cache
+	(<file>.bin) that the tools read instead of parsing the CSV. The cache is
+	used only when it is at least as new as the CSV and was written from a CSV
+	of the same size, so editing the CSV makes the tools read it again.
+
+	Layout, little-endian:
+
+		"DCXMATRX"               magic
+		uint32 version, uint32 value size (4 or 8)
+		uint64 genes, samples, CSV size, string table size
+		string table             gene IDs, sample IDs, uint32 metadata count
+		                         and key/value pairs; each string is a uint32
+		                         length and its bytes
+		padding                  zeros up to a multiple of 8 bytes
+		values                   genes x samples float32/float64, row by row
+		uint32 CRC-32C           of everything before it
+
+	The values start 8-byte aligned, so the body can be used in place from a
+	memory-mapped file.
+*/
+
+const (
+	matrixCacheMagic      = "DCXMATRX"
+	matrixCacheVersion    = 1
+	matrixCacheHeaderSize = 48
+	matrixCacheSuffix     = ".bin"
+)
+
+// Cache precisions, as given to -cache
+const (
+	CacheNone    = "none"
+	CacheFloat32 = "float32"
+	CacheFloat64 = "float64"
+)
+
+// crcTable is the CRC-32C table of the cache checksum
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MatrixCachesRead lists the caches read in place of their CSV, for the
+// manifest inputs
+var MatrixCachesRead []string
+
+// MatrixCache is an expression matrix read from a binary cache
+type MatrixCache struct {
+	GeneIDs   []string
+	SampleIDs []string
+	Metadata  map[string]string
+	Values    []float64 // genes x samples, row by row
+}
+
+// MatrixCachePath returns the cache file of an expression matrix file
+func MatrixCachePath(filename string) string {
+	return filename + matrixCacheSuffix
+}
+
+// CacheValueSize returns the bytes per value of a cache precision
+func CacheValueSize(precision string) (int, error) {
+	switch precision {
+	case CacheFloat32:
+		return 4, nil
+	case CacheFloat64:
+		return 8, nil
+	}
+	return 0, fmt.Errorf("unknown cache precision %q: use 'float32', 'float64' or 'none'", precision)
+}
+
+// WriteMatrixCache writes the cache of the expression matrix file csvPath,
+// which must already be written. at returns the value of a gene and sample.
+func WriteMatrixCache(csvPath, precision string, geneIDs, sampleIDs []string, metadata map[string]string,
+	at func(i, j int) float64) error {
+	valueSize, err := CacheValueSize(precision)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(csvPath)
+	if err != nil {
+		return fmt.Errorf("error writing cache: %v", err)
+	}
+
+	// String table, with the metadata sorted by key so caches are reproducible
+	var table bytes.Buffer
+	putString := func(s string) {
+		binary.Write(&table, binary.LittleEndian, uint32(len(s)))
+		table.WriteString(s)
+	}
+	for _, id := range geneIDs {
+		putString(id)
+	}
+	for _, id := range sampleIDs {
+		putString(id)
+	}
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	binary.Write(&table, binary.LittleEndian, uint32(len(keys)))
+	for _, key := range keys {
+		putString(key)
+		putString(metadata[key])
+	}
+
+	bodyStart := alignCache(matrixCacheHeaderSize + table.Len())
+	bodySize := len(geneIDs) * len(sampleIDs) * valueSize
+	content := make([]byte, bodyStart+bodySize+4)
+	copy(content, matrixCacheMagic)
+	binary.LittleEndian.PutUint32(content[8:], matrixCacheVersion)
+	binary.LittleEndian.PutUint32(content[12:], uint32(valueSize))
+	binary.LittleEndian.PutUint64(content[16:], uint64(len(geneIDs)))
+	binary.LittleEndian.PutUint64(content[24:], uint64(len(sampleIDs)))
+	binary.LittleEndian.PutUint64(content[32:], uint64(info.Size()))
+	binary.LittleEndian.PutUint64(content[40:], uint64(table.Len()))
+	copy(content[matrixCacheHeaderSize:], table.Bytes())
+
+	offset := bodyStart
+	for i := range geneIDs {
+		for j := range sampleIDs {
+			if valueSize == 4 {
+				binary.LittleEndian.PutUint32(content[offset:], math.Float32bits(float32(at(i, j))))
+			} else {
+				binary.LittleEndian.PutUint64(content[offset:], math.Float64bits(at(i, j)))
+			}
+			offset += valueSize
+		}
+	}
+	binary.LittleEndian.PutUint32(content[offset:], crc32.Checksum(content[:offset], crcTable))
+
+	if err := os.WriteFile(MatrixCachePath(csvPath), content, 0644); err != nil {
+		return fmt.Errorf("error writing cache: %v", err)
+	}
+	return nil
+}
+
+// alignCache rounds an offset up to a multiple of 8 bytes
+func alignCache(offset int) int {
+	return (offset + 7) &^ 7
+}
+
+// FreshMatrixCache returns the cache of an expression matrix file if it
+// exists, is at least as new as the file and was written from a file of the
+// same size
+func FreshMatrixCache(csvPath string) (string, bool) {
+	cachePath := MatrixCachePath(csvPath)
+	cacheInfo, err := os.Stat(cachePath)
+	if err != nil {
+		return "", false
+	}
+	csvInfo, err := os.Stat(csvPath)
+	if err != nil || cacheInfo.ModTime().Before(csvInfo.ModTime()) {
+		return "", false
+	}
+	file, err := os.Open(cachePath)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	header := make([]byte, matrixCacheHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != matrixCacheMagic {
+		return "", false
+	}
+	if int64(binary.LittleEndian.Uint64(header[32:])) != csvInfo.Size() {
+		return "", false
+	}
+	return cachePath, true
+}
+
+// readMatrixCache reads a cache file, checking its checksum
+func readMatrixCache(filename string) (*MatrixCache, error) {
+	content, unmap, err := mapFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache %s: %v", filename, err)
+	}
+	defer unmap()
+
+	corrupt := func(reason string) error {
+		return fmt.Errorf("cache %s is corrupt: %s", filename, reason)
+	}
+	if len(content) < matrixCacheHeaderSize+4 || string(content[:8]) != matrixCacheMagic {
+		return nil, corrupt("not a matrix cache")
+	}
+	if version := binary.LittleEndian.Uint32(content[8:]); version > matrixCacheVersion {
+		return nil, fmt.Errorf("cache %s has version %d, newer than supported version %d",
+			filename, version, matrixCacheVersion)
+	}
+	end := len(content) - 4
+	if crc32.Checksum(content[:end], crcTable) != binary.LittleEndian.Uint32(content[end:]) {
+		return nil, corrupt("checksum mismatch")
+	}
+
+	valueSize := int(binary.LittleEndian.Uint32(content[12:]))
+	genes := binary.LittleEndian.Uint64(content[16:])
+	samples := binary.LittleEndian.Uint64(content[24:])
+	tableSize := binary.LittleEndian.Uint64(content[40:])
+	if valueSize != 4 && valueSize != 8 {
+		return nil, corrupt(fmt.Sprintf("value size %d", valueSize))
+	}
+	if tableSize > uint64(end) || genes*samples > uint64(end) {
+		return nil, corrupt("sizes exceed the file")
+	}
+	bodyStart := alignCache(matrixCacheHeaderSize + int(tableSize))
+	if bodyStart+int(genes*samples)*valueSize != end {
+		return nil, corrupt("sizes do not match the file")
+	}
+
+	// String table
+	table := content[matrixCacheHeaderSize : matrixCacheHeaderSize+int(tableSize)]
+	var tableErr error
+	getUint32 := func() uint32 {
+		if len(table) < 4 {
+			tableErr = corrupt("truncated string table")
+			return 0
+		}
+		value := binary.LittleEndian.Uint32(table)
+		table = table[4:]
+		return value
+	}
+	getString := func() string {
+		length := getUint32()
+		if uint64(length) > uint64(len(table)) {
+			tableErr = corrupt("truncated string table")
+			return ""
+		}
+		s := string(table[:length])
+		table = table[length:]
+		return s
+	}
+	cache := &MatrixCache{
+		GeneIDs:   make([]string, genes),
+		SampleIDs: make([]string, samples),
+		Metadata:  make(map[string]string),
+		Values:    make([]float64, genes*samples),
+	}
+	for i := range cache.GeneIDs {
+		cache.GeneIDs[i] = getString()
+	}
+	for j := range cache.SampleIDs {
+		cache.SampleIDs[j] = getString()
+	}
+	for n := getUint32(); n > 0 && tableErr == nil; n-- {
+		key := getString()
+		cache.Metadata[key] = getString()
+	}
+	if tableErr != nil {
+		return nil, tableErr
+	}
+
+	body := content[bodyStart:end]
+	for k := range cache.Values {
+		if valueSize == 4 {
+			cache.Values[k] = float64(math.Float32frombits(binary.LittleEndian.Uint32(body[k*4:])))
+		} else {
+			cache.Values[k] = math.Float64frombits(binary.LittleEndian.Uint64(body[k*8:]))
+		}
+	}
+	return cache, nil
+}
+
+// ReadFreshMatrixCache reads the cache of an expression matrix file if it is
+// fresh. A cache that cannot be read is reported and skipped, so the caller
+// falls back to the file.
+func ReadFreshMatrixCache(csvPath string) *MatrixCache {
+	cachePath, ok := FreshMatrixCache(csvPath)
+	if !ok {
+		return nil
+	}
+	cache, err := readMatrixCache(cachePath)
+	if err != nil {
+		log.Printf("Warning: %v, reading %s instead", err, csvPath)
+		return nil
+	}
+	MatrixCachesRead = append(MatrixCachesRead, cachePath)
+	return cache
+}
@@ -0,0 +1,24 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+//go:build !unix
+
+package diffcoex
+
+import "os"
+
+// mapFile reads a file into memory where memory-mapping is not available and
+// returns its content and a function releasing it
+func mapFile(filename string) ([]byte, func() error, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, func() error { return nil }, nil
+}
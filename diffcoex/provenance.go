@@ -0,0 +1,239 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+/*
+	Every tool writes a provenance manifest (JSON) next to its outputs. It
+	records the SHA-256 of every input and output file, the command line and
+	config, the tool version (the git revision it was built from), the start
+	and end times, gene and sample counts and the random seeds. Paths are
+	recorded as given, so -verify <manifest> checks the files from the same
+	working directory: any file that is missing or whose SHA-256 changed is
+	reported.
+*/
+
+// manifestFormat is the version of the manifest layout
+const manifestFormat = 1
+
+// FileRecord identifies one input or output file
+type FileRecord struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// Manifest describes one run of a tool
+type Manifest struct {
+	Format    int              `json:"format"`
+	Tool      string           `json:"tool"`
+	Version   string           `json:"version"`
+	GoVersion string           `json:"go_version"`
+	Arguments []string         `json:"arguments"`
+	Config    json.RawMessage  `json:"config,omitempty"`
+	Started   time.Time        `json:"started"`
+	Finished  time.Time        `json:"finished"`
+	Inputs    []FileRecord     `json:"inputs"`
+	Outputs   []FileRecord     `json:"outputs"`
+	Counts    map[string]int   `json:"counts,omitempty"`
+	Seeds     map[string]int64 `json:"seeds,omitempty"`
+}
+
+// OutputFiles lists the files written so far, for the manifest
+var OutputFiles []string
+
+// RecordOutput adds a written file to the manifest outputs
+func RecordOutput(path string) {
+	OutputFiles = append(OutputFiles, path)
+}
+
+// NewManifest starts the manifest of a run of a tool
+func NewManifest(tool string) *Manifest {
+	return &Manifest{
+		Format:    manifestFormat,
+		Tool:      tool,
+		Version:   toolVersion(),
+		GoVersion: runtime.Version(),
+		Arguments: append([]string{}, os.Args[1:]...),
+		Started:   time.Now().UTC(),
+		Counts:    make(map[string]int),
+		Seeds:     make(map[string]int64),
+	}
+}
+
+// toolVersion returns the git revision the tool was built from, marked
+// "-dirty" if the tree had local changes, or "unknown"
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+		return "unknown"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// SetConfig records the config the tool ran with
+func (m *Manifest) SetConfig(config string) {
+	if config != "" {
+		m.Config = json.RawMessage(config)
+	}
+}
+
+// AddInputs hashes and records input files; empty paths are skipped
+func (m *Manifest) AddInputs(paths ...string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		record, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		m.Inputs = append(m.Inputs, record)
+	}
+	return nil
+}
+
+// AddOutputs hashes and records output files
+func (m *Manifest) AddOutputs(paths ...string) error {
+	for _, path := range paths {
+		record, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		m.Outputs = append(m.Outputs, record)
+	}
+	return nil
+}
+
+// Write records the end time and writes the manifest, indented, to a file
+func (m *Manifest) Write(filename string) error {
+	m.Finished = time.Now().UTC()
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %v", err)
+	}
+	if err := os.WriteFile(filename, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 and size of a file
+func hashFile(path string) (FileRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return FileRecord{}, fmt.Errorf("error hashing %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return FileRecord{}, fmt.Errorf("error hashing %s: %v", path, err)
+	}
+	return FileRecord{Path: path, SHA256: hex.EncodeToString(hash.Sum(nil)), Bytes: size}, nil
+}
+
+// ReadManifest reads a manifest file
+func ReadManifest(filename string) (*Manifest, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %v", filename, err)
+	}
+	return &m, nil
+}
+
+// VerifyManifest checks the inputs and outputs of a manifest against the
+// files on disk and returns one line per problem
+func VerifyManifest(m *Manifest) []string {
+	var problems []string
+	check := func(kind string, records []FileRecord) {
+		for _, expected := range records {
+			actual, err := hashFile(expected.Path)
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("%s %s: missing", kind, expected.Path))
+			case actual.SHA256 != expected.SHA256:
+				problems = append(problems, fmt.Sprintf("%s %s: changed (sha256 %s, expected %s)",
+					kind, expected.Path, actual.SHA256, expected.SHA256))
+			}
+		}
+	}
+	check("input", m.Inputs)
+	check("output", m.Outputs)
+	return problems
+}
+
+// RunVerify verifies a manifest, prints the result and returns the exit code
+func RunVerify(filename string) int {
+	m, err := ReadManifest(filename)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	problems := VerifyManifest(m)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d of %d files do not match\n", filename, len(problems), len(m.Inputs)+len(m.Outputs))
+		return 1
+	}
+	fmt.Printf("%s: all %d files match (%s %s, run %s)\n", filename, len(m.Inputs)+len(m.Outputs),
+		m.Tool, m.Version, m.Started.Format(time.RFC3339))
+	return 0
+}
+
+// NewSeed returns a random seed taken from the clock
+func NewSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// DeriveSeed returns a seed for one part of a run (a permutation, a module),
+// derived from the seed of the run and a key
+func DeriveSeed(seed int64, key string) int64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d/%s", seed, key)
+	return int64(hash.Sum64())
+}
@@ -0,0 +1,407 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	A tiled matrix holds a symmetric gene x gene matrix, such as the
+	correlations of a condition or the DiffCoEx adjacency difference of two
+	conditions, as the tiles of its upper triangle. Tile (a, b), with a <= b,
+	holds the values between the genes of blocks a and b of
+	CorrelationBlockSize genes, row by row. The tiles follow each other row
+	of tiles by row of tiles, and the tiles of the last block are padded to
+	the full size, so a value is found by arithmetic alone. The tiles are
+	computed in parallel, one block product each, so a matrix written to a
+	file is never held in memory as a whole.
+
+	A tiled matrix is kept in memory, or written to a tiled file that is
+	memory-mapped when it is opened, so the operating system pages in the
+	tiles that are read. Layout of the file, little-endian:
+
+		"DCXTILES"               magic
+		uint32 version, uint32 value size (4 or 8)
+		uint64 genes, tile size, string table size
+		string table             description, then the gene IDs; each string
+		                         is a uint32 length and its bytes
+		padding                  zeros up to a multiple of 8 bytes
+		tiles                    float32/float64 values
+
+	Unlike the matrix cache, the file has no checksum: checking it would read
+	the whole file on every open.
+
+	Besides random access, the reductions stream over the tiles in file
+	order: RowSums sums a transform of the values of every gene, as the
+	connectivity of an adjacency, and Threshold visits the pairs of genes
+	whose value is at least a threshold in absolute value.
+*/
+
+const (
+	tiledMatrixMagic      = "DCXTILES"
+	tiledMatrixVersion    = 1
+	tiledMatrixHeaderSize = 40
+)
+
+// TileFunc returns the values between the genes of rows a and rows b, as a
+// len(a) x len(b) matrix
+type TileFunc func(a, b []int) *mat.Dense
+
+// TiledMatrix is a symmetric gene x gene matrix stored as tiles
+type TiledMatrix struct {
+	Genes       []string
+	Description string
+	valueSize   int
+	tileSize    int
+	blocks      int
+	data        []byte // the tiles
+	release     func() error
+}
+
+// TiledMatrixSize returns the bytes of the tiles of a matrix of genes
+func TiledMatrixSize(genes, valueSize int) int64 {
+	blocks := (genes + CorrelationBlockSize - 1) / CorrelationBlockSize
+	return int64(blocks*(blocks+1)/2) * CorrelationBlockSize * CorrelationBlockSize * int64(valueSize)
+}
+
+// newTiledMatrix returns an empty tiled matrix of genes, in the precision
+// given as to -cache
+func newTiledMatrix(genes []string, description, precision string) (*TiledMatrix, error) {
+	valueSize, err := CacheValueSize(precision)
+	if err != nil {
+		return nil, err
+	}
+	return &TiledMatrix{
+		Genes:       genes,
+		Description: description,
+		valueSize:   valueSize,
+		tileSize:    CorrelationBlockSize,
+		blocks:      (len(genes) + CorrelationBlockSize - 1) / CorrelationBlockSize,
+		release:     func() error { return nil },
+	}, nil
+}
+
+// ComputeTiledMatrix computes a tiled matrix in memory
+func ComputeTiledMatrix(genes []string, description, precision string, tile TileFunc) (*TiledMatrix, error) {
+	m, err := newTiledMatrix(genes, description, precision)
+	if err != nil {
+		return nil, err
+	}
+	m.data = make([]byte, TiledMatrixSize(len(genes), m.valueSize))
+	err = m.computeTiles(tile, func(index int, content []byte) error {
+		copy(m.data[m.tileOffset(index):], content)
+		return nil
+	})
+	return m, err
+}
+
+// WriteTiledMatrix computes a tiled matrix into a tiled file, one tile at a
+// time
+func WriteTiledMatrix(filename string, genes []string, description, precision string, tile TileFunc) error {
+	m, err := newTiledMatrix(genes, description, precision)
+	if err != nil {
+		return err
+	}
+
+	// Header and string table
+	var table bytes.Buffer
+	putString := func(s string) {
+		binary.Write(&table, binary.LittleEndian, uint32(len(s)))
+		table.WriteString(s)
+	}
+	putString(description)
+	for _, gene := range genes {
+		putString(gene)
+	}
+	bodyStart := alignCache(tiledMatrixHeaderSize + table.Len())
+	header := make([]byte, bodyStart)
+	copy(header, tiledMatrixMagic)
+	binary.LittleEndian.PutUint32(header[8:], tiledMatrixVersion)
+	binary.LittleEndian.PutUint32(header[12:], uint32(m.valueSize))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(genes)))
+	binary.LittleEndian.PutUint64(header[24:], uint64(m.tileSize))
+	binary.LittleEndian.PutUint64(header[32:], uint64(table.Len()))
+	copy(header[tiledMatrixHeaderSize:], table.Bytes())
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", filename, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(header); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	if err := file.Truncate(int64(bodyStart) + TiledMatrixSize(len(genes), m.valueSize)); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	err = m.computeTiles(tile, func(index int, content []byte) error {
+		_, err := file.WriteAt(content, int64(bodyStart)+m.tileOffset(index))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	return nil
+}
+
+// OpenTiledMatrix memory-maps a tiled file
+func OpenTiledMatrix(filename string) (*TiledMatrix, error) {
+	content, unmap, err := mapFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", filename, err)
+	}
+	fail := func(reason string) (*TiledMatrix, error) {
+		unmap()
+		return nil, fmt.Errorf("%s is not a valid tiled file: %s", filename, reason)
+	}
+	if len(content) < tiledMatrixHeaderSize || string(content[:8]) != tiledMatrixMagic {
+		return fail("bad magic")
+	}
+	if version := binary.LittleEndian.Uint32(content[8:]); version > tiledMatrixVersion {
+		unmap()
+		return nil, fmt.Errorf("%s has version %d, newer than supported version %d",
+			filename, version, tiledMatrixVersion)
+	}
+	valueSize := int(binary.LittleEndian.Uint32(content[12:]))
+	genes := binary.LittleEndian.Uint64(content[16:])
+	tileSize := binary.LittleEndian.Uint64(content[24:])
+	tableSize := binary.LittleEndian.Uint64(content[32:])
+	if valueSize != 4 && valueSize != 8 {
+		return fail(fmt.Sprintf("value size %d", valueSize))
+	}
+	if tileSize != CorrelationBlockSize {
+		return fail(fmt.Sprintf("tile size %d", tileSize))
+	}
+	if tableSize > uint64(len(content)) || genes > uint64(len(content)) {
+		return fail("sizes exceed the file")
+	}
+	bodyStart := alignCache(tiledMatrixHeaderSize + int(tableSize))
+	if int64(len(content)) != int64(bodyStart)+TiledMatrixSize(int(genes), valueSize) {
+		return fail("sizes do not match the file")
+	}
+
+	// String table
+	table := content[tiledMatrixHeaderSize : tiledMatrixHeaderSize+int(tableSize)]
+	getString := func() (string, bool) {
+		if len(table) < 4 {
+			return "", false
+		}
+		length := binary.LittleEndian.Uint32(table)
+		if uint64(length) > uint64(len(table)-4) {
+			return "", false
+		}
+		s := string(table[4 : 4+length])
+		table = table[4+length:]
+		return s, true
+	}
+	description, ok := getString()
+	geneIDs := make([]string, genes)
+	for i := range geneIDs {
+		if ok {
+			geneIDs[i], ok = getString()
+		}
+	}
+	if !ok {
+		return fail("truncated string table")
+	}
+
+	return &TiledMatrix{
+		Genes:       geneIDs,
+		Description: description,
+		valueSize:   valueSize,
+		tileSize:    int(tileSize),
+		blocks:      (int(genes) + int(tileSize) - 1) / int(tileSize),
+		data:        content[bodyStart:],
+		release:     unmap,
+	}, nil
+}
+
+// computeTiles computes every tile in parallel and hands its encoded values
+// to put
+func (m *TiledMatrix) computeTiles(tile TileFunc, put func(index int, content []byte) error) error {
+	tiles := make(chan [2]int)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content := make([]byte, m.tileSize*m.tileSize*m.valueSize)
+			for ab := range tiles {
+				block := tile(m.blockRows(ab[0]), m.blockRows(ab[1]))
+				rows, cols := block.Dims()
+				for k := range content {
+					content[k] = 0
+				}
+				for i := 0; i < rows; i++ {
+					for j := 0; j < cols; j++ {
+						m.encode(content[(i*m.tileSize+j)*m.valueSize:], block.At(i, j))
+					}
+				}
+				if err := put(m.tileIndex(ab[0], ab[1]), content); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	for a := 0; a < m.blocks; a++ {
+		for b := a; b < m.blocks; b++ {
+			tiles <- [2]int{a, b}
+		}
+	}
+	close(tiles)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// blockRows returns the genes of a block
+func (m *TiledMatrix) blockRows(block int) []int {
+	start := block * m.tileSize
+	end := start + m.tileSize
+	if end > len(m.Genes) {
+		end = len(m.Genes)
+	}
+	rows := make([]int, end-start)
+	for k := range rows {
+		rows[k] = start + k
+	}
+	return rows
+}
+
+// tileIndex returns the position of tile (a, b), a <= b, among the tiles
+func (m *TiledMatrix) tileIndex(a, b int) int {
+	return a*m.blocks - a*(a-1)/2 + (b - a)
+}
+
+// tileOffset returns the byte offset of a tile
+func (m *TiledMatrix) tileOffset(index int) int64 {
+	return int64(index) * int64(m.tileSize*m.tileSize*m.valueSize)
+}
+
+// encode writes a value in the precision of the matrix
+func (m *TiledMatrix) encode(dst []byte, value float64) {
+	if m.valueSize == 4 {
+		binary.LittleEndian.PutUint32(dst, math.Float32bits(float32(value)))
+	} else {
+		binary.LittleEndian.PutUint64(dst, math.Float64bits(value))
+	}
+}
+
+// decode reads the value at a byte offset of the tiles
+func (m *TiledMatrix) decode(offset int64) float64 {
+	if m.valueSize == 4 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(m.data[offset:])))
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(m.data[offset:]))
+}
+
+// At returns the value between genes i and j
+func (m *TiledMatrix) At(i, j int) float64 {
+	if i > j {
+		i, j = j, i
+	}
+	offset := m.tileOffset(m.tileIndex(i/m.tileSize, j/m.tileSize)) +
+		int64((i%m.tileSize)*m.tileSize+j%m.tileSize)*int64(m.valueSize)
+	return m.decode(offset)
+}
+
+// Row returns the values between gene i and every gene, reusing dst if it is
+// large enough
+func (m *TiledMatrix) Row(i int, dst []float64) []float64 {
+	if cap(dst) < len(m.Genes) {
+		dst = make([]float64, len(m.Genes))
+	}
+	dst = dst[:len(m.Genes)]
+	for j := range dst {
+		dst[j] = m.At(i, j)
+	}
+	return dst
+}
+
+// eachPair calls visit with every pair of genes i < j and its value, tile by
+// tile in file order
+func (m *TiledMatrix) eachPair(visit func(i, j int, value float64) error) error {
+	valueSize := int64(m.valueSize)
+	for a := 0; a < m.blocks; a++ {
+		rowsA := m.blockRows(a)
+		for b := a; b < m.blocks; b++ {
+			rowsB := m.blockRows(b)
+			tileStart := m.tileOffset(m.tileIndex(a, b))
+			for k, i := range rowsA {
+				rowStart := tileStart + int64(k*m.tileSize)*valueSize
+				first := 0
+				if a == b {
+					first = k + 1
+				}
+				for l := first; l < len(rowsB); l++ {
+					if err := visit(i, rowsB[l], m.decode(rowStart+int64(l)*valueSize)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RowSums returns, for every gene, the sum of transform of its values with
+// the other genes, leaving out NaN values
+func (m *TiledMatrix) RowSums(transform func(float64) float64) []float64 {
+	sums := make([]float64, len(m.Genes))
+	m.eachPair(func(i, j int, value float64) error {
+		if !math.IsNaN(value) {
+			value = transform(value)
+			sums[i] += value
+			sums[j] += value
+		}
+		return nil
+	})
+	return sums
+}
+
+// Threshold calls visit with every pair of genes i < j whose value is at
+// least threshold in absolute value, tile by tile, stopping at the first
+// error
+func (m *TiledMatrix) Threshold(threshold float64, visit func(i, j int, value float64) error) error {
+	return m.eachPair(func(i, j int, value float64) error {
+		if math.Abs(value) >= threshold {
+			return visit(i, j, value)
+		}
+		return nil
+	})
+}
+
+// Close releases the tiles of a matrix read from a tiled file
+func (m *TiledMatrix) Close() error {
+	m.data = nil
+	return m.release()
+}
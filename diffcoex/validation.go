@@ -0,0 +1,176 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package diffcoex
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Every reader reports problems in its input through a Validator instead of
+	silently fixing them. In strict mode (-strict) any problem fails the run.
+	In lenient mode the reader keeps its old behaviour and the problems are
+	collected and written to a tab-separated warnings file at the end of the
+	run.
+*/
+
+// Kinds of validation issues
+const (
+	IssueDuplicateID = "duplicate_id"
+	IssueRaggedRow   = "ragged_row"
+	IssueNonNumeric  = "non_numeric"
+	IssueNonFinite   = "non_finite"
+	IssueEmptyRow    = "empty_row"
+)
+
+// maxReportedIssues is the number of issues listed in a strict mode error
+const maxReportedIssues = 10
+
+// ValidationIssue is one problem found in an input file
+type ValidationIssue struct {
+	File   string
+	Line   int
+	Kind   string
+	Detail string
+}
+
+// String formats an issue as "file:line: kind: detail"
+func (issue ValidationIssue) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", issue.File, issue.Line, issue.Kind, issue.Detail)
+}
+
+// Validator collects the issues found while reading one file
+type Validator struct {
+	File   string
+	Issues []ValidationIssue
+	seen   map[string]int // line of the first row of each ID
+}
+
+var (
+	// StrictValidation makes readers fail on the first file with issues
+	StrictValidation bool
+
+	// ValidationWarnings holds the issues of every file read in lenient mode
+	ValidationWarnings []ValidationIssue
+)
+
+// NewValidator creates a validator for one input file
+func NewValidator(file string) *Validator {
+	return &Validator{File: file, seen: make(map[string]int)}
+}
+
+// Add records an issue at a line of the file
+func (v *Validator) Add(line int, kind, format string, args ...interface{}) {
+	v.Issues = append(v.Issues, ValidationIssue{File: v.File, Line: line, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// CheckID records a duplicate if the row ID was already seen
+func (v *Validator) CheckID(line int, id string) {
+	if first, ok := v.seen[id]; ok {
+		v.Add(line, IssueDuplicateID, "%s already appears on line %d", id, first)
+		return
+	}
+	v.seen[id] = line
+}
+
+// CheckFields records a ragged row if a row does not have the expected number
+// of fields, and an empty row if none of its fields from firstValue on has a
+// value. It returns false for empty rows, which readers skip.
+func (v *Validator) CheckFields(line int, fields []string, expected, firstValue int) bool {
+	if len(fields) != expected {
+		v.Add(line, IssueRaggedRow, "%d fields, expected %d", len(fields), expected)
+	}
+	for j := firstValue; j < len(fields); j++ {
+		if strings.TrimSpace(fields[j]) != "" {
+			return true
+		}
+	}
+	v.Add(line, IssueEmptyRow, "row %q has no values", fields[0])
+	return false
+}
+
+// missingTokens are the cell values read as missing (case-insensitive)
+var missingTokens = []string{"", "null", "na", "n/a"}
+
+// IsMissingToken reports whether a cell holds a missing value marker
+func IsMissingToken(token string) bool {
+	for _, missing := range missingTokens {
+		if strings.EqualFold(token, missing) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseValue parses a cell. Missing value markers (null, NA, empty) become NaN
+// without an issue; non-numeric tokens become NaN and are recorded, as are
+// NaN and Inf tokens.
+func (v *Validator) ParseValue(line int, column string, token string) float64 {
+	token = strings.TrimSpace(token)
+	if IsMissingToken(token) {
+		return math.NaN()
+	}
+	value, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		v.Add(line, IssueNonNumeric, "column %s: %q is not a number", column, token)
+		return math.NaN()
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		v.Add(line, IssueNonFinite, "column %s: %q", column, token)
+	}
+	return value
+}
+
+// Finish ends validation of the file. In strict mode it returns an error
+// listing the first issues; otherwise the issues become warnings.
+func (v *Validator) Finish() error {
+	if len(v.Issues) == 0 {
+		return nil
+	}
+	if StrictValidation {
+		var lines []string
+		for i, issue := range v.Issues {
+			if i == maxReportedIssues {
+				lines = append(lines, fmt.Sprintf("... and %d more", len(v.Issues)-maxReportedIssues))
+				break
+			}
+			lines = append(lines, issue.String())
+		}
+		return fmt.Errorf("%d validation issues in %s:\n%s", len(v.Issues), v.File, strings.Join(lines, "\n"))
+	}
+
+	log.Printf("Warning: %d validation issues in %s", len(v.Issues), v.File)
+	ValidationWarnings = append(ValidationWarnings, v.Issues...)
+	return nil
+}
+
+// WriteValidationWarnings writes the collected warnings as a tab-separated
+// file with a header
+func WriteValidationWarnings(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating warnings file: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, "file\tline\tkind\tdetail")
+	for _, issue := range ValidationWarnings {
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\n", issue.File, issue.Line, issue.Kind,
+			strings.NewReplacer("\t", " ", "\n", " ").Replace(issue.Detail))
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,282 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+	Probes are excluded by what they are, not by where they are in the file.
+	An exclusion file has one rule per line, optionally followed by a tab and
+	the reason for the exclusion:
+
+		1367452_at	cross-hybridizes
+		regex:^RGD
+		affx
+
+	A plain value is a probe ID, "regex:" starts a regular expression matched
+	against probe IDs, and "affx" excludes the Affymetrix control probes. Lines
+	starting with # are comments.
+
+	The rat data excludes the probes of data/GDS2901_exclusions.txt unless
+	-exclude is given: the 2475th probeset and the last probe of GDS2901,
+	which the original analysis removed by position. The rat pipeline checks
+	that those rows are the ones excluded. A rule of a given list that
+	matches no probe is a warning, but one of the default list is an error,
+	as it would silently change the analysis.
+*/
+
+// ratExclusions is the default exclusion list of the rat data
+//
+//go:embed data/GDS2901_exclusions.txt
+var ratExclusions string
+
+// defaultExclusions are the exclusion lists used when -exclude is not given
+var defaultExclusions = map[string]string{
+	"rat": ratExclusions,
+}
+
+// ExclusionNone given to -exclude disables the default exclusion list
+const ExclusionNone = "none"
+
+// affxPattern matches Affymetrix control probe IDs such as AFFX-BioB-5_at
+const affxPattern = `^AFFX[-_]`
+
+// gds2901ExcludedRow is the 1-based row of GDS2901 that the original
+// analysis removed besides the last one
+const gds2901ExcludedRow = 2475
+
+// ExclusionList holds the probes to remove before processing
+type ExclusionList struct {
+	IDs      map[string]string // probe ID to reason
+	Patterns []ExclusionPattern
+
+	// builtin holds the rules, as returned by Unmatched, of the default list
+	builtin map[string]bool
+}
+
+// ExclusionPattern excludes every probe whose ID matches a regular expression
+type ExclusionPattern struct {
+	Regexp *regexp.Regexp
+	Reason string
+}
+
+// Exclusion records one removed row and why it was removed
+type Exclusion struct {
+	ID     string
+	Reason string
+}
+
+// NewExclusionList creates an empty exclusion list
+func NewExclusionList() *ExclusionList {
+	return &ExclusionList{IDs: make(map[string]string)}
+}
+
+// AddID excludes a probe ID
+func (list *ExclusionList) AddID(id, reason string) {
+	if reason == "" {
+		reason = "listed probe"
+	}
+	list.IDs[id] = reason
+}
+
+// AddPattern excludes every probe ID matching a regular expression
+func (list *ExclusionList) AddPattern(pattern, reason string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid exclusion pattern %q: %v", pattern, err)
+	}
+	if reason == "" {
+		reason = "matches " + pattern
+	}
+	list.Patterns = append(list.Patterns, ExclusionPattern{Regexp: re, Reason: reason})
+	return nil
+}
+
+// AddAFFX excludes the Affymetrix control probes
+func (list *ExclusionList) AddAFFX() {
+	list.AddPattern(affxPattern, "AFFX control probe")
+}
+
+// AddRule adds one rule in the exclusion file syntax
+func (list *ExclusionList) AddRule(rule, reason string) error {
+	switch {
+	case strings.EqualFold(rule, "affx"):
+		if reason == "" {
+			list.AddAFFX()
+			return nil
+		}
+		return list.AddPattern(affxPattern, reason)
+	case strings.HasPrefix(rule, "regex:"):
+		return list.AddPattern(strings.TrimPrefix(rule, "regex:"), reason)
+	}
+	list.AddID(rule, reason)
+	return nil
+}
+
+// Reason returns why a probe is excluded, or "" if it is kept
+func (list *ExclusionList) Reason(id string) string {
+	if reason, ok := list.IDs[id]; ok {
+		return reason
+	}
+	for _, pattern := range list.Patterns {
+		if pattern.Regexp.MatchString(id) {
+			return pattern.Reason
+		}
+	}
+	return ""
+}
+
+// Empty reports whether the list excludes nothing
+func (list *ExclusionList) Empty() bool {
+	return list == nil || (len(list.IDs) == 0 && len(list.Patterns) == 0)
+}
+
+// ReadExclusionList reads an exclusion file
+func ReadExclusionList(filename string) (*ExclusionList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening exclusion list: %v", err)
+	}
+	defer file.Close()
+	return parseExclusionList(file, filename)
+}
+
+// parseExclusionList reads the rules of an exclusion list; name prefixes the
+// errors
+func parseExclusionList(reader io.Reader, name string) (*ExclusionList, error) {
+	list := NewExclusionList()
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, reason, _ := strings.Cut(line, "\t")
+		if err := list.AddRule(strings.TrimSpace(rule), strings.TrimSpace(reason)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading exclusion list: %v", err)
+	}
+	return list, nil
+}
+
+// defaultExclusionList returns the exclusion list of a dataset type, or nil
+// if it has none
+func defaultExclusionList(datasetType string) *ExclusionList {
+	rules, ok := defaultExclusions[datasetType]
+	if !ok {
+		return nil
+	}
+	list, err := parseExclusionList(strings.NewReader(rules), datasetType+" exclusion list")
+	if err != nil {
+		panic(fmt.Sprintf("invalid default exclusion list for %s: %v", datasetType, err))
+	}
+	list.builtin = make(map[string]bool)
+	for _, rule := range list.Unmatched(nil) {
+		list.builtin[rule] = true
+	}
+	return list
+}
+
+// Builtin reports whether a rule, as returned by Unmatched, comes from the
+// default list of the dataset type
+func (list *ExclusionList) Builtin(rule string) bool {
+	return list != nil && list.builtin[rule]
+}
+
+// checkGDS2901Exclusions checks that the default rat exclusion list removes
+// the rows of GDS2901 that the original analysis removed by position
+func checkGDS2901Exclusions(d *DataWithGenes, list *ExclusionList) error {
+	if len(list.builtin) == 0 {
+		return nil
+	}
+	n := len(d.GeneIDs)
+	if n < gds2901ExcludedRow {
+		return fmt.Errorf("the default rat exclusion list is for GDS2901, but the data has %d probes; "+
+			"pass -exclude with a list for this data or -exclude none", n)
+	}
+	for _, row := range []int{gds2901ExcludedRow, n} {
+		if id := d.GeneIDs[row-1]; list.Reason(id) == "" {
+			return fmt.Errorf("the default rat exclusion list does not exclude probe %s of row %d, "+
+				"which the original GDS2901 analysis removed; pass -exclude with a list for this data or -exclude none", id, row)
+		}
+	}
+	return nil
+}
+
+// Unmatched returns the probe IDs and patterns of the list that match none of
+// ids
+func (list *ExclusionList) Unmatched(ids []string) []string {
+	if list.Empty() {
+		return nil
+	}
+	present := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		present[id] = true
+	}
+	var unmatched []string
+	for id := range list.IDs {
+		if !present[id] {
+			unmatched = append(unmatched, id)
+		}
+	}
+	sort.Strings(unmatched)
+	for _, pattern := range list.Patterns {
+		matched := false
+		for _, id := range ids {
+			if pattern.Regexp.MatchString(id) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, "regex:"+pattern.Regexp.String())
+		}
+	}
+	return unmatched
+}
+
+// ExcludeProbes removes the excluded rows from d and returns the removed
+// rows with their reasons. It runs before probes are collapsed to genes, so
+// the row IDs are probe IDs.
+func ExcludeProbes(d *DataWithGenes, list *ExclusionList) (*DataWithGenes, []Exclusion, error) {
+	if list.Empty() {
+		return d, nil, nil
+	}
+	var keep []int
+	var excluded []Exclusion
+	for i, id := range d.GeneIDs {
+		if reason := list.Reason(id); reason != "" {
+			excluded = append(excluded, Exclusion{ID: id, Reason: reason})
+			continue
+		}
+		keep = append(keep, i)
+	}
+	if len(excluded) == 0 {
+		return d, nil, nil
+	}
+	if len(keep) == 0 {
+		return nil, excluded, fmt.Errorf("the exclusion list removes all %d probes", len(excluded))
+	}
+	return selectRows(d, keep), excluded, nil
+}
@@ -0,0 +1,262 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	Besides the CSV read by the other tools, preprocess can export every
+	condition file for GenePattern and GSEA:
+
+		gct   GCT 1.2: "#1.2", the dimensions, then Name, Description and one
+		      column per sample. The description is the probes behind a
+		      collapsed gene, the gene symbol of an annotated probe, or "na".
+		tsv   plain tab-separated matrix with a Gene and sample header, and no
+		      format or metadata lines
+		cls   categorical CLS phenotype file labelling every sample with its
+		      condition. It goes with all_conditions.gct, which holds the
+		      samples of every condition, so each profile directory gets one
+		      pair.
+*/
+
+// Export formats, as given to -export
+const (
+	ExportGCT = "gct"
+	ExportTSV = "tsv"
+	ExportCLS = "cls"
+)
+
+// allConditionsName is the base name of the GCT and CLS pair holding every
+// condition of a profile
+const allConditionsName = "all_conditions"
+
+// ParseExportFormats parses a comma-separated list of export formats
+func ParseExportFormats(spec string) ([]string, error) {
+	var formats []string
+	for _, format := range splitList(spec) {
+		format = strings.ToLower(format)
+		if format != ExportGCT && format != ExportTSV && format != ExportCLS {
+			return nil, fmt.Errorf("unknown export format %q: use 'gct', 'tsv' or 'cls'", format)
+		}
+		if !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats, nil
+}
+
+// exportPath returns the path of a condition file exported in a format
+func exportPath(filename, format string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + format
+}
+
+// geneDescription returns the GCT description of a row
+func geneDescription(d *DataWithGenes, i int) string {
+	if d.ProbeIDs != nil && d.ProbeIDs[i] != "" {
+		return d.ProbeIDs[i]
+	}
+	if d.GeneSymbols != nil && d.GeneSymbols[i] != "" {
+		return d.GeneSymbols[i]
+	}
+	return "na"
+}
+
+// saveToGCT writes an expression matrix as a GCT 1.2 file. Missing values are
+// left empty, as GenePattern expects.
+func saveToGCT(d *DataWithGenes, filename string) error {
+	return writeTabular(d, filename, func(writer *bufio.Writer, rows, cols int) {
+		fmt.Fprintf(writer, "#1.2\n%d\t%d\n", rows, cols)
+		writer.WriteString(strings.Join(append([]string{"Name", "Description"}, cleanTabFields(d.SampleIDs)...), "\t") + "\n")
+	}, func(i int) []string {
+		return []string{d.GeneIDs[i], geneDescription(d, i)}
+	}, func(v float64) string {
+		if math.IsNaN(v) {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	})
+}
+
+// saveToTSV writes an expression matrix as a plain tab-separated file with a
+// sample header and missing values as NA
+func saveToTSV(d *DataWithGenes, filename string) error {
+	return writeTabular(d, filename, func(writer *bufio.Writer, rows, cols int) {
+		writer.WriteString(strings.Join(append([]string{"Gene"}, cleanTabFields(d.SampleIDs)...), "\t") + "\n")
+	}, func(i int) []string {
+		return []string{d.GeneIDs[i]}
+	}, formatValue)
+}
+
+// writeTabular writes a header, then one tab-separated line per gene made of
+// its leading fields and its formatted values
+func writeTabular(d *DataWithGenes, filename string, header func(*bufio.Writer, int, int),
+	leading func(int) []string, format func(float64) string) error {
+	rows, cols := d.Data.Dims()
+	if len(d.GeneIDs) != rows || len(d.SampleIDs) != cols {
+		return fmt.Errorf("matrix is %dx%d but has %d gene IDs and %d sample IDs",
+			rows, cols, len(d.GeneIDs), len(d.SampleIDs))
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	header(writer, rows, cols)
+	for i := 0; i < rows; i++ {
+		fields := cleanTabFields(leading(i))
+		for j := 0; j < cols; j++ {
+			fields = append(fields, format(d.Data.At(i, j)))
+		}
+		writer.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	return nil
+}
+
+// cleanTabFields replaces the tabs and line breaks inside fields by spaces
+func cleanTabFields(fields []string) []string {
+	cleaned := make([]string, len(fields))
+	for i, field := range fields {
+		cleaned[i] = strings.Join(strings.FieldsFunc(field, func(r rune) bool {
+			return r == '\t' || r == '\n' || r == '\r'
+		}), " ")
+	}
+	return cleaned
+}
+
+// saveToCLS writes a categorical CLS file giving the class of every sample,
+// in order. Classes are numbered in the order they first appear.
+func saveToCLS(labels []string, filename string) error {
+	var classes []string
+	for _, label := range labels {
+		if !slices.Contains(classes, label) {
+			classes = append(classes, label)
+		}
+	}
+	// CLS fields are separated by spaces
+	names := make([]string, len(labels))
+	for i, label := range labels {
+		names[i] = strings.Join(strings.Fields(label), "_")
+	}
+	classNames := make([]string, len(classes))
+	for i, class := range classes {
+		classNames[i] = strings.Join(strings.Fields(class), "_")
+	}
+
+	content := fmt.Sprintf("%d %d 1\n# %s\n%s\n", len(labels), len(classes),
+		strings.Join(classNames, " "), strings.Join(names, " "))
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	return nil
+}
+
+// exportCondition writes a condition file in the per-condition export formats
+func exportCondition(d *DataWithGenes, options PipelineOptions, filename string) error {
+	for _, format := range options.Exports {
+		path := exportPath(filename, format)
+		var err error
+		switch format {
+		case ExportGCT:
+			err = saveToGCT(d, path)
+		case ExportTSV:
+			err = saveToTSV(d, path)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		diffcoex.RecordOutput(path)
+	}
+	return nil
+}
+
+// combineConditions joins the samples of several conditions, which must have
+// the same genes in the same order, and returns the condition of every sample
+func combineConditions(names []string, groups []*DataWithGenes) (*DataWithGenes, []string, error) {
+	first := groups[0]
+	genes := len(first.GeneIDs)
+	samples := 0
+	for g, group := range groups {
+		if strings.Join(group.GeneIDs, "\x00") != strings.Join(first.GeneIDs, "\x00") {
+			return nil, nil, fmt.Errorf("conditions %s and %s do not have the same genes", names[0], names[g])
+		}
+		samples += len(group.SampleIDs)
+	}
+
+	combined := &DataWithGenes{
+		Data:        mat.NewDense(genes, samples, nil),
+		GeneIDs:     first.GeneIDs,
+		ProbeIDs:    first.ProbeIDs,
+		GeneSymbols: first.GeneSymbols,
+	}
+	var labels []string
+	column := 0
+	for g, group := range groups {
+		for j, sample := range group.SampleIDs {
+			for i := 0; i < genes; i++ {
+				combined.Data.Set(i, column, group.Data.At(i, j))
+			}
+			combined.SampleIDs = append(combined.SampleIDs, sample)
+			labels = append(labels, names[g])
+			column++
+		}
+	}
+	return combined, labels, nil
+}
+
+// writeCLSExports writes, in the directory of every profile, all the written
+// conditions as all_conditions.gct with the all_conditions.cls phenotypes
+func writeCLSExports(options PipelineOptions) error {
+	if !slices.Contains(options.Exports, ExportCLS) || len(writtenConditions) == 0 {
+		return nil
+	}
+	for p, profile := range options.Profiles {
+		var names []string
+		var groups []*DataWithGenes
+		for _, output := range writtenConditions {
+			names = append(names, output.Name)
+			groups = append(groups, output.Data[p])
+		}
+		combined, labels, err := combineConditions(names, groups)
+		if err != nil {
+			return fmt.Errorf("error exporting %s: %v", profile.Name, err)
+		}
+		gctPath := filepath.Join(options.OutputDir, profile.Name, allConditionsName+".gct")
+		clsPath := filepath.Join(options.OutputDir, profile.Name, allConditionsName+".cls")
+		if err := saveToGCT(combined, gctPath); err != nil {
+			return err
+		}
+		diffcoex.RecordOutput(gctPath)
+		if err := saveToCLS(labels, clsPath); err != nil {
+			return err
+		}
+		diffcoex.RecordOutput(clsPath)
+	}
+	return nil
+}
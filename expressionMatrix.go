@@ -0,0 +1,130 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	Expression matrices are shared between every tool in the same format:
+
+		#diffcoex-matrix 1
+		#key=value            (optional metadata lines)
+		Gene,S1,S2,...
+		gene1,0.5,1.2,...
+
+	saveToCSV always writes the format line and the header row of sample IDs,
+	so no gene or sample is lost when another tool reads the file back. Every
+	tool, preprocess included, reads matrices with diffcoex.ReadExpressionMatrix
+	(see diffcoex/expressionMatrix.go), which also reads a fresh binary cache
+	of the file in its place.
+*/
+
+// ReadExpressionMatrix reads an expression matrix with the shared reader of
+// diffcoex, which also takes the tab-separated, annotated and headerless input
+// formats, into a DataWithGenes
+func ReadExpressionMatrix(filePath string) (*DataWithGenes, error) {
+	matrix, err := diffcoex.ReadExpressionMatrix(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(matrix.GeneIDs) == 0 {
+		return nil, fmt.Errorf("%s: no valid data found in file", filePath)
+	}
+
+	data := mat.NewDense(len(matrix.GeneIDs), len(matrix.SampleIDs), nil)
+	for i, row := range matrix.Values {
+		data.SetRow(i, row)
+	}
+	return &DataWithGenes{
+		Data:      data,
+		GeneIDs:   matrix.GeneIDs,
+		SampleIDs: matrix.SampleIDs,
+		Metadata:  matrix.Metadata,
+	}, nil
+}
+
+// saveToCSV writes an expression matrix with its format line, metadata lines
+// and sample header
+func saveToCSV(d *DataWithGenes, filename string) error {
+	rows, cols := d.Data.Dims()
+	if len(d.GeneIDs) != rows || len(d.SampleIDs) != cols {
+		return fmt.Errorf("matrix is %dx%d but has %d gene IDs and %d sample IDs",
+			rows, cols, len(d.GeneIDs), len(d.SampleIDs))
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer file.Close()
+
+	// Format line, then metadata sorted by key so outputs are reproducible
+	if _, err := fmt.Fprintf(file, "%s %d\n", diffcoex.MatrixFormatName, diffcoex.MatrixFormatVersion); err != nil {
+		return fmt.Errorf("error writing format line: %v", err)
+	}
+	keys := make([]string, 0, len(d.Metadata))
+	for key := range d.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.ReplaceAll(d.Metadata[key], "\n", " ")
+		if _, err := fmt.Fprintf(file, "#%s=%s\n", key, value); err != nil {
+			return fmt.Errorf("error writing metadata: %v", err)
+		}
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	header := append([]string{"Gene"}, d.SampleIDs...)
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("error writing header: %v", err)
+	}
+
+	for i := 0; i < rows; i++ {
+		row := make([]string, cols+1)
+		row[0] = d.GeneIDs[i]
+		for j := 0; j < cols; j++ {
+			row[j+1] = formatValue(d.Data.At(i, j))
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing row: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// saveMatrixCache writes the binary cache of an expression matrix file saved
+// by saveToCSV
+func saveMatrixCache(d *DataWithGenes, filename, precision string) error {
+	return diffcoex.WriteMatrixCache(filename, precision, d.GeneIDs, d.SampleIDs, d.Metadata, d.Data.At)
+}
+
+// formatValue formats a matrix value for CSV output, writing missing values
+// as NA so that R and the other tools read them back as missing
+func formatValue(v float64) string {
+	if math.IsNaN(v) {
+		return "NA"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -13,7 +13,6 @@ import (
 	"bufio"
 	"fmt"
 	"io/fs"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -21,10 +20,9 @@ import (
 	"strings"
 	"testing"
 
-	"encoding/csv"
-
 	"math"
 
+	"diffcoex"
 	"gonum.org/v1/gonum/mat"
 )
 
@@ -51,7 +49,7 @@ type RatDataTest struct {
 }
 
 // Add this to your existing test_types.go
-type CleanDataTest struct {
+type ImputeMeanTest struct {
 	name     string
 	input    *DataWithGenes
 	expected *DataWithGenes
@@ -278,7 +276,7 @@ func TestProcessGolubData(t *testing.T) {
 		os.Symlink(tmpDir, "output")
 
 		// Run the test
-		err := processGolubData(test.inputFile)
+		err := processGolubData(test.inputFile, defaultPipelineOptions("golub"))
 		if err != nil {
 			t.Errorf("Test %d failed with error: %v", i, err)
 			continue
@@ -364,44 +362,13 @@ func ReadGolubDataTests(directory string) []GolubDataTest {
 	return tests
 }
 
-// ReadDataWithGenesFromCSV reads a DataWithGenes structure from a CSV file
+// ReadDataWithGenesFromCSV reads a DataWithGenes structure from a matrix file written by saveToCSV
 func ReadDataWithGenesFromCSV(file string) *DataWithGenes {
-	f, err := os.Open(file)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-
-	reader := csv.NewReader(f)
-	records, err := reader.ReadAll()
+	data, err := ReadExpressionMatrix(file)
 	if err != nil {
 		panic(err)
 	}
-
-	if len(records) == 0 {
-		return &DataWithGenes{
-			Data:    mat.NewDense(0, 0, nil),
-			GeneIDs: []string{},
-		}
-	}
-
-	rows := len(records)
-	cols := len(records[0]) - 1 // First column is gene ID
-	data := mat.NewDense(rows, cols, nil)
-	geneIDs := make([]string, rows)
-
-	for i, record := range records {
-		geneIDs[i] = record[0]
-		for j := 1; j < len(record); j++ {
-			val, _ := strconv.ParseFloat(record[j], 64)
-			data.Set(i, j-1, val)
-		}
-	}
-
-	return &DataWithGenes{
-		Data:    data,
-		GeneIDs: geneIDs,
-	}
+	return data
 }
 
 // compareDataWithGenes compares two DataWithGenes structures
@@ -476,10 +443,18 @@ func generateTestInputFile(filename string) error {
 	}
 	f.WriteString("\n")
 
-	// Write exactly 2476 rows
+	// Write exactly 2476 rows, the last two named as the GDS2901 probes the
+	// rat data excludes by default
 	for i := 1; i <= 2476; i++ {
 		// ID and Description
-		row := fmt.Sprintf("GENE%d\tdesc%d", i, i)
+		id := fmt.Sprintf("GENE%d", i)
+		switch i {
+		case 2475:
+			id = "1369926_at"
+		case 2476:
+			id = "AFFX_Rat_beta-actin_M_at"
+		}
+		row := fmt.Sprintf("%s\tdesc%d", id, i)
 
 		// Eker samples (first 36 columns)
 		for j := 0; j < 36; j++ {
@@ -541,8 +516,14 @@ func TestProcessRatData(t *testing.T) {
 		t.Fatalf("Failed to create output symlink: %v", err)
 	}
 
-	// Run the test
-	if err := processRatData(inputFile); err != nil {
+	// Run the test; the generated file has no subsets, so it is only split
+	// by the GDS2901 column layout when asked to
+	options := defaultPipelineOptions("rat")
+	if err := processRatData(inputFile, options); err == nil {
+		t.Errorf("processRatData should fail without subsets or -gds2901-layout")
+	}
+	options.GDS2901Layout = true
+	if err := processRatData(inputFile, options); err != nil {
 		t.Errorf("processRatData failed: %v", err)
 	}
 
@@ -579,14 +560,18 @@ func ReadRatDataTests(directory string) []RatDataTest {
 	return tests
 }
 
-// TestCleanData tests the CleanData function
-func TestCleanData(t *testing.T) {
-	tests := ReadCleanDataTests("tests/CleanData")
+// TestImputeMean tests filling missing and infinite values with the gene's
+// mean
+func TestImputeMean(t *testing.T) {
+	tests := ReadImputeMeanTests("tests/ImputeMean")
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			// Run the test
-			result := CleanData(test.input.Data)
+			result, err := ImputeMissing(test.input.Data, ImputeMean, defaultKNNNeighbours)
+			if err != nil {
+				t.Fatalf("ImputeMissing failed: %v", err)
+			}
 
 			// Compare dimensions
 			r1, c1 := result.Dims()
@@ -619,13 +604,13 @@ func TestCleanData(t *testing.T) {
 	}
 }
 
-// ReadCleanDataTests reads test cases from the specified directory
-func ReadCleanDataTests(directory string) []CleanDataTest {
+// ReadImputeMeanTests reads test cases from the specified directory
+func ReadImputeMeanTests(directory string) []ImputeMeanTest {
 	// Read input files
 	inputFiles := ReadDirectory(directory + "/input")
 	numFiles := len(inputFiles)
 
-	tests := make([]CleanDataTest, numFiles)
+	tests := make([]ImputeMeanTest, numFiles)
 	for i, inputFile := range inputFiles {
 		// Read test name from filename
 		tests[i].name = strings.TrimSuffix(inputFile.Name(), ".txt")
@@ -890,104 +875,6 @@ func sliceEqual(a, b []int) bool {
 	return true
 }
 
-// ReadMatrix reads a matrix from a given file path.
-// The first line should contain the row index to remove, followed by the matrix data.
-func ReadMatrix(filePath string) (*mat.Dense, int, error) {
-	inputData, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	lines := strings.Split(string(inputData), "\n")
-	if len(lines) < 2 {
-		return nil, 0, fmt.Errorf("Input file must contain at least one row of data and one row index")
-	}
-
-	// Read the row to remove
-	rowToRemove, err := strconv.Atoi(strings.TrimSpace(lines[0]))
-	if err != nil {
-		return nil, 0, fmt.Errorf("Invalid row index: %v", err)
-	}
-
-	// Parse the matrix data
-	var dataRows [][]float64
-	for _, line := range lines[1:] {
-		if line == "" {
-			continue
-		}
-		var row []float64
-		for _, val := range strings.Fields(line) {
-			num, _ := strconv.ParseFloat(val, 64)
-			row = append(row, num)
-		}
-		dataRows = append(dataRows, row)
-	}
-
-	// Create a matrix from the parsed data
-	data := mat.NewDense(len(dataRows), len(dataRows[0]), nil)
-	for i, row := range dataRows {
-		data.SetRow(i, row)
-	}
-
-	return data, rowToRemove, nil
-}
-
-// MatrixEqual compares two matrices for equality.
-func MatrixEqual(a, b *mat.Dense) bool {
-	if a == nil || b == nil {
-		return a == b
-	}
-	aRows, aCols := a.Dims()
-	bRows, bCols := b.Dims()
-	if aRows != bRows || aCols != bCols {
-		return false
-	}
-	for i := 0; i < aRows; i++ {
-		for j := 0; j < aCols; j++ {
-			if math.Abs(a.At(i, j)-b.At(i, j)) > 1e-9 { // Use a tolerance for floating-point comparison
-				return false
-			}
-		}
-	}
-	return true
-}
-
-func TestRemoveRow(t *testing.T) {
-	// Read test cases from tests/RemoveRow directory
-	files, err := os.ReadDir("tests/RemoveRow/input")
-	if err != nil {
-		t.Fatalf("Failed to read test directory: %v", err)
-	}
-
-	for _, file := range files {
-		inputPath := filepath.Join("tests/RemoveRow/input", file.Name())
-		outputPath := filepath.Join("tests/RemoveRow/output",
-			strings.Replace(file.Name(), "input_", "output_", 1))
-
-		// Read input matrix and row to remove
-		matrix, rowToRemove, err := ReadMatrix(inputPath)
-		if err != nil {
-			t.Errorf("Error reading input file %s: %v", file.Name(), err)
-			continue
-		}
-
-		// Read expected output matrix
-		expectedOutput, _, err := ReadMatrix(outputPath)
-		if err != nil {
-			t.Errorf("Error reading output file %s: %v", file.Name(), err)
-			continue
-		}
-
-		// Remove the specified row
-		result := removeRow(matrix, rowToRemove)
-
-		// Compare with expected output
-		if !MatrixEqual(result, expectedOutput) {
-			t.Errorf("Test case %s failed: matrices are not equal", file.Name())
-		}
-	}
-}
-
 func TestExtractALLSamples(t *testing.T) {
 	// Read test cases from tests/ExtractALL directory
 	tests := ReadALLTests("tests/ExtractALL")
@@ -1538,3 +1425,954 @@ func ReadApplyLog2FromFile(filename string) *mat.Dense {
 
 	return mat.NewDense(rows, cols, data)
 }
+
+// TestReadSoftFile tests that ReadSoftFile keeps dataset, platform and subset metadata
+func TestReadSoftFile(t *testing.T) {
+	inputFiles := ReadDirectory("tests/ReadSoftFile/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/ReadSoftFile/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+
+		soft, err := ReadSoftFile("tests/ReadSoftFile/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadSoftFile failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		// Describe the parsed file in the same layout as the expected output
+		got := []string{
+			"dataset\t" + soft.Dataset().ID,
+			"platform\t" + soft.Platform().ID,
+			"samples\t" + strings.Join(soft.Expression.SampleIDs, ","),
+			"genes\t" + strings.Join(soft.Expression.GeneIDs, ","),
+		}
+		for _, subset := range soft.Subsets {
+			got = append(got, strings.Join([]string{"subset", subset.Type, subset.Description,
+				strings.Join(subset.SampleIDs, ",")}, "\t"))
+		}
+
+		want := ReadLinesFromFile(outputPath)
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestSplitBySubsetType tests splitting a SOFT expression table by subset type
+func TestSplitBySubsetType(t *testing.T) {
+	inputFiles := ReadDirectory("tests/SplitBySubsetType/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/SplitBySubsetType/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+
+		soft, err := ReadSoftFile("tests/SplitBySubsetType/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadSoftFile failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		// The first line of the expected output is the subset type,
+		// followed by blank-line separated groups
+		want := ReadLinesFromFile(outputPath)
+		names, groups, err := soft.SplitBySubsetType(soft.Expression, want[0])
+		if err != nil {
+			t.Errorf("%s: SplitBySubsetType failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		got := []string{want[0]}
+		for i, group := range groups {
+			if i > 0 {
+				got = append(got, "")
+			}
+			got = append(got, names[i])
+			got = append(got, FormatRows(group)...)
+		}
+
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// ReadLinesFromFile reads a file and returns its lines without trailing newlines
+func ReadLinesFromFile(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return lines
+}
+
+// TestReadSeriesMatrix tests reading sample annotations and the expression table of a series matrix
+func TestReadSeriesMatrix(t *testing.T) {
+	inputFiles := ReadDirectory("tests/ReadSeriesMatrix/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/ReadSeriesMatrix/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+
+		series, err := ReadSeriesMatrix("tests/ReadSeriesMatrix/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadSeriesMatrix failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		// Describe the parsed file in the same layout as the expected output
+		got := []string{
+			"series\t" + series.Series["geo_accession"][0],
+			"samples\t" + strings.Join(series.Expression.SampleIDs, ","),
+			"genes\t" + strings.Join(series.Expression.GeneIDs, ","),
+		}
+		for _, sample := range series.Samples {
+			var characteristics []string
+			for key, value := range sample.Characteristics {
+				characteristics = append(characteristics, key+"="+value)
+			}
+			sort.Strings(characteristics)
+			got = append(got, strings.Join([]string{"sample", sample.Accession, sample.Title,
+				strings.Join(characteristics, ";")}, "\t"))
+		}
+		for _, row := range FormatRows(series.Expression) {
+			got = append(got, "row\t"+row)
+		}
+
+		want := ReadLinesFromFile(outputPath)
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestReadSampleSheet tests reading sample IDs, conditions, batches and covariates
+func TestReadSampleSheet(t *testing.T) {
+	inputFiles := ReadDirectory("tests/ReadSampleSheet/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/ReadSampleSheet/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+
+		sheet, err := ReadSampleSheet("tests/ReadSampleSheet/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadSampleSheet failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		got := []string{
+			"conditions\t" + strings.Join(sheet.Conditions(), ","),
+			"covariates\t" + strings.Join(sheet.CovariateNames, ","),
+		}
+		for _, sample := range sheet.Samples {
+			var covariates []string
+			for key, value := range sample.Covariates {
+				covariates = append(covariates, key+"="+value)
+			}
+			sort.Strings(covariates)
+			got = append(got, strings.Join([]string{"sample", sample.SampleID, sample.Condition,
+				sample.Batch, strings.Join(covariates, ";")}, "\t"))
+		}
+
+		want := ReadLinesFromFile(outputPath)
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestSplitByCondition tests splitting an expression matrix with a sample sheet
+func TestSplitByCondition(t *testing.T) {
+	inputFiles := ReadDirectory("tests/SplitByCondition/input")
+	for _, inputFile := range inputFiles {
+		if !strings.HasPrefix(inputFile.Name(), "matrix_") {
+			continue
+		}
+		index := strings.TrimSuffix(strings.TrimPrefix(inputFile.Name(), "matrix_"), filepath.Ext(inputFile.Name()))
+
+		data, err := ReadExpressionMatrix("tests/SplitByCondition/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+			continue
+		}
+		sheet, err := ReadSampleSheet("tests/SplitByCondition/input/samples_" + index + ".txt")
+		if err != nil {
+			t.Errorf("%s: ReadSampleSheet failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		names, groups, err := SplitByCondition(data, sheet, nil)
+		if err != nil {
+			t.Errorf("%s: SplitByCondition failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		var got []string
+		for i, group := range groups {
+			if i > 0 {
+				got = append(got, "")
+			}
+			got = append(got, names[i]+"\t"+strings.Join(group.SampleIDs, ","))
+			got = append(got, FormatRows(group)...)
+		}
+
+		want := ReadLinesFromFile("tests/SplitByCondition/output/output_" + index + ".txt")
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// FormatRows formats each row of a DataWithGenes as "gene,value,value,..."
+func FormatRows(d *DataWithGenes) []string {
+	rows, cols := d.Data.Dims()
+	lines := make([]string, rows)
+	for r := 0; r < rows; r++ {
+		row := []string{d.GeneIDs[r]}
+		for c := 0; c < cols; c++ {
+			row = append(row, strconv.FormatFloat(d.Data.At(r, c), 'f', -1, 64))
+		}
+		lines[r] = strings.Join(row, ",")
+	}
+	return lines
+}
+
+// TestSaveToCSVRoundTrip tests that every gene, sample and metadata entry
+// survives saveToCSV followed by ReadExpressionMatrix
+func TestSaveToCSVRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputFiles := ReadDirectory("tests/SaveToCSV/input")
+	for _, inputFile := range inputFiles {
+		original, err := ReadExpressionMatrix("tests/SaveToCSV/input/" + inputFile.Name())
+		if err != nil {
+			t.Fatalf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+		}
+		original.Metadata["written_by"] = "TestSaveToCSVRoundTrip"
+
+		outputPath := filepath.Join(tmpDir, inputFile.Name()+".csv")
+		if err := saveToCSV(original, outputPath); err != nil {
+			t.Fatalf("%s: saveToCSV failed: %v", inputFile.Name(), err)
+		}
+		result, err := ReadExpressionMatrix(outputPath)
+		if err != nil {
+			t.Fatalf("%s: reading back failed: %v", inputFile.Name(), err)
+		}
+
+		if !compareDataWithGenes(result, original, t) {
+			t.Errorf("%s: data changed after round trip", inputFile.Name())
+		}
+		if strings.Join(result.SampleIDs, ",") != strings.Join(original.SampleIDs, ",") {
+			t.Errorf("%s: sample IDs changed: got %v, want %v", inputFile.Name(), result.SampleIDs, original.SampleIDs)
+		}
+		for key, value := range original.Metadata {
+			if result.Metadata[key] != value {
+				t.Errorf("%s: metadata %s changed: got %q, want %q", inputFile.Name(), key, result.Metadata[key], value)
+			}
+		}
+	}
+}
+
+// TestSaveToCSVSharedReader tests that diffcoex.ReadExpressionMatrix, used
+// by the downstream tools, reads saveToCSV output back unchanged
+func TestSaveToCSVSharedReader(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputFiles := ReadDirectory("tests/SaveToCSV/input")
+	for _, inputFile := range inputFiles {
+		original, err := ReadExpressionMatrix("tests/SaveToCSV/input/" + inputFile.Name())
+		if err != nil {
+			t.Fatalf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+		}
+		outputPath := filepath.Join(tmpDir, inputFile.Name()+".csv")
+		if err := saveToCSV(original, outputPath); err != nil {
+			t.Fatalf("%s: saveToCSV failed: %v", inputFile.Name(), err)
+		}
+
+		matrix, err := diffcoex.ReadExpressionMatrix(outputPath)
+		if err != nil {
+			t.Fatalf("%s: diffcoex.ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+		}
+		result := &DataWithGenes{
+			Data:      mat.NewDense(len(matrix.GeneIDs), len(matrix.SampleIDs), nil),
+			GeneIDs:   matrix.GeneIDs,
+			SampleIDs: matrix.SampleIDs,
+			Metadata:  matrix.Metadata,
+		}
+		for i, row := range matrix.Values {
+			result.Data.SetRow(i, row)
+		}
+		if !compareDataWithGenes(result, original, t) {
+			t.Errorf("%s: data changed after round trip", inputFile.Name())
+		}
+		if strings.Join(result.SampleIDs, ",") != strings.Join(original.SampleIDs, ",") {
+			t.Errorf("%s: sample IDs changed: got %v, want %v", inputFile.Name(), result.SampleIDs, original.SampleIDs)
+		}
+		for key, value := range original.Metadata {
+			if result.Metadata[key] != value {
+				t.Errorf("%s: metadata %s changed: got %q, want %q", inputFile.Name(), key, result.Metadata[key], value)
+			}
+		}
+	}
+}
+
+// TestMatrixCache tests that the binary cache of a saved matrix reads back
+// the same data, and that stale or corrupt caches fall back to the CSV
+func TestMatrixCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputFiles := ReadDirectory("tests/SaveToCSV/input")
+	for _, inputFile := range inputFiles {
+		original, err := ReadExpressionMatrix("tests/SaveToCSV/input/" + inputFile.Name())
+		if err != nil {
+			t.Fatalf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+		}
+		outputPath := filepath.Join(tmpDir, inputFile.Name()+".csv")
+		if err := saveToCSV(original, outputPath); err != nil {
+			t.Fatalf("%s: saveToCSV failed: %v", inputFile.Name(), err)
+		}
+
+		for _, precision := range []string{diffcoex.CacheFloat64, diffcoex.CacheFloat32} {
+			if err := saveMatrixCache(original, outputPath, precision); err != nil {
+				t.Fatalf("%s: saveMatrixCache(%s) failed: %v", inputFile.Name(), precision, err)
+			}
+			cache := diffcoex.ReadFreshMatrixCache(outputPath)
+			if cache == nil {
+				t.Fatalf("%s: %s cache was not read", inputFile.Name(), precision)
+			}
+			result := &DataWithGenes{
+				Data:      mat.NewDense(len(cache.GeneIDs), len(cache.SampleIDs), cache.Values),
+				GeneIDs:   cache.GeneIDs,
+				SampleIDs: cache.SampleIDs,
+			}
+			if !compareDataWithGenes(result, original, t) {
+				t.Errorf("%s: %s cache changed the data", inputFile.Name(), precision)
+			}
+			if strings.Join(result.SampleIDs, ",") != strings.Join(original.SampleIDs, ",") {
+				t.Errorf("%s: %s cache changed the sample IDs", inputFile.Name(), precision)
+			}
+		}
+
+		// A corrupt cache is skipped
+		cachePath := diffcoex.MatrixCachePath(outputPath)
+		content, err := os.ReadFile(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content[len(content)-5] ^= 0xff
+		if err := os.WriteFile(cachePath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if diffcoex.ReadFreshMatrixCache(outputPath) != nil {
+			t.Errorf("%s: corrupt cache was read", inputFile.Name())
+		}
+
+		// A cache of a CSV that has since been rewritten is stale
+		if err := saveMatrixCache(original, outputPath, diffcoex.CacheFloat64); err != nil {
+			t.Fatal(err)
+		}
+		original.Metadata["rewritten"] = "yes"
+		if err := saveToCSV(original, outputPath); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := diffcoex.FreshMatrixCache(outputPath); ok {
+			t.Errorf("%s: stale cache is fresh", inputFile.Name())
+		}
+	}
+}
+
+// TestNormalizerChain tests parsing and applying normalization chains. The first
+// line of each input is the chain, the first line of each output its name.
+func TestNormalizerChain(t *testing.T) {
+	inputFiles := ReadDirectory("tests/NormalizerChain/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/NormalizerChain/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+		input := ReadLinesFromFile("tests/NormalizerChain/input/" + inputFile.Name())
+		want := ReadLinesFromFile(outputPath)
+
+		chain, err := ParseNormalizerChain(input[0])
+		if err != nil {
+			t.Errorf("%s: ParseNormalizerChain failed: %v", inputFile.Name(), err)
+			continue
+		}
+		data := ParseMatrixLines(input[1:])
+		expected := ParseMatrixLines(want[1:])
+
+		result := chain.Apply(&DataWithGenes{Data: data, GeneIDs: make([]string, data.RawMatrix().Rows)})
+		if result.Metadata["normalization"] != want[0] {
+			t.Errorf("%s: normalization metadata = %q, want %q", inputFile.Name(), result.Metadata["normalization"], want[0])
+		}
+		if !MatrixEqualNaN(result.Data, expected, 1e-10) {
+			t.Errorf("%s: got\n%v\nwant\n%v", inputFile.Name(), mat.Formatted(result.Data), mat.Formatted(expected))
+		}
+	}
+}
+
+// TestParseNormalizerChainErrors tests that invalid chains are rejected
+func TestParseNormalizerChainErrors(t *testing.T) {
+	specs := []string{"loess", "log:base=1", "log:bsae=2", "log:base", "arcsinh:cofactor=0", "quantile:pseudocount=x"}
+	for _, spec := range specs {
+		if _, err := ParseNormalizerChain(spec); err == nil {
+			t.Errorf("ParseNormalizerChain(%q) should fail", spec)
+		}
+	}
+}
+
+// ParseMatrixLines parses whitespace-separated rows of numbers into a matrix
+func ParseMatrixLines(lines []string) *mat.Dense {
+	var values []float64
+	rows := 0
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				panic(err)
+			}
+			values = append(values, v)
+		}
+		rows++
+	}
+	return mat.NewDense(rows, len(values)/rows, values)
+}
+
+// MatrixEqualNaN compares two matrices within a tolerance, treating NaNs as equal
+func MatrixEqualNaN(a, b *mat.Dense, tolerance float64) bool {
+	ra, ca := a.Dims()
+	rb, cb := b.Dims()
+	if ra != rb || ca != cb {
+		return false
+	}
+	for i := 0; i < ra; i++ {
+		for j := 0; j < ca; j++ {
+			x, y := a.At(i, j), b.At(i, j)
+			if math.IsNaN(x) != math.IsNaN(y) || (!math.IsNaN(x) && math.Abs(x-y) > tolerance) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TestDetectLogScale tests the GEO2R log scale rule. Each output holds
+// whether a log transform is needed, then the quantiles it was based on.
+func TestDetectLogScale(t *testing.T) {
+	inputFiles := ReadDirectory("tests/DetectLogScale/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/DetectLogScale/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+		data := ParseMatrixLines(ReadLinesFromFile("tests/DetectLogScale/input/" + inputFile.Name()))
+		want := ReadLinesFromFile(outputPath)
+
+		needsLog, detail := DetectLogScale(data)
+		got := []string{strconv.FormatBool(needsLog), detail}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestCollapseProbes tests collapsing probes to genes with a platform table.
+// The first line of each output is the collapse method, followed by the
+// collapsed rows, the probes behind each row and the status of every probe.
+func TestCollapseProbes(t *testing.T) {
+	inputFiles := ReadDirectory("tests/CollapseProbes/input")
+	for _, inputFile := range inputFiles {
+		if !strings.HasPrefix(inputFile.Name(), "matrix_") {
+			continue
+		}
+		index := strings.TrimSuffix(strings.TrimPrefix(inputFile.Name(), "matrix_"), filepath.Ext(inputFile.Name()))
+
+		data, err := ReadExpressionMatrix("tests/CollapseProbes/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+			continue
+		}
+		platform, err := ReadPlatformAnnotation("tests/CollapseProbes/input/platform_" + index + ".txt")
+		if err != nil {
+			t.Errorf("%s: ReadPlatformAnnotation failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		want := ReadLinesFromFile("tests/CollapseProbes/output/output_" + index + ".txt")
+		collapsed, statuses, err := CollapseProbes(data, platform, want[0])
+		if err != nil {
+			t.Errorf("%s: CollapseProbes failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		// Round so that principal components compare reliably
+		collapsed.Data.Apply(func(i, j int, v float64) float64 { return roundFloat(v, 6) }, collapsed.Data)
+
+		got := []string{want[0]}
+		got = append(got, FormatRows(collapsed)...)
+		got = append(got, "", strings.Join(collapsed.ProbeIDs, ","), "")
+		for _, status := range statuses {
+			got = append(got, strings.Join([]string{status.ProbeID, status.Symbol, status.EntrezID, status.Status, status.Reason}, "\t"))
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestValidation tests the issues reported while reading expression matrices.
+// Each output line is "line<TAB>kind<TAB>detail"; files without issues have
+// empty outputs and must also pass in strict mode.
+func TestValidation(t *testing.T) {
+	defer func() { diffcoex.StrictValidation, diffcoex.ValidationWarnings = false, nil }()
+
+	inputFiles := ReadDirectory("tests/Validation/input")
+	for _, inputFile := range inputFiles {
+		index := strings.TrimSuffix(strings.TrimPrefix(inputFile.Name(), "input_"), filepath.Ext(inputFile.Name()))
+		inputPath := "tests/Validation/input/" + inputFile.Name()
+		want := ReadLinesFromFile("tests/Validation/output/output_" + index + ".txt")
+
+		// Lenient mode collects the issues as warnings
+		diffcoex.StrictValidation, diffcoex.ValidationWarnings = false, nil
+		if _, err := ReadExpressionMatrix(inputPath); err != nil {
+			t.Errorf("%s: lenient ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+			continue
+		}
+		var got []string
+		for _, issue := range diffcoex.ValidationWarnings {
+			got = append(got, fmt.Sprintf("%d\t%s\t%s", issue.Line, issue.Kind, issue.Detail))
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+
+		// Strict mode fails exactly when there are issues
+		diffcoex.StrictValidation, diffcoex.ValidationWarnings = true, nil
+		_, err := ReadExpressionMatrix(inputPath)
+		if (err != nil) != (len(want) > 0) {
+			t.Errorf("%s: strict ReadExpressionMatrix error = %v, expected %d issues", inputFile.Name(), err, len(want))
+		}
+	}
+}
+
+// TestImputeMissing tests the missing value filter and imputation methods. The
+// first input line holds the method, k and the maximum missing fraction; the
+// first output line holds the summary.
+func TestImputeMissing(t *testing.T) {
+	inputFiles := ReadDirectory("tests/ImputeMissing/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/ImputeMissing/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+		input := ReadLinesFromFile("tests/ImputeMissing/input/" + inputFile.Name())
+		want := ReadLinesFromFile(outputPath)
+
+		var options MissingValueOptions
+		if _, err := fmt.Sscan(input[0], &options.Imputation, &options.K, &options.MaxMissingFraction); err != nil {
+			t.Fatalf("%s: invalid options line: %v", inputFile.Name(), err)
+		}
+		data := ParseMatrixLines(input[1:])
+		rows, _ := data.Dims()
+		geneIDs := make([]string, rows)
+		for i := range geneIDs {
+			geneIDs[i] = fmt.Sprintf("G%d", i+1)
+		}
+
+		result, summary, err := CleanMissingValues(&DataWithGenes{Data: data, GeneIDs: geneIDs}, options)
+		if err != nil {
+			t.Errorf("%s: CleanMissingValues failed: %v", inputFile.Name(), err)
+			continue
+		}
+		if summary.String() != want[0] {
+			t.Errorf("%s: summary = %q, want %q", inputFile.Name(), summary.String(), want[0])
+		}
+		expected := ParseMatrixLines(want[1:])
+		if !MatrixEqualNaN(result.Data, expected, 1e-10) {
+			t.Errorf("%s: got\n%v\nwant\n%v", inputFile.Name(), mat.Formatted(result.Data), mat.Formatted(expected))
+		}
+	}
+
+	data := mat.NewDense(1, 2, []float64{1, math.NaN()})
+	for _, method := range []string{"loess", ImputeKNN} {
+		if _, err := ImputeMissing(data, method, 0); err == nil {
+			t.Errorf("ImputeMissing(%q, k=0) should fail", method)
+		}
+	}
+}
+
+// TestExcludeProbes tests exclusion by probe ID, regex and AFFX patterns. The
+// output lists the kept rows, a blank line and the excluded probes with their
+// reasons, or "error" if the list is invalid or removes every probe.
+func TestExcludeProbes(t *testing.T) {
+	inputFiles := ReadDirectory("tests/ExcludeProbes/input")
+	for _, inputFile := range inputFiles {
+		if !strings.HasPrefix(inputFile.Name(), "matrix_") {
+			continue
+		}
+		index := strings.TrimSuffix(strings.TrimPrefix(inputFile.Name(), "matrix_"), filepath.Ext(inputFile.Name()))
+		want := ReadLinesFromFile("tests/ExcludeProbes/output/output_" + index + ".txt")
+
+		data, err := ReadExpressionMatrix("tests/ExcludeProbes/input/" + inputFile.Name())
+		if err != nil {
+			t.Errorf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+			continue
+		}
+		var got []string
+		list, err := ReadExclusionList("tests/ExcludeProbes/input/exclusions_" + index + ".txt")
+		if err == nil {
+			var kept *DataWithGenes
+			var excluded []Exclusion
+			kept, excluded, err = ExcludeProbes(data, list)
+			if err == nil {
+				got = append(FormatRows(kept), "")
+				for _, exclusion := range excluded {
+					got = append(got, exclusion.ID+"\t"+exclusion.Reason)
+				}
+			}
+		}
+		if err != nil {
+			got = []string{"error"}
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestDefaultExclusionList tests that the rat data excludes exactly the two
+// probes the original analysis removed by position, that it checks their
+// rows, and that only its own unmatched rules are errors
+func TestDefaultExclusionList(t *testing.T) {
+	if list := defaultExclusionList("golub"); !list.Empty() {
+		t.Errorf("golub should have no default exclusions")
+	}
+	list := defaultExclusionList("rat")
+	for _, id := range []string{"1369926_at", "AFFX_Rat_beta-actin_M_at"} {
+		if list.Reason(id) == "" {
+			t.Errorf("%s should be excluded from the rat data", id)
+		}
+	}
+	for _, id := range []string{"1369926_s_at", "1369926_x_at", "13699260_at", "AFFX_Rat_beta-actin_5_at"} {
+		if reason := list.Reason(id); reason != "" {
+			t.Errorf("%s should be kept, got %q", id, reason)
+		}
+	}
+
+	// The excluded probes must be at row 2475 and the last row
+	ids := make([]string, 2480)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%d_at", 1367452+i)
+	}
+	ids[len(ids)-1] = "AFFX_Rat_beta-actin_M_at"
+	if err := checkGDS2901Exclusions(&DataWithGenes{GeneIDs: ids}, list); err != nil {
+		t.Errorf("GDS2901 row order rejected: %v", err)
+	}
+	ids[2474], ids[2475] = ids[2475], ids[2474]
+	if err := checkGDS2901Exclusions(&DataWithGenes{GeneIDs: ids}, list); err == nil {
+		t.Errorf("probe 1369926_at at row 2476 was accepted")
+	}
+	if err := checkGDS2901Exclusions(&DataWithGenes{GeneIDs: ids[:100]}, list); err == nil {
+		t.Errorf("data shorter than GDS2901 was accepted")
+	}
+
+	// A default rule matching no probe fails; a given one only warns
+	data := &DataWithGenes{Data: mat.NewDense(2, 1, []float64{1, 2}), GeneIDs: []string{"1369926_at", "1367452_at"}}
+	options := PipelineOptions{Exclusions: list}
+	if _, err := excludeProbes(data, options, "rat"); err == nil {
+		t.Errorf("an unmatched default exclusion was accepted")
+	}
+	options.Exclusions = NewExclusionList()
+	options.Exclusions.AddID("AFFX_Rat_beta-actin_M_at", "")
+	if kept, err := excludeProbes(data, options, "rat"); err != nil || len(kept.GeneIDs) != 2 {
+		t.Errorf("an unmatched given exclusion failed: %v", err)
+	}
+}
+
+// TestFilterGenes tests the gene filters on two conditions. The first input
+// line holds the number of samples in the first condition followed by the
+// minimum present fraction, minimum mean, drop constant, top N and ranking.
+func TestFilterGenes(t *testing.T) {
+	inputFiles := ReadDirectory("tests/FilterGenes/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/FilterGenes/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+		input := ReadLinesFromFile("tests/FilterGenes/input/" + inputFile.Name())
+		want := ReadLinesFromFile(outputPath)
+
+		var split int
+		var options GeneFilterOptions
+		if _, err := fmt.Sscan(input[0], &split, &options.MinPresentFraction, &options.MinMean,
+			&options.DropConstant, &options.TopN, &options.RankBy); err != nil {
+			t.Fatalf("%s: invalid options line: %v", inputFile.Name(), err)
+		}
+		var geneIDs, rows []string
+		for _, line := range input[1:] {
+			if id, values, ok := strings.Cut(line, " "); ok {
+				geneIDs = append(geneIDs, id)
+				rows = append(rows, values)
+			}
+		}
+		data := &DataWithGenes{Data: ParseMatrixLines(rows), GeneIDs: geneIDs}
+		_, cols := data.Data.Dims()
+		data.SampleIDs = make([]string, cols)
+		groups := splitSamples(data, split, cols-split)
+
+		var got []string
+		result, err := FilterGenes(groups, options)
+		if err != nil {
+			got = []string{"error"}
+		} else {
+			got = append(append(got, result.Kept...), "")
+			for _, id := range geneIDs {
+				if reason, ok := result.Dropped[id]; ok {
+					got = append(got, id+"\t"+reason)
+				}
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestComBat tests that ComBat removes an added batch effect while keeping
+// the protected condition differences, and rejects unusable designs
+func TestComBat(t *testing.T) {
+	batches := []string{"A", "A", "A", "A", "B", "B", "B", "B"}
+	conditions := []string{"x", "y", "x", "y", "x", "y", "x", "y"}
+	genes, samples := 20, len(batches)
+
+	// Genes with noise, a condition effect on even genes and a batch effect
+	// shifting and scaling batch B
+	data := mat.NewDense(genes, samples, nil)
+	for i := 0; i < genes; i++ {
+		for j := 0; j < samples; j++ {
+			v := 5 + float64(i) + 0.5*math.Sin(float64(i*7+j*j*5))
+			if conditions[j] == "y" && i%2 == 0 {
+				v += 2
+			}
+			if batches[j] == "B" {
+				v = 1.5*v + 3
+			}
+			data.Set(i, j, v)
+		}
+	}
+
+	for _, protect := range []bool{false, true} {
+		var conditionArg []string
+		if protect {
+			conditionArg = conditions
+		}
+		corrected, unadjusted, err := ComBat(data, batches, conditionArg)
+		if err != nil {
+			t.Fatalf("protect=%v: ComBat failed: %v", protect, err)
+		}
+		if unadjusted != 0 {
+			t.Errorf("protect=%v: %d genes left unadjusted, want 0", protect, unadjusted)
+		}
+		before := SummarizeBatches("before", data, batches)
+		after := SummarizeBatches("after", corrected, batches)
+		for b := range before {
+			if after[b].CentroidDistance > 0.2*before[b].CentroidDistance {
+				t.Errorf("protect=%v: batch %s centroid distance %.3f -> %.3f, expected a large reduction",
+					protect, before[b].Batch, before[b].CentroidDistance, after[b].CentroidDistance)
+			}
+		}
+		if !protect {
+			continue
+		}
+		for i := 0; i < genes; i++ {
+			difference := 0.0
+			for j := 0; j < samples; j++ {
+				if conditions[j] == "y" {
+					difference += corrected.At(i, j) / 4
+				} else {
+					difference -= corrected.At(i, j) / 4
+				}
+			}
+			if (i%2 == 0) != (math.Abs(difference) > 1.5) {
+				t.Errorf("gene %d: condition difference %.3f after correction", i, difference)
+			}
+		}
+	}
+
+	// Confounded conditions, single sample batches and missing values fail
+	confounded := []string{"x", "x", "x", "x", "y", "y", "y", "y"}
+	if _, _, err := ComBat(data, batches, confounded); err == nil {
+		t.Errorf("ComBat with a condition confounded with the batches should fail")
+	}
+	if _, _, err := ComBat(data, []string{"A", "A", "A", "A", "B", "B", "B", "C"}, nil); err == nil {
+		t.Errorf("ComBat with a single sample batch should fail")
+	}
+	missing := mat.DenseCopyOf(data)
+	missing.Set(0, 0, math.NaN())
+	if _, _, err := ComBat(missing, batches, nil); err == nil {
+		t.Errorf("ComBat with missing values should fail")
+	}
+}
+
+// TestSampleQualityControl tests the sample QC table with an outlier
+// threshold of 1.5, which a sample can exceed among few samples
+func TestSampleQualityControl(t *testing.T) {
+	inputFiles := ReadDirectory("tests/SampleQC/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/SampleQC/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+		data, err := ReadExpressionMatrix("tests/SampleQC/input/" + inputFile.Name())
+		if err != nil {
+			t.Fatalf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+		}
+		qc, err := SampleQualityControl(data, 1.5)
+		if err != nil {
+			t.Errorf("%s: SampleQualityControl failed: %v", inputFile.Name(), err)
+			continue
+		}
+
+		tablePath := filepath.Join(t.TempDir(), "qc.tsv")
+		if err := writeSampleQC(qc, tablePath); err != nil {
+			t.Fatalf("%s: writeSampleQC failed: %v", inputFile.Name(), err)
+		}
+		got := ReadLinesFromFile(tablePath)
+		want := ReadLinesFromFile(outputPath)
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestRegressCovariates tests covariate regression jointly and within
+// conditions. The first output line holds the mode and the covariates.
+func TestRegressCovariates(t *testing.T) {
+	inputFiles := ReadDirectory("tests/RegressCovariates/input")
+	for _, inputFile := range inputFiles {
+		if !strings.HasPrefix(inputFile.Name(), "matrix_") {
+			continue
+		}
+		index := strings.TrimSuffix(strings.TrimPrefix(inputFile.Name(), "matrix_"), filepath.Ext(inputFile.Name()))
+		want := ReadLinesFromFile("tests/RegressCovariates/output/output_" + index + ".txt")
+		mode, names, _ := strings.Cut(want[0], " ")
+
+		data, err := ReadExpressionMatrix("tests/RegressCovariates/input/" + inputFile.Name())
+		if err != nil {
+			t.Fatalf("%s: ReadExpressionMatrix failed: %v", inputFile.Name(), err)
+		}
+		options := defaultPipelineOptions("matrix")
+		options.SampleSheet = "tests/RegressCovariates/input/samples_" + index + ".txt"
+		options.Covariates = CovariateOptions{Names: splitList(names), Mode: mode}
+
+		var result *DataWithGenes
+		if mode == RegressJoint {
+			result, err = regressCovariatesJoint(data, options, inputFile.Name())
+		} else {
+			sheet, sheetErr := ReadSampleSheet(options.SampleSheet)
+			if sheetErr != nil {
+				t.Fatalf("%s: ReadSampleSheet failed: %v", inputFile.Name(), sheetErr)
+			}
+			names, groups, splitErr := SplitByCondition(data, sheet, nil)
+			if splitErr != nil {
+				t.Fatalf("%s: SplitByCondition failed: %v", inputFile.Name(), splitErr)
+			}
+			if err = regressCovariatesWithin(groups, names, options); err == nil {
+				result, err = combineSamples(groups...)
+			}
+		}
+
+		if want[1] == "error" {
+			if err == nil {
+				t.Errorf("%s: expected an error", inputFile.Name())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: covariate regression failed: %v", inputFile.Name(), err)
+			continue
+		}
+		expected := ParseMatrixLines(want[1:])
+		if !MatrixEqualNaN(result.Data, expected, 1e-9) {
+			t.Errorf("%s: got\n%v\nwant\n%v", inputFile.Name(), mat.Formatted(result.Data), mat.Formatted(expected))
+		}
+	}
+}
+
+// TestParseProfiles tests building the profiles written for the rat data from
+// -profile (first input line) and -profiles (second input line)
+func TestParseProfiles(t *testing.T) {
+	inputFiles := ReadDirectory("tests/ParseProfiles/input")
+	for _, inputFile := range inputFiles {
+		outputPath := "tests/ParseProfiles/output/" + strings.Replace(inputFile.Name(), "input_", "output_", 1)
+		input := ReadLinesFromFile("tests/ParseProfiles/input/" + inputFile.Name())
+		want := ReadLinesFromFile(outputPath)
+
+		var got []string
+		custom, err := ParseProfiles(input[0])
+		if err == nil {
+			profiles := mergeProfiles(defaultProfiles("rat"), custom)
+			if names := splitList(input[1]); len(names) > 0 {
+				profiles, err = selectProfiles(profiles, names)
+			}
+			for _, profile := range profiles {
+				got = append(got, profile.Name+"\t"+profile.String())
+			}
+		}
+		if err != nil {
+			got = []string{"error"}
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", inputFile.Name(), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// TestExportFormats tests the GCT, TSV and CLS exports of two conditions
+func TestExportFormats(t *testing.T) {
+	dir := t.TempDir()
+	conditionA := &DataWithGenes{
+		Data:      mat.NewDense(2, 2, []float64{1, 2.5, math.NaN(), 4}),
+		GeneIDs:   []string{"g1", "g2"},
+		SampleIDs: []string{"a1", "a2"},
+		ProbeIDs:  []string{"p1;p2", "p3"},
+	}
+	conditionB := &DataWithGenes{
+		Data:      mat.NewDense(2, 1, []float64{5, 6}),
+		GeneIDs:   []string{"g1", "g2"},
+		SampleIDs: []string{"b1"},
+		ProbeIDs:  []string{"p1;p2", "p3"},
+	}
+
+	tests := []struct {
+		name  string
+		write func(string) error
+		want  string
+	}{
+		{"a.gct", func(path string) error { return saveToGCT(conditionA, path) },
+			"#1.2\n2\t2\nName\tDescription\ta1\ta2\ng1\tp1;p2\t1\t2.5\ng2\tp3\t\t4\n"},
+		{"a.tsv", func(path string) error { return saveToTSV(conditionA, path) },
+			"Gene\ta1\ta2\ng1\t1\t2.5\ng2\tNA\t4\n"},
+		{"all.gct", func(path string) error {
+			combined, _, err := combineConditions([]string{"A", "B"}, []*DataWithGenes{conditionA, conditionB})
+			if err != nil {
+				return err
+			}
+			return saveToGCT(combined, path)
+		}, "#1.2\n2\t3\nName\tDescription\ta1\ta2\tb1\ng1\tp1;p2\t1\t2.5\t5\ng2\tp3\t\t4\t6\n"},
+		{"all.cls", func(path string) error {
+			_, labels, err := combineConditions([]string{"wild type", "B"}, []*DataWithGenes{conditionA, conditionB})
+			if err != nil {
+				return err
+			}
+			return saveToCLS(labels, path)
+		}, "3 2 1\n# wild_type B\nwild_type wild_type B\n"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := test.write(path); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", test.name, got, test.want)
+		}
+	}
+
+	conditionB.GeneIDs = []string{"g2", "g1"}
+	if _, _, err := combineConditions([]string{"A", "B"}, []*DataWithGenes{conditionA, conditionB}); err == nil {
+		t.Errorf("conditions with different genes were combined")
+	}
+	if _, err := ParseExportFormats("gct,xls"); err == nil {
+		t.Errorf("unknown export format was accepted")
+	}
+}
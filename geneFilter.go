@@ -0,0 +1,186 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	Gene filters decide on all conditions together, so every condition file
+	keeps the same genes. The filters run in this order: minimum non-missing
+	fraction, minimum mean expression, constant in a condition, and finally
+	the top N genes by variance or MAD over all samples.
+*/
+
+// Statistics used to rank genes for the top N filter
+const (
+	RankByVariance = "variance"
+	RankByMAD      = "mad"
+)
+
+// GeneFilterOptions selects the gene filters to apply; the zero value of each
+// field (and -Inf for MinMean) disables that filter
+type GeneFilterOptions struct {
+	MinPresentFraction float64 // minimum fraction of non-missing values
+	MinMean            float64 // minimum mean over all samples
+	DropConstant       bool    // drop genes constant in any condition
+	TopN               int     // keep only the N most variable genes
+	RankBy             string  // variance or mad
+}
+
+// Enabled reports whether any filter is selected
+func (options GeneFilterOptions) Enabled() bool {
+	return options.MinPresentFraction > 0 || !math.IsInf(options.MinMean, -1) || options.DropConstant || options.TopN > 0
+}
+
+// GeneFilterResult lists the genes kept by FilterGenes and why the others
+// were dropped
+type GeneFilterResult struct {
+	Kept    []string
+	Dropped map[string]string // gene ID to reason
+}
+
+// Summary counts the dropped genes by reason
+func (result GeneFilterResult) Summary() string {
+	counts := make(map[string]int)
+	for _, reason := range result.Dropped {
+		counts[reason]++
+	}
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", counts[reason], reason)
+	}
+	if len(parts) == 0 {
+		return "none dropped"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FilterGenes applies the gene filters to condition groups with the same genes
+func FilterGenes(groups []*DataWithGenes, options GeneFilterOptions) (GeneFilterResult, error) {
+	result := GeneFilterResult{Dropped: make(map[string]string)}
+	if len(groups) == 0 {
+		return result, nil
+	}
+	if options.TopN > 0 && options.RankBy != RankByVariance && options.RankBy != RankByMAD {
+		return result, fmt.Errorf("unknown gene ranking %q (use variance or mad)", options.RankBy)
+	}
+	geneIDs := groups[0].GeneIDs
+	for _, group := range groups[1:] {
+		if strings.Join(group.GeneIDs, "\n") != strings.Join(geneIDs, "\n") {
+			return result, fmt.Errorf("condition groups do not have the same genes")
+		}
+	}
+
+	type candidate struct {
+		id    string
+		score float64
+	}
+	var candidates []candidate
+	for i, id := range geneIDs {
+		// Values of the gene in every sample, and per condition
+		var all []float64
+		constant := false
+		for _, group := range groups {
+			row := mat.Row(nil, i, group.Data)
+			all = append(all, row...)
+			if _, sd := nanMeanSD(row); options.DropConstant && !(sd > 0) {
+				constant = true
+			}
+		}
+
+		present := 0
+		for _, v := range all {
+			if !isMissing(v) {
+				present++
+			}
+		}
+		mean, sd := nanMeanSD(all)
+
+		switch {
+		case float64(present) < options.MinPresentFraction*float64(len(all)):
+			result.Dropped[id] = "too many missing values"
+		case !(mean >= options.MinMean):
+			result.Dropped[id] = "low mean expression"
+		case constant:
+			result.Dropped[id] = "constant in a condition"
+		default:
+			score := sd * sd
+			if options.RankBy == RankByMAD {
+				score = medianAbsoluteDeviation(all)
+			}
+			candidates = append(candidates, candidate{id: id, score: score})
+		}
+	}
+
+	// Keep the top N, in their original order
+	if options.TopN > 0 && len(candidates) > options.TopN {
+		ranked := append([]candidate{}, candidates...)
+		sort.SliceStable(ranked, func(a, b int) bool { return ranked[a].score > ranked[b].score })
+		top := make(map[string]bool, options.TopN)
+		for _, c := range ranked[:options.TopN] {
+			top[c.id] = true
+		}
+		var kept []candidate
+		for _, c := range candidates {
+			if top[c.id] {
+				kept = append(kept, c)
+			} else {
+				result.Dropped[c.id] = "not in the top " + fmt.Sprint(options.TopN) + " by " + options.RankBy
+			}
+		}
+		candidates = kept
+	}
+
+	for _, c := range candidates {
+		result.Kept = append(result.Kept, c.id)
+	}
+	if len(result.Kept) == 0 {
+		return result, fmt.Errorf("the gene filters remove all %d genes", len(geneIDs))
+	}
+	return result, nil
+}
+
+// medianAbsoluteDeviation returns the median absolute deviation of the
+// non-missing values from their median
+func medianAbsoluteDeviation(values []float64) float64 {
+	median := nanMedian(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	return nanMedian(deviations)
+}
+
+// selectGenes returns a copy of d with only the given genes, in that order
+func selectGenes(d *DataWithGenes, geneIDs []string) *DataWithGenes {
+	index := make(map[string]int, len(d.GeneIDs))
+	for i, id := range d.GeneIDs {
+		index[id] = i
+	}
+	rows := make([]int, 0, len(geneIDs))
+	for _, id := range geneIDs {
+		if i, ok := index[id]; ok {
+			rows = append(rows, i)
+		}
+	}
+	return selectRows(d, rows)
+}
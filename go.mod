@@ -2,4 +2,9 @@ module FinalProject
 
 go 1.22.4
 
-require gonum.org/v1/gonum v0.15.1 // indirect
+require (
+	diffcoex v0.0.0
+	gonum.org/v1/gonum v0.15.1
+)
+
+replace diffcoex => ./diffcoex
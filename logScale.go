@@ -0,0 +1,175 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// NonPositivePolicy says what a log transform does with values that are zero
+// or negative after the pseudocount is added
+type NonPositivePolicy string
+
+const (
+	NonPositiveNaN    NonPositivePolicy = "nan"    // leave them missing, as GEO2R does
+	NonPositiveFloor  NonPositivePolicy = "floor"  // raise them to the smallest positive value
+	NonPositiveOffset NonPositivePolicy = "offset" // shift every value so the minimum becomes 1
+)
+
+func (p NonPositivePolicy) valid() bool {
+	return p == NonPositiveNaN || p == NonPositiveFloor || p == NonPositiveOffset
+}
+
+// LogTransform computes log_base(v + pseudocount)
+type LogTransform struct {
+	Base        float64
+	Pseudocount float64
+	NonPositive NonPositivePolicy
+}
+
+// AutoLogTransform applies its log transform only when the values do not
+// already look log-scaled
+type AutoLogTransform struct {
+	LogTransform
+}
+
+func (l LogTransform) Name() string {
+	name := fmt.Sprintf("log(base=%s,pseudocount=%s", formatParam(l.Base), formatParam(l.Pseudocount))
+	if l.NonPositive != "" && l.NonPositive != NonPositiveNaN {
+		name += ",nonpositive=" + string(l.NonPositive)
+	}
+	return name + ")"
+}
+
+func (l LogTransform) Normalize(data *mat.Dense) *mat.Dense {
+	result, _ := l.NormalizeWithReport(data)
+	return result
+}
+
+// NormalizeWithReport log-transforms every value and reports how many
+// non-positive values were handled by the policy
+func (l LogTransform) NormalizeWithReport(data *mat.Dense) (*mat.Dense, string) {
+	rows, cols := data.Dims()
+	result := mat.NewDense(rows, cols, nil)
+
+	// Smallest shifted value, and smallest positive one, for the policies
+	minShifted := math.Inf(1)
+	minPositive := math.Inf(1)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			x := data.At(i, j) + l.Pseudocount
+			if math.IsNaN(x) {
+				continue
+			}
+			minShifted = math.Min(minShifted, x)
+			if x > 0 {
+				minPositive = math.Min(minPositive, x)
+			}
+		}
+	}
+	offset := 0.0
+	if l.NonPositive == NonPositiveOffset && minShifted <= 0 {
+		offset = 1 - minShifted
+	}
+
+	transformed, nonPositive := 0, 0
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			x := data.At(i, j) + l.Pseudocount + offset
+			if math.IsNaN(x) {
+				result.Set(i, j, x)
+				continue
+			}
+			if x <= 0 {
+				nonPositive++
+				if l.NonPositive == NonPositiveFloor && !math.IsInf(minPositive, 1) {
+					x = minPositive
+				} else {
+					result.Set(i, j, math.NaN())
+					continue
+				}
+			}
+			result.Set(i, j, l.log(x))
+			transformed++
+		}
+	}
+
+	report := fmt.Sprintf("log-transformed %d values", transformed)
+	switch {
+	case offset != 0:
+		report += fmt.Sprintf(", shifted all values by %s", formatParam(offset))
+	case nonPositive > 0 && l.NonPositive == NonPositiveFloor:
+		report += fmt.Sprintf(", raised %d non-positive values to %s", nonPositive, formatParam(minPositive))
+	case nonPositive > 0:
+		report += fmt.Sprintf(", set %d non-positive values to NaN", nonPositive)
+	}
+	return result, report
+}
+
+// log computes the logarithm of a positive value in the transform's base
+func (l LogTransform) log(x float64) float64 {
+	// Use the exact functions for the common bases
+	switch l.Base {
+	case 2:
+		return math.Log2(x)
+	case 10:
+		return math.Log10(x)
+	}
+	return math.Log(x) / math.Log(l.Base)
+}
+
+func (a AutoLogTransform) Name() string {
+	return "auto-" + a.LogTransform.Name()
+}
+
+func (a AutoLogTransform) Normalize(data *mat.Dense) *mat.Dense {
+	result, _ := a.NormalizeWithReport(data)
+	return result
+}
+
+// NormalizeWithReport log-transforms the data only if DetectLogScale says it
+// is not log-scaled yet
+func (a AutoLogTransform) NormalizeWithReport(data *mat.Dense) (*mat.Dense, string) {
+	needsLog, detail := DetectLogScale(data)
+	if !needsLog {
+		return mat.DenseCopyOf(data), "values look log-scaled (" + detail + "), no transform applied, 0 values changed"
+	}
+	result, report := a.LogTransform.NormalizeWithReport(data)
+	return result, "values look linear (" + detail + "), " + report
+}
+
+// DetectLogScale applies the GEO2R rule to decide whether data still needs a
+// log transform: it does if the 99th percentile is above 100, or if the range
+// is above 50 and the lower quartile is positive. The detail lists the
+// quantiles used.
+func DetectLogScale(data *mat.Dense) (bool, string) {
+	values := data.RawMatrix().Data
+	if rows, cols := data.Dims(); len(values) != rows*cols {
+		values = mat.DenseCopyOf(data).RawMatrix().Data
+	}
+
+	minimum := nanQuantile(values, 0)
+	lower := nanQuantile(values, 0.25)
+	upper := nanQuantile(values, 0.99)
+	maximum := nanQuantile(values, 1)
+
+	needsLog := upper > 100 || (maximum-minimum > 50 && lower > 0)
+	detail := fmt.Sprintf("min=%s q25=%s q99=%s max=%s",
+		formatQuantile(minimum), formatQuantile(lower), formatQuantile(upper), formatQuantile(maximum))
+	return needsLog, detail
+}
+
+// formatQuantile formats a quantile for reports
+func formatQuantile(v float64) string {
+	return formatParam(math.Round(v*1000) / 1000)
+}
@@ -0,0 +1,281 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Imputation methods for missing values
+const (
+	ImputeNone   = "none"   // keep missing values as NaN (written as NA)
+	ImputeMean   = "mean"   // replace with the gene's mean
+	ImputeMedian = "median" // replace with the gene's median
+	ImputeKNN    = "knn"    // average of the k nearest genes, like impute.knn
+)
+
+// defaultKNNNeighbours is the k used by impute.knn
+const defaultKNNNeighbours = 10
+
+// MissingValueOptions controls how missing values are filtered and imputed
+type MissingValueOptions struct {
+	// MaxMissingFraction drops genes with a larger fraction of missing values
+	MaxMissingFraction float64
+	Imputation         string
+	K                  int // neighbours for knn imputation
+}
+
+// MissingValueSummary describes what CleanMissingValues did
+type MissingValueSummary struct {
+	Cells        int      // cells in the input matrix
+	Missing      int      // missing cells in the input matrix
+	DroppedGenes []string // genes above the maximum missing fraction
+	Imputed      int      // missing cells replaced by imputation
+}
+
+// String formats the summary for the run log
+func (s MissingValueSummary) String() string {
+	percent := 0.0
+	if s.Cells > 0 {
+		percent = 100 * float64(s.Missing) / float64(s.Cells)
+	}
+	return fmt.Sprintf("%d of %d values missing (%.2f%%), %d genes dropped, %d values imputed",
+		s.Missing, s.Cells, percent, len(s.DroppedGenes), s.Imputed)
+}
+
+// missingRow returns a row of n missing values, so that cells absent from a
+// short input row stay missing
+func missingRow(n int) []float64 {
+	row := make([]float64, n)
+	for j := range row {
+		row[j] = math.NaN()
+	}
+	return row
+}
+
+// isMissing reports whether a value is missing or unusable
+func isMissing(v float64) bool {
+	return math.IsNaN(v) || math.IsInf(v, 0)
+}
+
+// CleanMissingValues drops genes with too many missing values and imputes the
+// remaining ones
+func CleanMissingValues(d *DataWithGenes, options MissingValueOptions) (*DataWithGenes, MissingValueSummary, error) {
+	rows, cols := d.Data.Dims()
+	summary := MissingValueSummary{Cells: rows * cols}
+
+	// Keep the genes at or below the maximum missing fraction
+	var keep []int
+	for i := 0; i < rows; i++ {
+		missing := 0
+		for j := 0; j < cols; j++ {
+			if isMissing(d.Data.At(i, j)) {
+				missing++
+			}
+		}
+		summary.Missing += missing
+		if cols > 0 && float64(missing)/float64(cols) > options.MaxMissingFraction {
+			summary.DroppedGenes = append(summary.DroppedGenes, d.GeneIDs[i])
+			continue
+		}
+		keep = append(keep, i)
+	}
+	if len(keep) == 0 {
+		return nil, summary, fmt.Errorf("every gene has more than %.2f missing values", options.MaxMissingFraction)
+	}
+
+	result := selectRows(d, keep)
+	remaining := 0
+	result.Data.Apply(func(i, j int, v float64) float64 {
+		if isMissing(v) {
+			remaining++
+		}
+		return v
+	}, result.Data)
+
+	var err error
+	result.Data, err = ImputeMissing(result.Data, options.Imputation, options.K)
+	if err != nil {
+		return nil, summary, err
+	}
+	if options.Imputation != ImputeNone {
+		summary.Imputed = remaining
+	}
+	return result, summary, nil
+}
+
+// selectRows returns a copy of d with only the given rows, in order
+func selectRows(d *DataWithGenes, rows []int) *DataWithGenes {
+	_, cols := d.Data.Dims()
+	result := &DataWithGenes{
+		Data:      mat.NewDense(len(rows), cols, nil),
+		GeneIDs:   make([]string, len(rows)),
+		SampleIDs: copyStrings(d.SampleIDs),
+		Metadata:  copyMetadata(d.Metadata),
+	}
+	if d.ProbeIDs != nil {
+		result.ProbeIDs = make([]string, len(rows))
+	}
+	if d.GeneSymbols != nil {
+		result.GeneSymbols = make([]string, len(rows))
+	}
+	for k, i := range rows {
+		result.Data.SetRow(k, mat.Row(nil, i, d.Data))
+		result.GeneIDs[k] = d.GeneIDs[i]
+		if d.ProbeIDs != nil {
+			result.ProbeIDs[k] = d.ProbeIDs[i]
+		}
+		if d.GeneSymbols != nil {
+			result.GeneSymbols[k] = d.GeneSymbols[i]
+		}
+	}
+	return result
+}
+
+// ImputeMissing replaces missing values with the given method
+func ImputeMissing(data *mat.Dense, method string, k int) (*mat.Dense, error) {
+	switch method {
+	case ImputeNone:
+		return mat.DenseCopyOf(data), nil
+	case ImputeMean:
+		return imputeRowMean(data), nil
+	case ImputeMedian:
+		return imputeRowMedian(data), nil
+	case ImputeKNN:
+		if k < 1 {
+			return nil, fmt.Errorf("knn imputation needs at least 1 neighbour, got %d", k)
+		}
+		return imputeKNN(data, k), nil
+	}
+	return nil, fmt.Errorf("unknown imputation method %q (use none, mean, median or knn)", method)
+}
+
+// imputeRowMean replaces missing values with the mean of the gene's observed
+// values (0 if none were observed)
+func imputeRowMean(data *mat.Dense) *mat.Dense {
+	rows, cols := data.Dims()
+	result := mat.NewDense(rows, cols, nil)
+	for i := 0; i < rows; i++ {
+		row := mat.Row(nil, i, data)
+		sum, observed := 0.0, 0
+		for _, v := range row {
+			if !isMissing(v) {
+				sum += v
+				observed++
+			}
+		}
+		mean := 0.0
+		if observed > 0 {
+			mean = sum / float64(observed)
+		}
+		for j, v := range row {
+			if isMissing(v) {
+				v = mean
+			}
+			result.Set(i, j, v)
+		}
+	}
+	return result
+}
+
+// imputeRowMedian replaces missing values with the median of the gene's
+// observed values (0 if none were observed, like imputeRowMean)
+func imputeRowMedian(data *mat.Dense) *mat.Dense {
+	rows, cols := data.Dims()
+	result := mat.NewDense(rows, cols, nil)
+	for i := 0; i < rows; i++ {
+		row := mat.Row(nil, i, data)
+		var observed []float64
+		for _, v := range row {
+			if !isMissing(v) {
+				observed = append(observed, v)
+			}
+		}
+		median := 0.0
+		if len(observed) > 0 {
+			median = nanMedian(observed)
+		}
+		for j, v := range row {
+			if isMissing(v) {
+				v = median
+			}
+			result.Set(i, j, v)
+		}
+	}
+	return result
+}
+
+// imputeKNN replaces each missing value with the average of the k genes
+// closest to the gene that have the sample observed. Distances are the mean
+// squared difference over the samples both genes have, as in impute.knn.
+// Values without any usable neighbour fall back to the gene's mean.
+func imputeKNN(data *mat.Dense, k int) *mat.Dense {
+	rows, cols := data.Dims()
+	result := imputeRowMean(data)
+
+	for i := 0; i < rows; i++ {
+		row := mat.Row(nil, i, data)
+		var missingCols []int
+		for j, v := range row {
+			if isMissing(v) {
+				missingCols = append(missingCols, j)
+			}
+		}
+		if len(missingCols) == 0 {
+			continue
+		}
+
+		// Distances to every other gene sharing at least one observed sample
+		type neighbour struct {
+			row      int
+			distance float64
+		}
+		var neighbours []neighbour
+		for other := 0; other < rows; other++ {
+			if other == i {
+				continue
+			}
+			sum, shared := 0.0, 0
+			for j := 0; j < cols; j++ {
+				a, b := row[j], data.At(other, j)
+				if isMissing(a) || isMissing(b) {
+					continue
+				}
+				sum += (a - b) * (a - b)
+				shared++
+			}
+			if shared > 0 {
+				neighbours = append(neighbours, neighbour{row: other, distance: sum / float64(shared)})
+			}
+		}
+		sort.SliceStable(neighbours, func(a, b int) bool { return neighbours[a].distance < neighbours[b].distance })
+
+		for _, j := range missingCols {
+			sum, used := 0.0, 0
+			for _, n := range neighbours {
+				if used == k {
+					break
+				}
+				if v := data.At(n.row, j); !isMissing(v) {
+					sum += v
+					used++
+				}
+			}
+			if used > 0 {
+				result.Set(i, j, sum/float64(used))
+			}
+		}
+	}
+	return result
+}
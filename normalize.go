@@ -0,0 +1,349 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	Normalization is a chain of steps applied in order to the full expression
+	matrix (genes x samples) before it is split into conditions. Chains are
+	written as comma-separated steps with optional ":key=value" parameters:
+
+		log:base=2:pseudocount=1,quantile
+		auto-log:nonpositive=floor,quantile
+		arcsinh:cofactor=5,zscore
+*/
+
+// Normalizer is one step of a normalization chain
+type Normalizer interface {
+	// Name describes the step and its parameters for the output metadata
+	Name() string
+	Normalize(data *mat.Dense) *mat.Dense
+}
+
+// reportingNormalizer is implemented by steps that describe what they changed,
+// e.g. whether a log transform was needed
+type reportingNormalizer interface {
+	NormalizeWithReport(data *mat.Dense) (*mat.Dense, string)
+}
+
+// NormalizerChain applies its steps in order
+type NormalizerChain []Normalizer
+
+// QuantileNormalizer performs cross-sample quantile normalization
+type QuantileNormalizer struct{}
+
+// MedianCenter subtracts each gene's median
+type MedianCenter struct{}
+
+// ZScore scales each gene to mean 0 and standard deviation 1
+type ZScore struct{}
+
+// UpperQuartileScale scales each sample so that its upper quartile equals the
+// mean upper quartile across samples
+type UpperQuartileScale struct{}
+
+// ArcsinhTransform computes asinh(v / cofactor), a variance-stabilizing transform
+type ArcsinhTransform struct {
+	Cofactor float64
+}
+
+func (QuantileNormalizer) Name() string { return "quantile" }
+
+func (QuantileNormalizer) Normalize(data *mat.Dense) *mat.Dense {
+	return NormalizeQuantiles(data)
+}
+
+func (MedianCenter) Name() string { return "median-center" }
+
+func (MedianCenter) Normalize(data *mat.Dense) *mat.Dense {
+	rows, cols := data.Dims()
+	result := mat.NewDense(rows, cols, nil)
+	for i := 0; i < rows; i++ {
+		row := mat.Row(nil, i, data)
+		median := nanMedian(row)
+		for j, v := range row {
+			result.Set(i, j, v-median)
+		}
+	}
+	return result
+}
+
+func (ZScore) Name() string { return "zscore" }
+
+func (ZScore) Normalize(data *mat.Dense) *mat.Dense {
+	rows, cols := data.Dims()
+	result := mat.NewDense(rows, cols, nil)
+	for i := 0; i < rows; i++ {
+		row := mat.Row(nil, i, data)
+		mean, sd := nanMeanSD(row)
+		for j, v := range row {
+			// Constant genes are only centered
+			if sd == 0 || math.IsNaN(sd) {
+				result.Set(i, j, v-mean)
+			} else {
+				result.Set(i, j, (v-mean)/sd)
+			}
+		}
+	}
+	return result
+}
+
+func (UpperQuartileScale) Name() string { return "upper-quartile" }
+
+func (UpperQuartileScale) Normalize(data *mat.Dense) *mat.Dense {
+	rows, cols := data.Dims()
+	result := mat.NewDense(rows, cols, nil)
+
+	// Upper quartile of each sample
+	quartiles := make([]float64, cols)
+	sum := 0.0
+	n := 0
+	for j := 0; j < cols; j++ {
+		quartiles[j] = nanQuantile(mat.Col(nil, j, data), 0.75)
+		if quartiles[j] != 0 && !math.IsNaN(quartiles[j]) {
+			sum += quartiles[j]
+			n++
+		}
+	}
+	target := 1.0
+	if n > 0 {
+		target = sum / float64(n)
+	}
+
+	for j := 0; j < cols; j++ {
+		scale := 1.0
+		if quartiles[j] != 0 && !math.IsNaN(quartiles[j]) {
+			scale = target / quartiles[j]
+		}
+		for i := 0; i < rows; i++ {
+			result.Set(i, j, data.At(i, j)*scale)
+		}
+	}
+	return result
+}
+
+func (a ArcsinhTransform) Name() string {
+	return fmt.Sprintf("arcsinh(cofactor=%s)", formatParam(a.Cofactor))
+}
+
+func (a ArcsinhTransform) Normalize(data *mat.Dense) *mat.Dense {
+	rows, cols := data.Dims()
+	result := mat.NewDense(rows, cols, nil)
+	result.Apply(func(i, j int, v float64) float64 {
+		return math.Asinh(v / a.Cofactor)
+	}, data)
+	return result
+}
+
+// Apply runs every step on a copy of d and records the chain, and the report of
+// every reporting step, in its metadata
+func (c NormalizerChain) Apply(d *DataWithGenes) *DataWithGenes {
+	result := copyDataWithGenes(d)
+	var reports []string
+	for _, step := range c {
+		reporter, ok := step.(reportingNormalizer)
+		if !ok {
+			result.Data = step.Normalize(result.Data)
+			continue
+		}
+		var report string
+		result.Data, report = reporter.NormalizeWithReport(result.Data)
+		fmt.Printf("Normalization %s: %s\n", step.Name(), report)
+		reports = append(reports, step.Name()+": "+report)
+	}
+	if result.Metadata == nil {
+		result.Metadata = make(map[string]string)
+	}
+	result.Metadata["normalization"] = c.String()
+	if len(reports) > 0 {
+		result.Metadata["normalization_report"] = strings.Join(reports, "; ")
+	}
+	return result
+}
+
+// String lists the step names separated by ";", or "none" for an empty chain
+func (c NormalizerChain) String() string {
+	if len(c) == 0 {
+		return "none"
+	}
+	names := make([]string, len(c))
+	for i, step := range c {
+		names[i] = step.Name()
+	}
+	return strings.Join(names, ";")
+}
+
+// ParseNormalizerChain builds a chain from a comma-separated list of steps
+func ParseNormalizerChain(spec string) (NormalizerChain, error) {
+	var chain NormalizerChain
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "none" {
+		return chain, nil
+	}
+
+	for _, stepSpec := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(stepSpec), ":")
+		name := strings.ToLower(parts[0])
+		params := make(map[string]string)
+		for _, param := range parts[1:] {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok {
+				return nil, fmt.Errorf("step %s: parameter %q is not key=value", name, param)
+			}
+			params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+
+		step, err := newNormalizer(name, params)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, step)
+	}
+	return chain, nil
+}
+
+// newNormalizer creates a single step from its name and parameters
+func newNormalizer(name string, params map[string]string) (Normalizer, error) {
+	var paramErr error
+	param := func(key string, defaultValue float64) float64 {
+		value, ok := params[key]
+		if !ok {
+			return defaultValue
+		}
+		delete(params, key)
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil && paramErr == nil {
+			paramErr = fmt.Errorf("step %s: invalid value for %s: %v", name, key, err)
+		}
+		return f
+	}
+	policy := func() NonPositivePolicy {
+		value, ok := params["nonpositive"]
+		if !ok {
+			return NonPositiveNaN
+		}
+		delete(params, "nonpositive")
+		return NonPositivePolicy(strings.ToLower(value))
+	}
+
+	var step Normalizer
+	switch name {
+	case "log":
+		step = LogTransform{Base: param("base", 2), Pseudocount: param("pseudocount", 1), NonPositive: policy()}
+	case "log2":
+		step = LogTransform{Base: 2, Pseudocount: param("pseudocount", 1), NonPositive: policy()}
+	case "auto-log":
+		step = AutoLogTransform{LogTransform{Base: param("base", 2), Pseudocount: param("pseudocount", 1),
+			NonPositive: policy()}}
+	case "quantile":
+		step = QuantileNormalizer{}
+	case "median-center":
+		step = MedianCenter{}
+	case "zscore":
+		step = ZScore{}
+	case "upper-quartile":
+		step = UpperQuartileScale{}
+	case "arcsinh":
+		step = ArcsinhTransform{Cofactor: param("cofactor", 1)}
+	default:
+		return nil, fmt.Errorf("unknown normalization step %q", name)
+	}
+	if paramErr != nil {
+		return nil, paramErr
+	}
+
+	if len(params) > 0 {
+		var unknown []string
+		for key := range params {
+			unknown = append(unknown, key)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("step %s: unknown parameters %s", name, strings.Join(unknown, ", "))
+	}
+
+	logStep, isLog := step.(LogTransform)
+	if auto, ok := step.(AutoLogTransform); ok {
+		logStep, isLog = auto.LogTransform, true
+	}
+	if isLog {
+		if logStep.Base <= 0 || logStep.Base == 1 {
+			return nil, fmt.Errorf("step %s: invalid base %v", name, logStep.Base)
+		}
+		if !logStep.NonPositive.valid() {
+			return nil, fmt.Errorf("step %s: unknown nonpositive policy %q (use nan, floor or offset)",
+				name, logStep.NonPositive)
+		}
+	}
+	if arcsinh, ok := step.(ArcsinhTransform); ok && arcsinh.Cofactor <= 0 {
+		return nil, fmt.Errorf("step %s: cofactor must be positive", name)
+	}
+	return step, nil
+}
+
+// formatParam formats a step parameter without trailing zeros
+func formatParam(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// nanMeanSD returns the mean and sample standard deviation of the non-NaN values
+func nanMeanSD(values []float64) (float64, float64) {
+	sum := 0.0
+	n := 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN(), math.NaN()
+	}
+	mean := sum / float64(n)
+	if n < 2 {
+		return mean, 0
+	}
+	ss := 0.0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			ss += (v - mean) * (v - mean)
+		}
+	}
+	return mean, math.Sqrt(ss / float64(n-1))
+}
+
+// nanMedian returns the median of the non-NaN values
+func nanMedian(values []float64) float64 {
+	return nanQuantile(values, 0.5)
+}
+
+// nanQuantile returns the p-th quantile of the non-NaN values, interpolating
+// between order statistics like R's default quantile type
+func nanQuantile(values []float64, p float64) float64 {
+	sorted := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sorted = append(sorted, v)
+		}
+	}
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(sorted)
+	return interpolateSorted(sorted, p*float64(len(sorted)-1))
+}
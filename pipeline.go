@@ -0,0 +1,598 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+)
+
+// PipelineOptions holds the settings shared by every dataset type
+type PipelineOptions struct {
+	SubsetType     string   // GDS subset type used to split SOFT files
+	GDS2901Layout  bool     // split rat data by the GDS2901 columns instead of subsets
+	Characteristic string   // sample characteristic used to split series matrices
+	SampleSheet    string   // sample sheet used to split generic matrices
+	Conditions     []string // conditions to write for generic matrices (all if empty)
+
+	// Profiles are the output sets written, each with its own transforms; the
+	// first one drives sample QC and the gene filters
+	Profiles []Profile
+
+	// Exclusions lists the probes removed before anything else is done
+	Exclusions *ExclusionList
+
+	// Platform, if set, collapses probes to genes with CollapseMethod before
+	// normalization
+	Platform       *PlatformAnnotation
+	CollapseMethod string
+
+	// MissingValues filters and imputes missing values after collapsing
+	MissingValues MissingValueOptions
+
+	// BatchCorrection runs ComBat on the normalized data of the profiles
+	// asking for it, using the batches of the sample sheet
+	BatchCorrection BatchCorrectionOptions
+
+	// Covariates are regressed out of the normalized data of the profiles
+	// asking for it, jointly or within each condition, using the covariates
+	// of the sample sheet
+	Covariates CovariateOptions
+
+	// SampleQC checks the samples of each condition of the first profile for
+	// outliers
+	SampleQC SampleQCOptions
+
+	// GeneFilter selects the genes written for every condition
+	GeneFilter GeneFilterOptions
+
+	// OutputDir holds the diffcoex and coxpress directories and the reports
+	OutputDir string
+
+	// Exports lists the formats every condition file is also written in
+	Exports []string
+
+	// Cache is the precision of the binary cache written next to every
+	// condition file, or CacheNone
+	Cache string
+
+	// Config, if set, is the JSON config of the run, embedded in every output
+	Config string
+}
+
+// ConditionOutput records the files written for one condition
+type ConditionOutput struct {
+	Name    string
+	Files   []string // one file per profile, in the order of the profiles
+	Genes   int
+	Samples int
+
+	// Data holds the condition data of every profile, kept only for the CLS
+	// export
+	Data []*DataWithGenes
+}
+
+// writtenConditions lists the conditions written so far, in order
+var writtenConditions []ConditionOutput
+
+// defaultNormalizations are the normalization chains used when -normalize is
+// not given. The rat data keeps the original log2(v+1) and quantile steps, but
+// skips the log if the input is already log-scaled.
+var defaultNormalizations = map[string]string{
+	"rat": "auto-log:base=2:pseudocount=1,quantile",
+}
+
+// defaultProfiles returns the built-in profiles of a dataset type: diffcoex
+// with the default normalization and covariate regression, and coxpress with
+// no transforms
+func defaultProfiles(datasetType string) []Profile {
+	normalization, err := ParseNormalizerChain(defaultNormalizations[datasetType])
+	if err != nil {
+		panic(fmt.Sprintf("invalid default normalization for %s: %v", datasetType, err))
+	}
+	return []Profile{
+		{Name: ProfileDiffCoEx, Normalization: normalization, Covariates: true},
+		{Name: ProfileCoXpress},
+	}
+}
+
+// defaultPipelineOptions returns the options used for a dataset type when no
+// flags are given
+func defaultPipelineOptions(datasetType string) PipelineOptions {
+	return PipelineOptions{
+		SubsetType:     defaultRatSubsetType,
+		Profiles:       defaultProfiles(datasetType),
+		Exclusions:     defaultExclusionList(datasetType),
+		CollapseMethod: defaultCollapse,
+		MissingValues: MissingValueOptions{
+			MaxMissingFraction: 1,
+			Imputation:         ImputeNone,
+			K:                  defaultKNNNeighbours,
+		},
+		Covariates: CovariateOptions{Mode: RegressJoint},
+		SampleQC:   SampleQCOptions{Mode: SampleQCNone, ZThreshold: defaultOutlierZ},
+		GeneFilter: GeneFilterOptions{MinMean: math.Inf(-1), RankBy: RankByVariance},
+		OutputDir:  "output",
+		Cache:      diffcoex.CacheFloat64,
+	}
+}
+
+// combineSamples joins matrices with the same genes side by side so that they
+// can be normalized together
+func combineSamples(parts ...*DataWithGenes) (*DataWithGenes, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no matrices to combine")
+	}
+	rows, _ := parts[0].Data.Dims()
+	cols := 0
+	for _, part := range parts {
+		partRows, partCols := part.Data.Dims()
+		if partRows != rows {
+			return nil, fmt.Errorf("cannot combine matrices with %d and %d genes", rows, partRows)
+		}
+		cols += partCols
+	}
+
+	combined := &DataWithGenes{
+		Data:        mat.NewDense(rows, cols, nil),
+		GeneIDs:     append([]string{}, parts[0].GeneIDs...),
+		Metadata:    copyMetadata(parts[0].Metadata),
+		ProbeIDs:    copyStrings(parts[0].ProbeIDs),
+		GeneSymbols: copyStrings(parts[0].GeneSymbols),
+	}
+	offset := 0
+	for _, part := range parts {
+		_, partCols := part.Data.Dims()
+		combined.Data.Slice(0, rows, offset, offset+partCols).(*mat.Dense).Copy(part.Data)
+		combined.SampleIDs = append(combined.SampleIDs, part.SampleIDs...)
+		offset += partCols
+	}
+	return combined, nil
+}
+
+// splitSamples cuts a combined matrix back into parts with the given column counts
+func splitSamples(d *DataWithGenes, counts ...int) []*DataWithGenes {
+	rows, _ := d.Data.Dims()
+	parts := make([]*DataWithGenes, len(counts))
+	offset := 0
+	for i, count := range counts {
+		parts[i] = &DataWithGenes{
+			Data:        mat.DenseCopyOf(d.Data.Slice(0, rows, offset, offset+count)),
+			GeneIDs:     append([]string{}, d.GeneIDs...),
+			SampleIDs:   append([]string{}, d.SampleIDs[offset:offset+count]...),
+			Metadata:    copyMetadata(d.Metadata),
+			ProbeIDs:    copyStrings(d.ProbeIDs),
+			GeneSymbols: copyStrings(d.GeneSymbols),
+		}
+		offset += count
+	}
+	return parts
+}
+
+// excludeProbes removes the probes on the exclusion list. Unless prefix is
+// empty, every removed probe is logged with its reason.
+func excludeProbes(d *DataWithGenes, options PipelineOptions, prefix string) (*DataWithGenes, error) {
+	kept, excluded, err := ExcludeProbes(d, options.Exclusions)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" || options.Exclusions.Empty() {
+		return kept, nil
+	}
+	for _, rule := range options.Exclusions.Unmatched(d.GeneIDs) {
+		if options.Exclusions.Builtin(rule) {
+			return nil, fmt.Errorf("default exclusion %s matches no probe of %s; "+
+				"pass -exclude with a list for this data or -exclude none", rule, prefix)
+		}
+		fmt.Printf("Warning: exclusion %s matches no probe of %s\n", rule, prefix)
+	}
+	for _, exclusion := range excluded {
+		fmt.Printf("Excluded probe %s from %s: %s\n", exclusion.ID, prefix, exclusion.Reason)
+	}
+	fmt.Printf("Excluded %d of %d probes from %s\n", len(excluded), len(d.GeneIDs), prefix)
+	return kept, nil
+}
+
+// collapseProbes collapses the probes of d to genes if a platform annotation
+// was given. Unless prefix is empty, the status of every probe is written to
+// output/<prefix>_probes.tsv.
+func collapseProbes(d *DataWithGenes, options PipelineOptions, prefix string) (*DataWithGenes, error) {
+	if options.Platform == nil {
+		return d, nil
+	}
+	collapsed, statuses, err := CollapseProbes(d, options.Platform, options.CollapseMethod)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		return collapsed, nil
+	}
+
+	reportPath := filepath.Join(options.OutputDir, prefix+"_probes.tsv")
+	if err := writeProbeReport(statuses, reportPath); err != nil {
+		return nil, err
+	}
+	diffcoex.RecordOutput(reportPath)
+	fmt.Printf("Collapsed %d probes into %d genes by %s: %s (see %s)\n", len(d.GeneIDs), len(collapsed.GeneIDs),
+		options.CollapseMethod, summarizeProbeStatuses(statuses), reportPath)
+	return collapsed, nil
+}
+
+// cleanMissingValues filters and imputes the missing values of d. Unless
+// prefix is empty, a summary is printed to the run log.
+func cleanMissingValues(d *DataWithGenes, options PipelineOptions, prefix string) (*DataWithGenes, error) {
+	cleaned, summary, err := CleanMissingValues(d, options.MissingValues)
+	if err != nil {
+		return nil, fmt.Errorf("error handling missing values: %v", err)
+	}
+	if prefix != "" {
+		fmt.Printf("Missing values in %s (imputation %s): %s\n", prefix, options.MissingValues.Imputation, summary)
+	}
+	return cleaned, nil
+}
+
+// filterGenes applies the gene filters to the condition groups of a profile,
+// replacing them with the filtered groups, and returns the kept genes (nil if
+// no filter is selected). Unless prefix is empty, a summary is printed.
+func filterGenes(groups []*DataWithGenes, options PipelineOptions, prefix string) ([]string, error) {
+	if !options.GeneFilter.Enabled() {
+		return nil, nil
+	}
+	result, err := FilterGenes(groups, options.GeneFilter)
+	if err != nil {
+		return nil, fmt.Errorf("error filtering genes: %v", err)
+	}
+	keepGenes(groups, result.Kept)
+	if prefix != "" {
+		fmt.Printf("Gene filters kept %d of %d genes in %s (%s)\n", len(result.Kept),
+			len(result.Kept)+len(result.Dropped), prefix, result.Summary())
+	}
+	return result.Kept, nil
+}
+
+// keepGenes replaces each group with a copy holding only the given genes, so
+// that every profile keeps the same genes. A nil list keeps all.
+func keepGenes(groups []*DataWithGenes, geneIDs []string) {
+	if geneIDs == nil {
+		return
+	}
+	for i, group := range groups {
+		groups[i] = selectGenes(group, geneIDs)
+	}
+}
+
+// correctBatches runs ComBat on the normalized data if batch correction is
+// enabled, and writes the per-batch summaries before and after correction to
+// output/<prefix>_batches.tsv
+func correctBatches(d *DataWithGenes, options PipelineOptions, prefix string) (*DataWithGenes, error) {
+	if !options.BatchCorrection.Enabled {
+		return d, nil
+	}
+	if options.SampleSheet == "" {
+		return nil, fmt.Errorf("batch correction needs a sample sheet with a batch column (-samples)")
+	}
+	sheet, err := ReadSampleSheet(options.SampleSheet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up the batch and condition of every sample
+	samples, err := sheetSamples(sheet, d.SampleIDs)
+	if err != nil {
+		return nil, err
+	}
+	batches := make([]string, len(samples))
+	var conditions []string
+	if options.BatchCorrection.ProtectCondition {
+		conditions = make([]string, len(samples))
+	}
+	for j, sample := range samples {
+		if sample.Batch == "" {
+			return nil, fmt.Errorf("sample %s has no batch in the sample sheet", sample.SampleID)
+		}
+		batches[j] = sample.Batch
+		if conditions != nil {
+			conditions[j] = sample.Condition
+		}
+	}
+
+	corrected, unadjusted, err := ComBat(d.Data, batches, conditions)
+	if err != nil {
+		return nil, fmt.Errorf("error correcting batches: %v", err)
+	}
+
+	summaries := append(SummarizeBatches("before", d.Data, batches), SummarizeBatches("after", corrected, batches)...)
+	summaryPath := filepath.Join(options.OutputDir, prefix+"_batches.tsv")
+	if err := writeBatchSummary(summaries, summaryPath); err != nil {
+		return nil, err
+	}
+	diffcoex.RecordOutput(summaryPath)
+	method := "combat"
+	if options.BatchCorrection.ProtectCondition {
+		method = "combat(protect=condition)"
+	}
+	fmt.Printf("Batch correction %s: %d batches, %d genes constant within a batch left unadjusted (see %s)\n",
+		method, len(summaries)/2, unadjusted, summaryPath)
+
+	result := copyDataWithGenes(d)
+	result.Data = corrected
+	if result.Metadata == nil {
+		result.Metadata = make(map[string]string)
+	}
+	result.Metadata["batch_correction"] = method
+	return result, nil
+}
+
+// checkSamples runs sample QC on each condition group of a profile and writes
+// its table to output/<prefix>_<name>_qc.tsv. In remove mode the outliers are
+// dropped from the groups, and their IDs are returned so that the other
+// profiles can drop them too.
+func checkSamples(groups []*DataWithGenes, names []string, options PipelineOptions, prefix string) ([]string, error) {
+	if options.SampleQC.Mode == SampleQCNone {
+		return nil, nil
+	}
+	var removed []string
+	for i, group := range groups {
+		qc, err := SampleQualityControl(group, options.SampleQC.ZThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("error checking samples of %s: %v", names[i], err)
+		}
+		tablePath := filepath.Join(options.OutputDir, strings.TrimSuffix(outputFileName(prefix, names[i]), ".csv")+"_qc.tsv")
+		if err := writeSampleQC(qc, tablePath); err != nil {
+			return nil, err
+		}
+		diffcoex.RecordOutput(tablePath)
+
+		var outliers []string
+		for _, sample := range qc {
+			if sample.Outlier {
+				outliers = append(outliers, sample.SampleID)
+			}
+		}
+		fmt.Printf("Sample QC of %s: %d of %d samples are outliers (Z.K < -%s) %s (see %s)\n", names[i],
+			len(outliers), len(qc), formatParam(options.SampleQC.ZThreshold), strings.Join(outliers, ", "), tablePath)
+		if options.SampleQC.Mode == SampleQCRemove && len(outliers) > 0 {
+			removed = append(removed, outliers...)
+		}
+	}
+	if err := dropSamples(groups, removed); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// dropSamples replaces each group with a copy without the given samples
+func dropSamples(groups []*DataWithGenes, sampleIDs []string) error {
+	if len(sampleIDs) == 0 {
+		return nil
+	}
+	drop := make(map[string]bool, len(sampleIDs))
+	for _, id := range sampleIDs {
+		drop[id] = true
+	}
+	for i, group := range groups {
+		var keep []string
+		for _, id := range group.SampleIDs {
+			if !drop[id] {
+				keep = append(keep, id)
+			}
+		}
+		if len(keep) == len(group.SampleIDs) {
+			continue
+		}
+		if len(keep) < minimumQCSamples {
+			return fmt.Errorf("removing outliers leaves %d samples in a condition", len(keep))
+		}
+		kept, err := ExtractSamples(group, keep)
+		if err != nil {
+			return err
+		}
+		groups[i] = kept
+	}
+	return nil
+}
+
+// regressCovariates removes the covariate effects from d, keeping the
+// condition effects if keepConditions is set
+func regressCovariates(d *DataWithGenes, options PipelineOptions, keepConditions bool, label string) (*DataWithGenes, error) {
+	if options.SampleSheet == "" {
+		return nil, fmt.Errorf("covariate regression needs a sample sheet (-samples)")
+	}
+	sheet, err := ReadSampleSheet(options.SampleSheet)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := sheetSamples(sheet, d.SampleIDs)
+	if err != nil {
+		return nil, err
+	}
+	covariates, columnNames, err := covariateDesign(samples, options.Covariates.Names)
+	if err != nil {
+		return nil, err
+	}
+	var protected *mat.Dense
+	if keepConditions {
+		protected = conditionDesign(samples)
+	}
+
+	residuals, err := RegressCovariates(d.Data, protected, covariates)
+	if err != nil {
+		return nil, fmt.Errorf("error regressing covariates from %s: %v", label, err)
+	}
+	fmt.Printf("Regressed %s out of %s (%s)\n", strings.Join(columnNames, ", "), label, options.Covariates.Mode)
+
+	result := copyDataWithGenes(d)
+	result.Data = residuals
+	if result.Metadata == nil {
+		result.Metadata = make(map[string]string)
+	}
+	result.Metadata["covariate_regression"] = options.Covariates.Mode + ":" + strings.Join(options.Covariates.Names, ",")
+	return result, nil
+}
+
+// regressCovariatesJoint regresses the covariates out of the normalized data
+// of all conditions together, if covariates are selected in joint mode
+func regressCovariatesJoint(d *DataWithGenes, options PipelineOptions, prefix string) (*DataWithGenes, error) {
+	if len(options.Covariates.Names) == 0 || options.Covariates.Mode != RegressJoint {
+		return d, nil
+	}
+	return regressCovariates(d, options, true, prefix)
+}
+
+// regressCovariatesWithin regresses the covariates out of each normalized
+// condition group separately, if covariates are selected in within mode
+func regressCovariatesWithin(groups []*DataWithGenes, names []string, options PipelineOptions) error {
+	if len(options.Covariates.Names) == 0 || options.Covariates.Mode != RegressWithin {
+		return nil
+	}
+	for i, group := range groups {
+		residuals, err := regressCovariates(group, options, false, names[i])
+		if err != nil {
+			return err
+		}
+		groups[i] = residuals
+	}
+	return nil
+}
+
+// saveOutput saves a condition file with the config of the run in its
+// metadata, its exports and its binary cache
+func saveOutput(d *DataWithGenes, options PipelineOptions, filename string) error {
+	withConfig := *d
+	if options.Config != "" {
+		withConfig.Metadata = copyMetadata(d.Metadata)
+		if withConfig.Metadata == nil {
+			withConfig.Metadata = make(map[string]string)
+		}
+		withConfig.Metadata["config"] = options.Config
+	}
+	if err := saveToCSV(&withConfig, filename); err != nil {
+		return err
+	}
+	diffcoex.RecordOutput(filename)
+	if err := exportCondition(&withConfig, options, filename); err != nil {
+		return err
+	}
+	if options.Cache == diffcoex.CacheNone {
+		return nil
+	}
+	if err := saveMatrixCache(&withConfig, filename, options.Cache); err != nil {
+		return err
+	}
+	diffcoex.RecordOutput(diffcoex.MatrixCachePath(filename))
+	return nil
+}
+
+// writeConditionManifest writes the conditions written so far, with their
+// file in every profile, as a tab-separated file, so that the other tools can
+// find them by name
+func writeConditionManifest(options PipelineOptions) error {
+	header := []string{"condition"}
+	for _, profile := range options.Profiles {
+		header = append(header, profile.Name)
+	}
+	lines := []string{strings.Join(header, "\t")}
+	for _, output := range writtenConditions {
+		lines = append(lines, strings.Join(append([]string{output.Name}, output.Files...), "\t"))
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	path := filepath.Join(options.OutputDir, diffcoex.ConditionManifestName)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing condition manifest: %v", err)
+	}
+	diffcoex.RecordOutput(path)
+	return nil
+}
+
+// conditionWritten reports whether a condition has been written
+func conditionWritten(name string) bool {
+	for _, output := range writtenConditions {
+		if output.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runProfiles runs the steps shared by every profile on d, then the
+// transforms of each profile, splits the results into conditions and writes
+// one file per condition and profile, named by fileName. Sample QC and the
+// gene filters run on the first profile and are applied to the others. It
+// returns the file names.
+func runProfiles(d *DataWithGenes, prefix string, split func(*DataWithGenes) ([]string, []*DataWithGenes, error),
+	fileName func(string) string, options PipelineOptions) ([]string, error) {
+	if len(options.Profiles) == 0 {
+		return nil, fmt.Errorf("no profiles to write")
+	}
+	d, err := excludeProbes(d, options, prefix)
+	if err != nil {
+		return nil, err
+	}
+	d, err = collapseProbes(d, options, prefix)
+	if err != nil {
+		return nil, err
+	}
+	d, err = cleanMissingValues(d, options, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Condition groups of every profile
+	var names []string
+	groups := make([][]*DataWithGenes, len(options.Profiles))
+	for p, profile := range options.Profiles {
+		transformed, err := applyProfile(d, profile, options, prefix)
+		if err != nil {
+			return nil, err
+		}
+		names, groups[p], err = split(transformed)
+		if err != nil {
+			return nil, err
+		}
+		if err := regressCovariatesWithin(groups[p], names, profileOptions(options, profile)); err != nil {
+			return nil, err
+		}
+	}
+
+	removed, err := checkSamples(groups[0], names, options, prefix)
+	if err != nil {
+		return nil, err
+	}
+	kept, err := filterGenes(groups[0], options, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range groups[1:] {
+		if err := dropSamples(other, removed); err != nil {
+			return nil, err
+		}
+		keepGenes(other, kept)
+	}
+
+	var files []string
+	for i, name := range names {
+		conditionGroups := make([]*DataWithGenes, len(groups))
+		for p := range groups {
+			conditionGroups[p] = groups[p][i]
+		}
+		filename := fileName(name)
+		if err := writeOutput(options, name, conditionGroups, filename); err != nil {
+			return nil, fmt.Errorf("error saving group %s: %v", name, err)
+		}
+		files = append(files, filename)
+	}
+	return files, nil
+}
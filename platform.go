@@ -0,0 +1,370 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	A GPL platform annotation maps probe IDs to genes. It is read either from
+	a GEO platform SOFT file (the table between !platform_table_begin and
+	!platform_table_end) or from a plain tab-separated table with a header,
+	such as the "Full table" download of a GPL record.
+*/
+
+// PlatformAnnotation maps probe IDs to gene symbols and Entrez IDs
+type PlatformAnnotation struct {
+	Symbols   map[string]string
+	EntrezIDs map[string]string
+}
+
+// Accepted header names for the platform table columns
+var (
+	probeColumnNames  = []string{"ID", "ID_REF", "probe", "probe_id", "probeset_id"}
+	symbolColumnNames = []string{"Gene Symbol", "GENE_SYMBOL", "Symbol"}
+	entrezColumnNames = []string{"ENTREZ_GENE_ID", "Entrez Gene", "Entrez", "GENE_ID", "GENE"}
+)
+
+// multipleGeneSeparator separates the genes of probes that map to several genes
+const multipleGeneSeparator = "///"
+
+// ReadPlatformAnnotation reads a GPL annotation table
+func ReadPlatformAnnotation(filePath string) (*PlatformAnnotation, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening platform file: %v", err)
+	}
+	defer file.Close()
+
+	annotation := &PlatformAnnotation{
+		Symbols:   make(map[string]string),
+		EntrezIDs: make(map[string]string),
+	}
+
+	var header []string
+	probeCol, symbolCol, entrezCol := -1, -1, -1
+	isSoft := false
+	inTable := false
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// SOFT files only have a table between the markers
+		switch {
+		case strings.HasPrefix(line, "!platform_table_begin"):
+			isSoft, inTable = true, true
+			continue
+		case strings.HasPrefix(line, "!platform_table_end"):
+			inTable = false
+			continue
+		case strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "^"):
+			continue
+		}
+		if isSoft && !inTable {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if header == nil {
+			header = fields
+			probeCol = findColumn(header, probeColumnNames)
+			symbolCol = findColumn(header, symbolColumnNames)
+			entrezCol = findColumn(header, entrezColumnNames)
+			if probeCol == -1 || symbolCol == -1 {
+				return nil, fmt.Errorf("platform table needs a probe ID column and a gene symbol column")
+			}
+			continue
+		}
+
+		probe := fieldAt(fields, probeCol)
+		if probe == "" {
+			continue
+		}
+		annotation.Symbols[probe] = fieldAt(fields, symbolCol)
+		if entrezCol != -1 {
+			annotation.EntrezIDs[probe] = fieldAt(fields, entrezCol)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading platform file: %v", err)
+	}
+	if len(annotation.Symbols) == 0 {
+		return nil, fmt.Errorf("no probes found in platform file")
+	}
+
+	return annotation, nil
+}
+
+// fieldAt returns the trimmed field at index i, or "" if the row is too short
+func fieldAt(fields []string, i int) string {
+	if i < 0 || i >= len(fields) {
+		return ""
+	}
+	return strings.TrimSpace(fields[i])
+}
+
+// Probe collapsing methods
+const (
+	CollapseMaxMean     = "maxmean" // keep the probe with the highest mean
+	CollapseMaxVariance = "maxvar"  // keep the probe with the highest variance
+	CollapseMedian      = "median"  // per-sample median of the probes
+	CollapsePC1         = "pc1"     // first principal component of the probes
+	defaultCollapse     = CollapseMaxMean
+	probeIDSeparator    = ";"
+)
+
+// Probe statuses and drop reasons reported by CollapseProbes
+const (
+	probeKept            = "kept"
+	probeCombined        = "combined"
+	probeDropped         = "dropped"
+	reasonNoSymbol       = "no gene symbol"
+	reasonMultipleGenes  = "maps to multiple genes"
+	reasonNotRepresented = "not the representative probe"
+)
+
+// ProbeStatus records what happened to one probe during collapsing
+type ProbeStatus struct {
+	ProbeID  string
+	Symbol   string
+	EntrezID string
+	Status   string // kept, combined or dropped
+	Reason   string // why a probe was dropped
+}
+
+// CollapseProbes annotates the probes of d and collapses them into one row per
+// gene symbol using the given method. Probes without a symbol or mapping to
+// several genes are dropped. It returns the collapsed data and the status of
+// every probe in input order.
+func CollapseProbes(d *DataWithGenes, annotation *PlatformAnnotation, method string) (*DataWithGenes, []ProbeStatus, error) {
+	switch method {
+	case CollapseMaxMean, CollapseMaxVariance, CollapseMedian, CollapsePC1:
+	default:
+		return nil, nil, fmt.Errorf("unknown collapse method %q (use maxmean, maxvar, median or pc1)", method)
+	}
+
+	// Group the probe rows by gene symbol, in order of first appearance
+	statuses := make([]ProbeStatus, len(d.GeneIDs))
+	var symbols []string
+	rowsBySymbol := make(map[string][]int)
+	for i, probe := range d.GeneIDs {
+		symbol := annotation.Symbols[probe]
+		statuses[i] = ProbeStatus{ProbeID: probe, Symbol: symbol, EntrezID: annotation.EntrezIDs[probe]}
+		switch {
+		case symbol == "" || symbol == "---":
+			statuses[i].Status, statuses[i].Reason = probeDropped, reasonNoSymbol
+			continue
+		case strings.Contains(symbol, multipleGeneSeparator):
+			statuses[i].Status, statuses[i].Reason = probeDropped, reasonMultipleGenes
+			continue
+		}
+		if _, seen := rowsBySymbol[symbol]; !seen {
+			symbols = append(symbols, symbol)
+		}
+		rowsBySymbol[symbol] = append(rowsBySymbol[symbol], i)
+	}
+	if len(symbols) == 0 {
+		return nil, statuses, fmt.Errorf("none of the %d probes has a gene symbol in the platform table", len(d.GeneIDs))
+	}
+
+	_, cols := d.Data.Dims()
+	result := &DataWithGenes{
+		Data:        mat.NewDense(len(symbols), cols, nil),
+		GeneIDs:     symbols,
+		SampleIDs:   copyStrings(d.SampleIDs),
+		Metadata:    copyMetadata(d.Metadata),
+		ProbeIDs:    make([]string, len(symbols)),
+		GeneSymbols: copyStrings(symbols),
+	}
+	if result.Metadata == nil {
+		result.Metadata = make(map[string]string)
+	}
+	result.Metadata["probe_collapse"] = method
+
+	for g, symbol := range symbols {
+		rows := rowsBySymbol[symbol]
+		probes := make([]string, len(rows))
+		profiles := make([][]float64, len(rows))
+		for k, row := range rows {
+			probes[k] = d.GeneIDs[row]
+			profiles[k] = mat.Row(nil, row, d.Data)
+		}
+
+		// Genes with a single probe are kept as is
+		if len(rows) == 1 {
+			result.Data.SetRow(g, profiles[0])
+			result.ProbeIDs[g] = probes[0]
+			statuses[rows[0]].Status = probeKept
+			continue
+		}
+
+		switch method {
+		case CollapseMaxMean, CollapseMaxVariance:
+			best := selectProbe(profiles, method)
+			result.Data.SetRow(g, profiles[best])
+			result.ProbeIDs[g] = probes[best]
+			for k, row := range rows {
+				if k == best {
+					statuses[row].Status = probeKept
+				} else {
+					statuses[row].Status, statuses[row].Reason = probeDropped, reasonNotRepresented
+				}
+			}
+		case CollapseMedian, CollapsePC1:
+			if method == CollapseMedian {
+				result.Data.SetRow(g, medianProfile(profiles))
+			} else {
+				result.Data.SetRow(g, firstPrincipalComponent(profiles))
+			}
+			result.ProbeIDs[g] = strings.Join(probes, probeIDSeparator)
+			for _, row := range rows {
+				statuses[row].Status = probeCombined
+			}
+		}
+	}
+
+	return result, statuses, nil
+}
+
+// selectProbe returns the index of the probe with the highest mean or variance
+func selectProbe(profiles [][]float64, method string) int {
+	best := 0
+	bestScore := math.Inf(-1)
+	for k, profile := range profiles {
+		mean, sd := nanMeanSD(profile)
+		score := mean
+		if method == CollapseMaxVariance {
+			score = sd * sd
+		}
+		if score > bestScore {
+			best, bestScore = k, score
+		}
+	}
+	return best
+}
+
+// medianProfile returns the per-sample median across probes
+func medianProfile(profiles [][]float64) []float64 {
+	result := make([]float64, len(profiles[0]))
+	values := make([]float64, len(profiles))
+	for j := range result {
+		for k, profile := range profiles {
+			values[k] = profile[j]
+		}
+		result[j] = nanMedian(values)
+	}
+	return result
+}
+
+// firstPrincipalComponent summarizes probes by the first principal component
+// of their standardized profiles, like WGCNA's module eigengene. The sign is
+// chosen to agree with the average probe, and the scores are rescaled to the
+// mean and standard deviation of the average probe so that they stay on the
+// expression scale.
+func firstPrincipalComponent(profiles [][]float64) []float64 {
+	n := len(profiles[0])
+	average := make([]float64, n)
+	standardized := mat.NewDense(len(profiles), n, nil)
+	for k, profile := range profiles {
+		mean, sd := nanMeanSD(profile)
+		for j, v := range profile {
+			average[j] += v / float64(len(profiles))
+			z := 0.0
+			if sd > 0 && !math.IsNaN(v) {
+				z = (v - mean) / sd
+			}
+			standardized.Set(k, j, z)
+		}
+	}
+
+	var svd mat.SVD
+	if !svd.Factorize(standardized, mat.SVDThin) {
+		return average
+	}
+	var v mat.Dense
+	svd.VTo(&v)
+	scores := mat.Col(nil, 0, &v)
+
+	// Align the component with the average probe and rescale it
+	avgMean, avgSD := nanMeanSD(average)
+	scoreMean, scoreSD := nanMeanSD(scores)
+	dot := 0.0
+	for j := range scores {
+		if !math.IsNaN(average[j]) {
+			dot += (scores[j] - scoreMean) * (average[j] - avgMean)
+		}
+	}
+	sign := 1.0
+	if dot < 0 {
+		sign = -1
+	}
+	result := make([]float64, n)
+	for j, score := range scores {
+		z := 0.0
+		if scoreSD > 0 {
+			z = sign * (score - scoreMean) / scoreSD
+		}
+		result[j] = avgMean + z*avgSD
+	}
+	return result
+}
+
+// writeProbeReport writes the status of every probe as a tab-separated file
+func writeProbeReport(statuses []ProbeStatus, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating probe report: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, "probe\tsymbol\tentrez\tstatus\treason")
+	for _, status := range statuses {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+			status.ProbeID, status.Symbol, status.EntrezID, status.Status, status.Reason)
+	}
+	return writer.Flush()
+}
+
+// summarizeProbeStatuses counts the probes per status and drop reason, e.g.
+// "8 kept, 2 combined, 3 dropped (1 no gene symbol, 2 not the representative probe)"
+func summarizeProbeStatuses(statuses []ProbeStatus) string {
+	counts := make(map[string]int)
+	for _, status := range statuses {
+		counts[status.Status]++
+		if status.Reason != "" {
+			counts[status.Reason]++
+		}
+	}
+
+	summary := fmt.Sprintf("%d kept, %d combined, %d dropped", counts[probeKept], counts[probeCombined], counts[probeDropped])
+	var reasons []string
+	for _, reason := range []string{reasonNoSymbol, reasonMultipleGenes, reasonNotRepresented} {
+		if counts[reason] > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d %s", counts[reason], reason))
+		}
+	}
+	if len(reasons) > 0 {
+		summary += " (" + strings.Join(reasons, ", ") + ")"
+	}
+	return summary
+}
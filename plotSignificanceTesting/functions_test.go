@@ -18,6 +18,8 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+
+	"diffcoex"
 )
 
 type NormalCDFTest struct {
@@ -38,12 +40,6 @@ type ModuleCorrelationTest struct {
 	expected       []float64
 }
 
-type GeneIndicesTest struct {
-	idx       int
-	expectedI int
-	expectedJ int
-}
-
 // TestNormalCDF tests the normalCDF function
 func TestNormalCDF(t *testing.T) {
 	tests := ReadNormalCDFTests("Tests/NormalCDF")
@@ -69,12 +65,13 @@ func TestCalculateTStatistic(t *testing.T) {
 	}
 }
 
-// TestGetModuleCorrelations tests the getModuleCorrelations function
-func TestGetModuleCorrelations(t *testing.T) {
+// TestModuleCorrelations tests the module correlations of the correlation
+// engine
+func TestModuleCorrelations(t *testing.T) {
 	tests := ReadModuleCorrelationTests("Tests/ModuleCorrelation")
 
 	for i, test := range tests {
-		result := getModuleCorrelations(test.genes, test.expressionData)
+		result, _ := diffcoex.NewCorrelationEngine(test.expressionData, diffcoex.CorrelationMethod{Name: diffcoex.CorrelationPearson, MaxPOutliers: 1}).ModuleCorrelations(test.genes)
 
 		// Sort both slices to ensure consistent comparison
 		sort.Float64s(result)
@@ -93,19 +90,6 @@ func TestGetModuleCorrelations(t *testing.T) {
 	}
 }
 
-// TestGetGeneIndices tests the getGeneIndices function
-func TestGetGeneIndices(t *testing.T) {
-	tests := ReadGeneIndicesTests("Tests/GeneIndices")
-
-	for i, test := range tests {
-		resultI, resultJ := getGeneIndices(test.idx)
-		if resultI != test.expectedI || resultJ != test.expectedJ {
-			t.Errorf("Test %d: getGeneIndices(%v) = (%v, %v), want (%v, %v)",
-				i, test.idx, resultI, resultJ, test.expectedI, test.expectedJ)
-		}
-	}
-}
-
 // ReadNormalCDFTests takes in an input directory and returns a slice
 // of NormalCDFTest objects
 func ReadNormalCDFTests(directory string) []NormalCDFTest {
@@ -174,28 +158,6 @@ func ReadModuleCorrelationTests(directory string) []ModuleCorrelationTest {
 	return tests
 }
 
-// ReadGeneIndicesTests reads test cases from files
-func ReadGeneIndicesTests(directory string) []GeneIndicesTest {
-	inputFiles := ReadDirectory(directory + "/input")
-	numFiles := len(inputFiles)
-
-	tests := make([]GeneIndicesTest, numFiles)
-	for i, inputFile := range inputFiles {
-		tests[i] = ReadGeneIndicesTest(directory + "/input/" + inputFile.Name())
-	}
-
-	outputFiles := ReadDirectory(directory + "/output")
-	if len(outputFiles) != numFiles {
-		panic("Error: number of input and output files do not match!")
-	}
-
-	for i, outputFile := range outputFiles {
-		tests[i].expectedI, tests[i].expectedJ = ReadTwoIntsFromFile(directory + "/output/" + outputFile.Name())
-	}
-
-	return tests
-}
-
 // ReadNormalCDFTest reads a single NormalCDFTest from a file
 func ReadNormalCDFTest(file string) NormalCDFTest {
 	f, err := os.Open(file)
@@ -285,23 +247,6 @@ func ReadModuleCorrelationTest(file string) ModuleCorrelationTest {
 	return test
 }
 
-// ReadGeneIndicesTest reads a single test case from a file
-func ReadGeneIndicesTest(file string) GeneIndicesTest {
-	f, err := os.Open(file)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	var test GeneIndicesTest
-
-	scanner.Scan()
-	test.idx, _ = strconv.Atoi(scanner.Text())
-
-	return test
-}
-
 // ReadDirectory reads in a directory and returns a slice of fs.DirEntry objects containing file info for the directory
 func ReadDirectory(dir string) []fs.DirEntry {
 	//read in all files in the given directory
@@ -376,22 +321,82 @@ func ReadCorrelationsFromFile(file string) []float64 {
 	return values
 }
 
-// ReadTwoIntsFromFile reads two integers from a file
-func ReadTwoIntsFromFile(file string) (int, int) {
-	f, err := os.Open(file)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
+//-----------------------------------------------------------------------------------
 
-	scanner := bufio.NewScanner(f)
-	scanner.Scan()
-	values := strings.Split(scanner.Text(), " ")
+type LoadExpressionDataTest struct {
+	file              string
+	expectedSamples   []string
+	expectedGenes     []string
+	expectedNumGenes  int
+	expectedNumValues int
+}
 
-	val1, _ := strconv.Atoi(values[0])
-	val2, _ := strconv.Atoi(values[1])
+// TestLoadExpressionData tests that no gene or sample is lost when reading expression matrices
+func TestLoadExpressionData(t *testing.T) {
+	tests := ReadLoadExpressionDataTests("Tests/LoadExpressionData")
 
-	return val1, val2
+	for i, test := range tests {
+		matrix, err := diffcoex.ReadExpressionMatrix(test.file)
+		if err != nil {
+			t.Errorf("Test %d: ReadExpressionMatrix() error: %v", i, err)
+			continue
+		}
+		if strings.Join(matrix.SampleIDs, " ") != strings.Join(test.expectedSamples, " ") {
+			t.Errorf("Test %d: samples = %v, want %v", i, matrix.SampleIDs, test.expectedSamples)
+		}
+		if strings.Join(matrix.GeneIDs, " ") != strings.Join(test.expectedGenes, " ") {
+			t.Errorf("Test %d: genes = %v, want %v", i, matrix.GeneIDs, test.expectedGenes)
+		}
+
+		data, err := loadExpressionData(test.file)
+		if err != nil {
+			t.Errorf("Test %d: loadExpressionData() error: %v", i, err)
+			continue
+		}
+		if len(data) != test.expectedNumGenes {
+			t.Errorf("Test %d: loaded %d genes, want %d", i, len(data), test.expectedNumGenes)
+		}
+		for _, gene := range test.expectedGenes {
+			if len(data[gene]) != test.expectedNumValues {
+				t.Errorf("Test %d: gene %s has %d values, want %d", i, gene, len(data[gene]), test.expectedNumValues)
+			}
+		}
+	}
 }
 
-//-----------------------------------------------------------------------------------
+// ReadLoadExpressionDataTests reads test cases from files
+func ReadLoadExpressionDataTests(directory string) []LoadExpressionDataTest {
+	inputFiles := ReadDirectory(directory + "/input")
+	numFiles := len(inputFiles)
+
+	tests := make([]LoadExpressionDataTest, numFiles)
+	for i, inputFile := range inputFiles {
+		tests[i].file = directory + "/input/" + inputFile.Name()
+	}
+
+	outputFiles := ReadDirectory(directory + "/output")
+	if len(outputFiles) != numFiles {
+		panic("Error: number of input and output files do not match!")
+	}
+
+	for i, outputFile := range outputFiles {
+		f, err := os.Open(directory + "/output/" + outputFile.Name())
+		if err != nil {
+			panic(err)
+		}
+		scanner := bufio.NewScanner(f)
+
+		scanner.Scan()
+		counts := strings.Fields(scanner.Text())
+		tests[i].expectedNumGenes, _ = strconv.Atoi(counts[0])
+		tests[i].expectedNumValues, _ = strconv.Atoi(counts[1])
+
+		scanner.Scan()
+		tests[i].expectedSamples = strings.Fields(scanner.Text())
+		scanner.Scan()
+		tests[i].expectedGenes = strings.Fields(scanner.Text())
+		f.Close()
+	}
+
+	return tests
+}
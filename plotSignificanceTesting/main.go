@@ -10,31 +10,112 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+
+	"diffcoex"
 )
 
 func main() {
-	// ./plotSignificanceTesting moduleMap condition1Data condition2Data module
-	// Check if correct number of arguments are provided
-	if len(os.Args) != 5 {
-		fmt.Println("Usage: ./plotSignificanceTesting moduleMap condition1Data condition2Data module")
+	// ./plotSignificanceTesting [options] moduleMap condition1Data condition2Data module
+	strict := flag.Bool("strict", false,
+		"fail on any input problem (duplicate IDs, ragged rows, non-numeric, NaN/Inf or empty values)")
+	warningsPath := flag.String("warnings", "",
+		"tab-separated file listing the input problems found in lenient mode (default: <output>/plotting/validation_warnings.tsv)")
+	output := flag.String("output", "output",
+		"output directory shared with preprocess; plots go to its plotting directory")
+	configPath := flag.String("config", "",
+		"JSON config file shared with preprocess; its plotting section gives modules, condition1, condition2 and module")
+	correlation := flag.String("correlation", diffcoex.CorrelationPearson,
+		"correlation measure: 'pearson', 'spearman' (as clustering.R), 'bicor' (biweight midcorrelation) or 'kendall' (tau-b)")
+	maxPOutliers := flag.Float64("max-p-outliers", 1,
+		"bicor only: the largest fraction of each side of the median treated as outliers (1 keeps the plain biweight)")
+	storeMemory := flag.Int64("store-memory", 1024,
+		"largest correlation store of a condition kept in memory, in MB; larger stores are tiled on disk in the output directory")
+	storePrecision := flag.String("store-precision", diffcoex.CacheFloat64,
+		"precision of the correlation stores: 'float64' or 'float32' (half the memory and disk)")
+	minSamples := flag.Int("min-samples", 3,
+		"fewest samples observed in both genes for a pair to have a correlation; missing values are left out pair by pair")
+	seed := flag.Int64("seed", 0,
+		"seed of the random null modules, any value including 0 (default: taken from the clock, and recorded in the manifest)")
+	verifyPath := flag.String("verify", "",
+		"check the input and output files of a provenance manifest against the files on disk, then exit")
+	flag.Usage = func() {
+		fmt.Println("Usage: ./plotSignificanceTesting [options] moduleMap condition1Data condition2Data module")
+		fmt.Println("       ./plotSignificanceTesting -config <config.json> [options]")
+		fmt.Println("       ./plotSignificanceTesting -verify <output>/plotting/plotting_manifest.json")
 		fmt.Println("Example: ./plotSignificanceTesting data/golub/golub_diffcoex.csv data/golub/aml_samples.csv data/golub/all_samples.csv M1")
-		os.Exit(1)
+		fmt.Println("Conditions written by preprocess can also be given by name, e.g. AML ALL")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *verifyPath != "" {
+		os.Exit(diffcoex.RunVerify(*verifyPath))
+	}
+	manifest := diffcoex.NewManifest("plotSignificanceTesting")
+
+	// Read the settings missing from the command line from the config
+	config := diffcoex.Config{}
+	arguments := map[string]string{}
+	if *configPath != "" {
+		var err error
+		if config, err = diffcoex.ReadConfig(*configPath); err != nil {
+			log.Fatal("Error reading config:", err)
+		}
+		if arguments, err = diffcoex.ApplyConfig(config, "plotting", []string{"modules", "condition1", "condition2", "module"}); err != nil {
+			log.Fatal("Invalid config:", err)
+		}
+		pairs, err := config.ConditionPairs()
+		if err != nil {
+			log.Fatal("Invalid config:", err)
+		}
+		if len(pairs) > 0 && arguments["condition1"] == "" && arguments["condition2"] == "" {
+			arguments["condition1"], arguments["condition2"] = pairs[0][0], pairs[0][1]
+		}
 	}
 
 	// Get file paths from command line arguments
-	moduleMapPath := os.Args[1]
-	condition1Path := os.Args[2]
-	condition2Path := os.Args[3]
-	targetModule := os.Args[4]
+	if flag.NArg() == 4 {
+		arguments["modules"], arguments["condition1"], arguments["condition2"] = flag.Arg(0), flag.Arg(1), flag.Arg(2)
+		arguments["module"] = flag.Arg(3)
+	} else if flag.NArg() != 0 || arguments["modules"] == "" || arguments["condition1"] == "" ||
+		arguments["condition2"] == "" || arguments["module"] == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	moduleMapPath := arguments["modules"]
+	condition1Path := diffcoex.ResolveCondition(arguments["condition1"], *output)
+	condition2Path := diffcoex.ResolveCondition(arguments["condition2"], *output)
+	targetModule := arguments["module"]
+	diffcoex.StrictValidation = *strict
 
 	// Create output/plotting directory if it doesn't exist
-	outputDir := "output/plotting"
+	outputDir := filepath.Join(*output, "plotting")
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		log.Fatal("Error creating output directory:", err)
 	}
+	warningsFile := *warningsPath
+	if warningsFile == "" {
+		warningsFile = filepath.Join(outputDir, "validation_warnings.tsv")
+	}
+	if !diffcoex.FlagGiven("seed") {
+		*seed = diffcoex.NewSeed()
+	}
+	method, err := diffcoex.ParseCorrelationMethod(*correlation, *maxPOutliers, *minSamples)
+	if err != nil {
+		log.Fatal("Invalid -correlation:", err)
+	}
+	if *storePrecision != diffcoex.CacheFloat64 && *storePrecision != diffcoex.CacheFloat32 {
+		log.Fatalf("Invalid -store-precision %q: use 'float64' or 'float32'", *storePrecision)
+	}
+	runConfig, err := diffcoex.EffectiveConfig(config, "plotting", arguments)
+	if err != nil {
+		log.Fatal("Error recording config:", err)
+	}
 
 	// Load module assignments
 	moduleMap, err := loadModules(moduleMapPath)
@@ -53,13 +134,62 @@ func main() {
 		log.Fatal("Error loading condition 2 data:", err)
 	}
 
+	if len(diffcoex.ValidationWarnings) > 0 {
+		if err := diffcoex.WriteValidationWarnings(warningsFile); err != nil {
+			log.Fatal("Error writing validation warnings:", err)
+		}
+		diffcoex.RecordOutput(warningsFile)
+		fmt.Printf("%d input problems were found, see %s\n", len(diffcoex.ValidationWarnings), warningsFile)
+	}
+
 	// Check if the specified module exists
 	if !moduleExists(targetModule, moduleMap) {
 		log.Fatalf("Module %s not found in the module map", targetModule)
 	}
 
 	fmt.Printf("Plotting distributions for module %s...\n", targetModule)
-	plotModuleDistributions(targetModule, moduleMap, condition1Data, condition2Data)
+	condition1 := diffcoex.NewCorrelationEngine(condition1Data, method)
+	condition2 := diffcoex.NewCorrelationEngine(condition2Data, method)
+	store1, err := diffcoex.NewCorrelationStore(condition1, *storePrecision, *storeMemory<<20, outputDir, "condition1_correlations")
+	if err != nil {
+		log.Fatal("Error computing condition 1 correlations:", err)
+	}
+	store2, err := diffcoex.NewCorrelationStore(condition2, *storePrecision, *storeMemory<<20, outputDir, "condition2_correlations")
+	if err != nil {
+		log.Fatal("Error computing condition 2 correlations:", err)
+	}
+	moduleGenes := plotModuleDistributions(outputDir, targetModule, moduleMap, store1, store2, *seed)
+	for _, store := range []*diffcoex.CorrelationStore{store1, store2} {
+		if err := store.Close(); err != nil {
+			log.Fatal("Error closing correlation store:", err)
+		}
+	}
+
+	// Record the config next to the plots so that the run can be repeated
+	configFile := filepath.Join(outputDir, "config.json")
+	if err := diffcoex.WriteEffectiveConfig(runConfig, configFile); err != nil {
+		log.Fatal("Error writing config:", err)
+	}
+	diffcoex.RecordOutput(configFile)
+
+	// Record the provenance of the plots
+	manifest.SetConfig(runConfig)
+	if err := manifest.AddInputs(*configPath, moduleMapPath, condition1Path, condition2Path); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
+	if err := manifest.AddInputs(diffcoex.MatrixCachesRead...); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
+	if err := manifest.AddOutputs(diffcoex.OutputFiles...); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
+	manifest.Counts["module genes"] = moduleGenes
+	manifest.Counts["condition1 genes"], manifest.Counts["condition1 samples"] = expressionDims(condition1Data)
+	manifest.Counts["condition2 genes"], manifest.Counts["condition2 samples"] = expressionDims(condition2Data)
+	manifest.Seeds["null"] = *seed
+	if err := manifest.Write(filepath.Join(outputDir, "plotting_manifest.json")); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
 	fmt.Println("Done!")
 }
 
@@ -72,7 +202,10 @@ func moduleExists(targetModule string, moduleMap map[string]string) bool {
 	return false
 }
 
-func plotModuleDistributions(moduleName string, moduleMap map[string]string, condition1Data, condition2Data map[string][]float64) {
+// plotModuleDistributions plots the module and null correlations of both
+// conditions and returns the number of genes in the module
+func plotModuleDistributions(outputDir, moduleName string, moduleMap map[string]string, condition1, condition2 *diffcoex.CorrelationStore,
+	seed int64) int {
 	// Get genes in this module
 	var moduleGenes []string
 	for gene, module := range moduleMap {
@@ -81,25 +214,29 @@ func plotModuleDistributions(moduleName string, moduleMap map[string]string, con
 		}
 	}
 
-	// Get actual correlations
-	actualC1Corrs := getModuleCorrelations(moduleGenes, condition1Data)
-	actualC2Corrs := getModuleCorrelations(moduleGenes, condition2Data)
+	sort.Strings(moduleGenes)
 
-	// Generate null distributions
-	const numPermutations = 1000
-	var c1Genes, c2Genes []string
-	for gene := range condition1Data {
-		c1Genes = append(c1Genes, gene)
-	}
-	for gene := range condition2Data {
-		c2Genes = append(c2Genes, gene)
-	}
+	// Look up actual correlations
+	actualC1Corrs, _ := condition1.ModuleCorrelations(moduleGenes)
+	actualC2Corrs, _ := condition2.ModuleCorrelations(moduleGenes)
 
 	// Get null distributions
-	c1NullCorrs, c2NullCorrs := generateNullCorrelations(moduleGenes, c1Genes, c2Genes,
-		condition1Data, condition2Data, numPermutations)
+	const numPermutations = 1000
+	c1NullCorrs, c2NullCorrs := generateNullCorrelations(moduleGenes, condition1, condition2,
+		numPermutations, diffcoex.DeriveSeed(seed, moduleName))
 
 	// Create plots for each condition using the function from plotDistributions.go
-	plotConditionDistribution(moduleName, "condition1", actualC1Corrs, c1NullCorrs)
-	plotConditionDistribution(moduleName, "condition2", actualC2Corrs, c2NullCorrs)
+	plotConditionDistribution(outputDir, moduleName, "condition1", condition1.Method(), actualC1Corrs, c1NullCorrs)
+	plotConditionDistribution(outputDir, moduleName, "condition2", condition2.Method(), actualC2Corrs, c2NullCorrs)
+	return len(moduleGenes)
+}
+
+// expressionDims returns the number of genes and samples of expression data
+func expressionDims(data map[string][]float64) (int, int) {
+	samples := 0
+	for _, values := range data {
+		samples = len(values)
+		break
+	}
+	return len(data), samples
 }
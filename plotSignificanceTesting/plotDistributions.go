@@ -18,91 +18,70 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"sync"
-	"time"
 
+	"diffcoex"
 	"gonum.org/v1/gonum/stat"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 )
 
-func generateNullCorrelations(moduleGenes, c1Genes, c2Genes []string,
-	condition1Data, condition2Data map[string][]float64, numPermutations int) ([]float64, []float64) {
+// generateNullCorrelations returns the correlations of random modules of the
+// size of the module, drawn from the genes of each condition and looked up in
+// its correlation store
+func generateNullCorrelations(moduleGenes []string, condition1, condition2 *diffcoex.CorrelationStore,
+	numPermutations int, seed int64) ([]float64, []float64) {
 
 	moduleSize := len(moduleGenes)
-
-	// Create channels for parallel processing
-	c1Results := make(chan []float64, numPermutations)
-	c2Results := make(chan []float64, numPermutations)
-
-	// Create worker pool
+	c1Genes := condition1.Genes()
+	c2Genes := condition2.Genes()
+
+	// Draw the random modules of both conditions on a worker pool. The
+	// modules of permutation i are drawn from a seed derived from i and kept
+	// in order, so the same seed gives the same correlations on any machine.
+	c1Permutations := make([][]float64, numPermutations)
+	c2Permutations := make([][]float64, numPermutations)
 	numWorkers := runtime.GOMAXPROCS(0)
 	var wg sync.WaitGroup
-
-	// Launch workers for condition 1
 	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
-		go func() {
+		go func(w int) {
 			defer wg.Done()
-			r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-			permutationsPerWorker := numPermutations / numWorkers
-			for i := 0; i < permutationsPerWorker; i++ {
-				// Randomly sample genes for null module
-				nullGenes := sampleGenes(c1Genes, moduleSize, r)
-				nullCorrs := getModuleCorrelations(nullGenes, condition1Data)
-				c1Results <- nullCorrs
-			}
-		}()
-	}
+			for i := w; i < numPermutations; i += numWorkers {
+				// Randomly sample genes for the null modules of permutation i
+				r := rand.New(rand.NewSource(diffcoex.DeriveSeed(seed, fmt.Sprintf("condition1/%d", i))))
+				c1Permutations[i], _ = condition1.ModuleCorrelations(sampleGenes(c1Genes, moduleSize, r))
 
-	// Launch workers for condition 2
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-			permutationsPerWorker := numPermutations / numWorkers
-			for i := 0; i < permutationsPerWorker; i++ {
-				nullGenes := sampleGenes(c2Genes, moduleSize, r)
-				nullCorrs := getModuleCorrelations(nullGenes, condition2Data)
-				c2Results <- nullCorrs
+				r = rand.New(rand.NewSource(diffcoex.DeriveSeed(seed, fmt.Sprintf("condition2/%d", i))))
+				c2Permutations[i], _ = condition2.ModuleCorrelations(sampleGenes(c2Genes, moduleSize, r))
 			}
-		}()
+		}(w)
 	}
+	wg.Wait()
 
-	// Close results channels when all workers are done
-	go func() {
-		wg.Wait()
-		close(c1Results)
-		close(c2Results)
-	}()
-
-	// Collect results
+	// Collect results in permutation order
 	var c1NullCorrs, c2NullCorrs []float64
-	for corrs := range c1Results {
-		c1NullCorrs = append(c1NullCorrs, corrs...)
-	}
-	for corrs := range c2Results {
-		c2NullCorrs = append(c2NullCorrs, corrs...)
+	for i := 0; i < numPermutations; i++ {
+		c1NullCorrs = append(c1NullCorrs, c1Permutations[i]...)
+		c2NullCorrs = append(c2NullCorrs, c2Permutations[i]...)
 	}
 
 	return c1NullCorrs, c2NullCorrs
 }
 
-func plotConditionDistribution(moduleName, conditionName string, actualCorrs, nullCorrs []float64) {
+func plotConditionDistribution(outputDir, moduleName, conditionName string, method diffcoex.CorrelationMethod,
+	actualCorrs, nullCorrs []float64) {
 	p := plot.New()
 
 	// Calculate t-statistic and p-value
 	tstat, pval := calculateTStatistic(actualCorrs, nullCorrs)
 
-	// Set plot title and labels with t-statistic and p-value
-	p.Title.Text = fmt.Sprintf("Module %s - %s\nt-statistic: %.2f, p-value: %.4f",
-		moduleName, conditionName, tstat, pval)
-	p.X.Label.Text = "Correlation"
+	// Set plot title and labels with the correlation measure, t-statistic
+	// and p-value
+	p.Title.Text = fmt.Sprintf("Module %s - %s (%s)\nt-statistic: %.2f, p-value: %.4f",
+		moduleName, conditionName, method, tstat, pval)
+	p.X.Label.Text = fmt.Sprintf("Correlation (%s)", method)
 	p.Y.Label.Text = "Density"
 
 	// Create histograms
@@ -127,12 +106,14 @@ func plotConditionDistribution(moduleName, conditionName string, actualCorrs, nu
 	p.Legend.Top = true
 
 	// Save the plot to the correct directory
-	outputPath := filepath.Join("output", "plotting",
+	outputPath := filepath.Join(outputDir,
 		fmt.Sprintf("%s_%s_distribution.png", moduleName, conditionName))
 
 	if err := p.Save(6*vg.Inch, 4*vg.Inch, outputPath); err != nil {
 		fmt.Printf("Error saving plot: %v\n", err)
+		return
 	}
+	diffcoex.RecordOutput(outputPath)
 }
 
 func calculateTStatistic(actual, null []float64) (float64, float64) {
@@ -221,123 +202,21 @@ func loadModules(filename string) (map[string]string, error) {
 }
 
 func loadExpressionData(filename string) (map[string][]float64, error) {
-	file, err := os.Open(filename)
+	matrix, err := diffcoex.ReadExpressionMatrix(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
 	data := make(map[string][]float64)
-
-	// Skip header if it exists
-	_, err = reader.Read()
-	if err != nil {
-		return nil, err
-	}
-
-	for {
-		record, err := reader.Read()
-		if err != nil {
-			break
-		}
-
-		geneName := record[0]
-		values := make([]float64, 0)
-
-		// Convert string values to float64, starting from column 1
-		for _, val := range record[1:] {
-			f, err := strconv.ParseFloat(val, 64)
-			if err != nil {
-				continue
+	for i, geneName := range matrix.GeneIDs {
+		// Keep the values aligned by sample, with NaN where they did not
+		// parse, and only the genes with a value
+		for _, f := range matrix.Values[i] {
+			if !math.IsNaN(f) {
+				data[geneName] = matrix.Values[i]
+				break
 			}
-			values = append(values, f)
-		}
-
-		if len(values) > 0 {
-			data[geneName] = values
 		}
 	}
 	return data, nil
 }
-
-func getModuleCorrelations(genes []string, expressionData map[string][]float64) []float64 {
-	// Find minimum sample size across all genes in the dataset
-	minSamples := -1
-	for _, expr := range expressionData {
-		if minSamples == -1 || len(expr) < minSamples {
-			minSamples = len(expr)
-		}
-	}
-
-	// Calculate total number of correlations needed
-	numGenes := len(genes)
-	numCorrelations := (numGenes * (numGenes - 1)) / 2
-
-	// Create channels for parallel processing
-	results := make(chan float64, numCorrelations)
-	numWorkers := runtime.GOMAXPROCS(0)
-	var wg sync.WaitGroup
-
-	// Calculate how many gene pairs each worker should handle
-	pairsPerWorker := numCorrelations / numWorkers
-	if pairsPerWorker < 1 {
-		pairsPerWorker = 1
-	}
-
-	// Launch workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		startIdx := w * pairsPerWorker
-		endIdx := (w + 1) * pairsPerWorker
-		if w == numWorkers-1 {
-			endIdx = numCorrelations
-		}
-
-		go func(start, end int) {
-			defer wg.Done()
-
-			for idx := start; idx < end; idx++ {
-				i, j := getGeneIndices(idx)
-				if i >= len(genes) || j >= len(genes) {
-					continue
-				}
-
-				gene1 := genes[i]
-				gene2 := genes[j]
-
-				expr1, ok1 := expressionData[gene1]
-				expr2, ok2 := expressionData[gene2]
-
-				if ok1 && ok2 {
-					expr1 = expr1[:minSamples]
-					expr2 = expr2[:minSamples]
-
-					corr := stat.Correlation(expr1, expr2, nil)
-
-					if !math.IsNaN(corr) {
-						results <- corr
-					}
-				}
-			}
-		}(startIdx, endIdx)
-	}
-
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	var correlations []float64
-	for corr := range results {
-		correlations = append(correlations, corr)
-	}
-
-	return correlations
-}
-
-func getGeneIndices(idx int) (i, j int) {
-	i = int(math.Floor((-1 + math.Sqrt(1+8*float64(idx))) / 2))
-	j = idx - (i * (i + 1) / 2)
-	return i, j + i + 1
-}
@@ -11,106 +11,43 @@ package main
 
 import (
 	"encoding/csv"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
-	"strconv"
+	"strings"
+	"unicode"
 
+	"diffcoex"
 	"gonum.org/v1/gonum/mat"
 )
 
 // DataWithGenes holds both the expression data matrix and gene IDs
 type DataWithGenes struct {
-	Data    *mat.Dense
-	GeneIDs []string
+	Data      *mat.Dense
+	GeneIDs   []string
+	SampleIDs []string
+	Metadata  map[string]string // Written as "#key=value" lines by saveToCSV
+
+	// Set once probes are annotated with a platform table (nil otherwise).
+	// After collapsing, GeneIDs are gene symbols and ProbeIDs lists the
+	// probes behind each row, separated by ";".
+	ProbeIDs    []string
+	GeneSymbols []string
 }
 
-// ReadData reads and parses the GDS2901.soft file
+// ReadData reads and parses the expression table of a GDS SOFT file
 func ReadData(filePath string) (*DataWithGenes, error) {
-	file, err := os.Open(filePath)
+	soft, err := ReadSoftFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("error opening file: %v", err)
-	}
-	defer file.Close()
-
-	reader := csv.NewReader(file)
-	reader.Comma = '\t'
-	reader.FieldsPerRecord = -1 // Allow variable number of fields
-	reader.LazyQuotes = true    // Be more permissive with quotes
-
-	var geneIDs []string
-	var dataRows [][]float64
-	var dataStarted bool
-	var numCols int
-
-	// Read the file line by line
-	for {
-		record, err := reader.Read()
-		if err != nil {
-			break // End of file or error
-		}
-
-		// Skip empty lines
-		if len(record) == 0 {
-			continue
-		}
-
-		// Look for the start of data
-		if record[0] == "!dataset_table_begin" {
-			dataStarted = true
-			// Read the header in the next iteration
-			continue
-		}
-
-		// If we found the end of data, break
-		if record[0] == "!dataset_table_end" {
-			break
-		}
-
-		// Skip until we find the start of data
-		if !dataStarted {
-			continue
-		}
-
-		// If this is the first line after data start, it's the header
-		if numCols == 0 {
-			numCols = len(record) - 2 // Subtract ID and description columns
-			continue
-		}
-
-		// Process data rows
-		if len(record) >= 3 { // Ensure we have at least ID, description, and one data point
-			geneIDs = append(geneIDs, record[0])
-			rowData := make([]float64, numCols)
-
-			for j := 2; j < len(record) && j-2 < numCols; j++ {
-				val, err := strconv.ParseFloat(record[j], 64)
-				if err != nil {
-					val = 0 // Use 0 for invalid values
-				}
-				rowData[j-2] = val
-			}
-			dataRows = append(dataRows, rowData)
-		}
+		return nil, err
 	}
-
-	// Verify we have data
-	if len(dataRows) == 0 {
-		return nil, fmt.Errorf("no valid data found in file")
-	}
-
-	// Create matrix from data
-	matrix := mat.NewDense(len(dataRows), numCols, nil)
-	for i, row := range dataRows {
-		matrix.SetRow(i, row)
-	}
-
-	return &DataWithGenes{
-		Data:    matrix,
-		GeneIDs: geneIDs,
-	}, nil
+	return soft.Expression, nil
 }
 
 // ReadGolubData reads and parses the Golub data file
@@ -123,53 +60,70 @@ func ReadGolubData(filePath string) (*DataWithGenes, *DataWithGenes, error) {
 
 	reader := csv.NewReader(file)
 	reader.Comma = '\t'
+	reader.FieldsPerRecord = -1
 
-	// Read all records
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, nil, fmt.Errorf("error reading file: %v", err)
+	// Read all records, keeping their line numbers for validation messages
+	var records [][]string
+	var lineNumbers []int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading file: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, record)
+		lineNumbers = append(lineNumbers, line)
 	}
 
 	// Skip header row
 	if len(records) < 2 {
 		return nil, nil, fmt.Errorf("file does not contain enough data")
 	}
+	header := records[0]
+	if len(header) < 39 {
+		return nil, nil, fmt.Errorf("header has %d columns, expected at least 39", len(header))
+	}
 	records = records[1:] // Skip header row
+	lineNumbers = lineNumbers[1:]
 
 	// Process data rows
+	validator := diffcoex.NewValidator(filePath)
 	var geneIDs []string
 	var allRows [][]float64
 	var amlRows [][]float64
 
-	for _, record := range records {
+	for i, record := range records {
+		line := lineNumbers[i]
+		if !validator.CheckFields(line, record, len(header), 1) {
+			continue
+		}
 		if len(record) < 39 { // Need at least 38 columns plus gene ID
 			continue
 		}
 
+		validator.CheckID(line, record[0])
 		geneIDs = append(geneIDs, record[0])
 
 		// Process ALL samples (columns 1-27)
 		allData := make([]float64, 27)
 		for j := 1; j < 28; j++ {
-			val, err := strconv.ParseFloat(record[j], 64)
-			if err != nil {
-				val = 0 // Use 0 for invalid values
-			}
-			allData[j-1] = val
+			allData[j-1] = validator.ParseValue(line, header[j], record[j])
 		}
 		allRows = append(allRows, allData)
 
 		// Process AML samples (columns 28-38)
 		amlData := make([]float64, 11)
 		for j := 28; j < 39; j++ {
-			val, err := strconv.ParseFloat(record[j], 64)
-			if err != nil {
-				val = 0 // Use 0 for invalid values
-			}
-			amlData[j-28] = val
+			amlData[j-28] = validator.ParseValue(line, header[j], record[j])
 		}
 		amlRows = append(amlRows, amlData)
 	}
+	if err := validator.Finish(); err != nil {
+		return nil, nil, err
+	}
 
 	// Create matrix from data
 	allMatrix := mat.NewDense(len(allRows), 27, nil)
@@ -183,11 +137,13 @@ func ReadGolubData(filePath string) (*DataWithGenes, *DataWithGenes, error) {
 	}
 
 	return &DataWithGenes{
-			Data:    allMatrix,
-			GeneIDs: geneIDs,
+			Data:      allMatrix,
+			GeneIDs:   geneIDs,
+			SampleIDs: append([]string{}, header[1:28]...),
 		}, &DataWithGenes{
-			Data:    amlMatrix,
-			GeneIDs: geneIDs,
+			Data:      amlMatrix,
+			GeneIDs:   geneIDs,
+			SampleIDs: append([]string{}, header[28:39]...),
 		}, nil
 }
 
@@ -201,39 +157,107 @@ func applyLog2(data *mat.Dense) *mat.Dense {
 	return result
 }
 
-// NormalizeQuantiles performs quantile normalization
+// NormalizeQuantiles performs quantile normalization across samples, matching
+// preprocessCore's normalize.quantiles: every column is given the row-wise
+// mean of the sorted columns, and tied values share the average of their
+// quantiles. Missing (NaN) values stay missing; columns with missing values are
+// mapped onto the mean quantiles by linear interpolation.
 func NormalizeQuantiles(data *mat.Dense) *mat.Dense {
 	rows, cols := data.Dims()
 	result := mat.NewDense(rows, cols, nil)
+	if rows == 0 || cols == 0 {
+		return result
+	}
 
-	// For each column
+	// Sort the observed values of each column
+	sortedCols := make([][]float64, cols)
 	for j := 0; j < cols; j++ {
-		// Get column data
-		col := mat.Col(nil, j, data)
-
-		// Sort values
-		sorted := make([]float64, len(col))
-		copy(sorted, col)
+		sorted := make([]float64, 0, rows)
+		for _, v := range mat.Col(nil, j, data) {
+			if !math.IsNaN(v) {
+				sorted = append(sorted, v)
+			}
+		}
 		sort.Float64s(sorted)
+		sortedCols[j] = sorted
+	}
 
-		// Create rank mapping
-		rankMap := make(map[float64]float64)
-		for i, v := range sorted {
-			rankMap[v] = float64(i)
+	// Row-wise mean of the sorted columns
+	meanQuantiles := make([]float64, rows)
+	for k := 0; k < rows; k++ {
+		sum := 0.0
+		n := 0
+		for _, sorted := range sortedCols {
+			if len(sorted) == 0 {
+				continue
+			}
+			sum += interpolateSorted(sorted, float64(k)*float64(len(sorted)-1)/math.Max(float64(rows-1), 1))
+			n++
 		}
+		if n > 0 {
+			meanQuantiles[k] = sum / float64(n)
+		}
+	}
 
-		// Apply normalization
-		for i := 0; i < rows; i++ {
-			val := data.At(i, j)
-			rank := rankMap[val]
-			normalizedVal := sorted[int(rank)]
-			result.Set(i, j, normalizedVal)
+	// Replace each value by the mean quantile of its (tie-averaged) rank
+	for j := 0; j < cols; j++ {
+		col := mat.Col(nil, j, data)
+		ranks := averageRanks(col)
+		observed := len(sortedCols[j])
+		for i, v := range col {
+			if math.IsNaN(v) {
+				result.Set(i, j, math.NaN())
+				continue
+			}
+			position := (ranks[i] - 1) * float64(rows-1) / math.Max(float64(observed-1), 1)
+			result.Set(i, j, interpolateSorted(meanQuantiles, position))
 		}
 	}
 
 	return result
 }
 
+// averageRanks returns the 1-based ranks of the non-NaN values, with tied
+// values sharing the average of their ranks. NaN values get rank 0.
+func averageRanks(values []float64) []float64 {
+	var order []int
+	for i, v := range values {
+		if !math.IsNaN(v) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return values[order[a]] < values[order[b]]
+	})
+
+	ranks := make([]float64, len(values))
+	for start := 0; start < len(order); {
+		end := start
+		for end+1 < len(order) && values[order[end+1]] == values[order[start]] {
+			end++
+		}
+		rank := float64(start+end)/2 + 1
+		for k := start; k <= end; k++ {
+			ranks[order[k]] = rank
+		}
+		start = end + 1
+	}
+	return ranks
+}
+
+// interpolateSorted returns the value at a fractional index of a sorted slice
+func interpolateSorted(sorted []float64, position float64) float64 {
+	lower := int(math.Floor(position))
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	fraction := position - float64(lower)
+	if fraction == 0 {
+		return sorted[lower]
+	}
+	return sorted[lower] + fraction*(sorted[lower+1]-sorted[lower])
+}
+
 // Extract Eker rat samples for different conditions
 func ExtractEkerSamples(data *mat.Dense) *mat.Dense {
 	rows, _ := data.Dims()
@@ -290,24 +314,6 @@ func ExtractAMLSamples(data *mat.Dense) *mat.Dense {
 }
 
 // Helper functions
-func removeRow(data *mat.Dense, rowIndex int) *mat.Dense {
-	rows, cols := data.Dims()
-	if rowIndex < 0 || rowIndex >= rows {
-		return data
-	}
-
-	newData := mat.NewDense(rows-1, cols, nil)
-	for i := 0; i < rowIndex; i++ {
-		row := mat.Row(nil, i, data)
-		newData.SetRow(i, row)
-	}
-	for i := rowIndex + 1; i < rows; i++ {
-		row := mat.Row(nil, i, data)
-		newData.SetRow(i-1, row)
-	}
-	return newData
-}
-
 func makeRange(min, max int) []int {
 	a := make([]int, max-min)
 	for i := range a {
@@ -316,184 +322,541 @@ func makeRange(min, max int) []int {
 	return a
 }
 
-func saveToCSV(data *mat.Dense, geneIDs []string, filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	rows, cols := data.Dims()
-	for i := 0; i < rows; i++ {
-		row := make([]string, cols+1)
-		row[0] = geneIDs[i]
-		for j := 0; j < cols; j++ {
-			row[j+1] = strconv.FormatFloat(data.At(i, j), 'f', -1, 64)
-		}
-		if err := writer.Write(row); err != nil {
-			return fmt.Errorf("error writing row: %v", err)
+// writeOutput saves one condition in the directory of every profile and
+// records it for the condition manifest. groups holds the condition data of
+// each profile, in the order of options.Profiles.
+func writeOutput(options PipelineOptions, name string, groups []*DataWithGenes, filename string) error {
+	output := ConditionOutput{Name: name}
+	output.Genes, output.Samples = groups[0].Data.Dims()
+	for p, profile := range options.Profiles {
+		path := filepath.Join(options.OutputDir, profile.Name, filename)
+		if err := saveOutput(groups[p], options, path); err != nil {
+			return fmt.Errorf("error saving to %s: %v", profile.Name, err)
 		}
+		output.Files = append(output.Files, path)
+	}
+	if slices.Contains(options.Exports, ExportCLS) {
+		output.Data = groups
 	}
 
+	writtenConditions = append(writtenConditions, output)
 	return nil
 }
 
-// CleanData removes or replaces invalid values in the matrix
-func CleanData(data *mat.Dense) *mat.Dense {
-	rows, cols := data.Dims()
-	cleaned := mat.NewDense(rows, cols, nil)
-
-	for i := 0; i < rows; i++ {
-		rowData := mat.Row(nil, i, data)
-		validValues := make([]float64, 0)
-
-		// Collect valid values from the row
-		for _, val := range rowData {
-			if !math.IsNaN(val) && !math.IsInf(val, 0) {
-				validValues = append(validValues, val)
-			}
+func main() {
+	subsetType := flag.String("subset-type", defaultRatSubsetType,
+		"GDS subset type used to split samples into conditions (e.g. 'genotype/variation', 'age', 'tissue')")
+	gds2901Layout := flag.Bool("gds2901-layout", false,
+		"split rat data by the GDS2901 column layout (36 Eker mutants, then 36 wild types) instead of -subset-type")
+	characteristic := flag.String("characteristic", "",
+		"sample characteristic used to split a series matrix into conditions (e.g. 'tissue')")
+	sampleSheetPath := flag.String("samples", "",
+		"tab-separated sample sheet (sample ID, condition, optional batch and covariates) for matrix datasets, -combat and -covariates")
+	conditionList := flag.String("conditions", "",
+		"comma-separated conditions to write for matrix datasets (default: every condition in the sample sheet)")
+	normalize := flag.String("normalize", "",
+		"comma-separated normalization steps of the diffcoex profile, e.g. 'log:base=2:pseudocount=1,quantile'.\n"+
+			"Steps: log, log2, auto-log, quantile, median-center, zscore, upper-quartile, arcsinh, or 'none'.\n"+
+			"Log steps take base, pseudocount and nonpositive=nan|floor|offset; auto-log only logs linear data\n"+
+			"(default: auto-log and quantile for rat, none otherwise)")
+	platformPath := flag.String("platform", "",
+		"GPL platform annotation table; probes are collapsed to one row per gene symbol")
+	collapseMethod := flag.String("collapse", defaultCollapse,
+		"how to collapse several probes of a gene: 'maxmean', 'maxvar', 'median' or 'pc1'")
+	excludePath := flag.String("exclude", "",
+		"probe exclusion list: one probe ID, 'regex:<pattern>' or 'affx' per line, optionally followed by a tab and a reason,\n"+
+			"or 'none' (default: data/GDS2901_exclusions.txt for rat, none otherwise)")
+	excludeAFFX := flag.Bool("exclude-affx", false,
+		"exclude Affymetrix control probes (IDs starting with AFFX-)")
+	impute := flag.String("impute", ImputeNone,
+		"how to fill missing values (null, NA, empty): 'none' keeps them as NA, 'mean', 'median' or 'knn'")
+	knnNeighbours := flag.Int("knn-k", defaultKNNNeighbours,
+		"number of neighbouring genes averaged by -impute knn")
+	maxMissing := flag.Float64("max-missing", 1,
+		"drop genes with a larger fraction of missing values (0 to 1)")
+	minPresent := flag.Float64("min-present", 0,
+		"drop genes with a smaller fraction of non-missing values over all conditions (0 to 1)")
+	minMean := flag.Float64("min-mean", math.Inf(-1),
+		"drop genes whose mean normalized expression over all conditions is lower")
+	dropConstant := flag.Bool("drop-constant", false,
+		"drop genes that are constant in any condition")
+	topN := flag.Int("top", 0,
+		"keep only the N genes with the highest -rank-by statistic over all conditions (0 keeps all)")
+	rankBy := flag.String("rank-by", RankByVariance,
+		"statistic ranking genes for -top: 'variance' or 'mad'")
+	combat := flag.Bool("combat", false,
+		"correct batch effects in the diffcoex profile with parametric ComBat, using the batch column of -samples")
+	protectCondition := flag.Bool("combat-protect-condition", false,
+		"keep the condition of -samples in the ComBat model so that condition differences are not removed")
+	covariates := flag.String("covariates", "",
+		"comma-separated sample sheet covariates to regress out in the diffcoex profile and the profiles with 'regress' (numeric or categorical)")
+	regressMode := flag.String("regress", RegressJoint,
+		"fit the covariate model 'joint'ly over all conditions (keeping condition effects) or 'within' each condition")
+	sampleQC := flag.String("sample-qc", SampleQCNone,
+		"inter-array correlation QC of each condition: 'none', 'flag' (write QC tables) or 'remove' (also drop outliers)")
+	outlierZ := flag.Float64("outlier-z", defaultOutlierZ,
+		"samples with a standardized connectivity Z.K below minus this value are outliers")
+	profileSpecs := flag.String("profile", "",
+		"semicolon-separated extra profiles 'name=steps', where steps are normalization steps, 'combat' and 'regress',\n"+
+			"e.g. 'scaled=log2,zscore;batch=quantile,combat'. A diffcoex or coxpress profile replaces the built-in one")
+	profileNames := flag.String("profiles", "",
+		"comma-separated profiles to write, in order; the first one drives -sample-qc and the gene filters\n"+
+			"(default: diffcoex, coxpress, then the -profile ones)")
+	strict := flag.Bool("strict", false,
+		"fail on any input problem (duplicate IDs, ragged rows, non-numeric, NaN/Inf or empty values)")
+	warningsPath := flag.String("warnings", "",
+		"tab-separated file listing the input problems found in lenient mode (default: <output>/validation_warnings.tsv)")
+	exportFormats := flag.String("export", "",
+		"comma-separated formats every condition file is also written in: 'gct' and 'tsv' next to it,\n"+
+			"'cls' as all_conditions.gct and all_conditions.cls in each profile directory for GSEA")
+	cache := flag.String("cache", diffcoex.CacheFloat64,
+		"precision of the binary cache written next to every condition file for the other tools: 'float64', 'float32' or 'none'")
+	outputDir := flag.String("output", "output",
+		"directory receiving the diffcoex and coxpress outputs, the reports and the config of the run")
+	configPath := flag.String("config", "",
+		"JSON config file giving the dataset, input and any of these options (command line flags win)")
+	verifyPath := flag.String("verify", "",
+		"check the input and output files of a provenance manifest against the files on disk, then exit")
+	flag.Usage = func() {
+		fmt.Println("Usage: ./preprocess [options] <dataset_type> <file_path>")
+		fmt.Println("       ./preprocess -config <config.json> [options]")
+		fmt.Println("       ./preprocess -verify <output>/preprocess_manifest.json")
+		fmt.Println("dataset_type: 'rat', 'golub', 'soft', 'series' or 'matrix'")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *verifyPath != "" {
+		os.Exit(diffcoex.RunVerify(*verifyPath))
+	}
+	manifest := diffcoex.NewManifest("preprocess")
+
+	config := diffcoex.Config{}
+	arguments := map[string]string{}
+	if *configPath != "" {
+		var err error
+		if config, err = diffcoex.ReadConfig(*configPath); err != nil {
+			log.Fatalf("Error reading config: %v", err)
 		}
-
-		// Calculate row mean from valid values
-		var rowMean float64
-		if len(validValues) > 0 {
-			sum := 0.0
-			for _, val := range validValues {
-				sum += val
-			}
-			rowMean = sum / float64(len(validValues))
+		if arguments, err = diffcoex.ApplyConfig(config, "", []string{"dataset", "input"}); err != nil {
+			log.Fatalf("Invalid config: %v", err)
 		}
-
-		// Replace invalid values with row mean
-		for j := 0; j < cols; j++ {
-			val := data.At(i, j)
-			if math.IsNaN(val) || math.IsInf(val, 0) {
-				cleaned.Set(i, j, rowMean)
-			} else {
-				cleaned.Set(i, j, val)
+	}
+	if flag.NArg() == 2 {
+		arguments["dataset"], arguments["input"] = flag.Arg(0), flag.Arg(1)
+	} else if flag.NArg() != 0 || arguments["dataset"] == "" || arguments["input"] == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	conditionPairs, err := config.ConditionPairs()
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	datasetType := arguments["dataset"]
+	filePath := arguments["input"]
+	diffcoex.StrictValidation = *strict
+	warningsFile := *warningsPath
+	if warningsFile == "" {
+		warningsFile = filepath.Join(*outputDir, "validation_warnings.tsv")
+	}
+
+	options := defaultPipelineOptions(datasetType)
+	options.SubsetType = *subsetType
+	options.GDS2901Layout = *gds2901Layout
+	options.Characteristic = *characteristic
+	options.SampleSheet = *sampleSheetPath
+	options.Conditions = splitList(*conditionList)
+	if len(options.Conditions) == 0 {
+		// Write the conditions compared downstream
+		for _, pair := range conditionPairs {
+			for _, condition := range pair {
+				if !slices.Contains(options.Conditions, condition) {
+					options.Conditions = append(options.Conditions, condition)
+				}
 			}
 		}
 	}
 
-	return cleaned
-}
-
-// writeOutput saves the processed data to both diffcoex and coxpress directories
-func writeOutput(d *DataWithGenes, filename string) error {
-	// Write to diffcoex directory
-	if err := saveToCSV(d.Data, d.GeneIDs, "output/diffcoex/"+filename); err != nil {
-		return fmt.Errorf("error saving to diffcoex: %v", err)
+	// Built-in profiles, as set by -normalize, -combat and -covariates, then
+	// the -profile ones
+	profiles := defaultProfiles(datasetType)
+	if *normalize != "" {
+		chain, err := ParseNormalizerChain(*normalize)
+		if err != nil {
+			log.Fatalf("Invalid -normalize: %v", err)
+		}
+		profiles[0].Normalization = chain
 	}
-
-	// Write to coxpress directory
-	if err := saveToCSV(d.Data, d.GeneIDs, "output/coxpress/"+filename); err != nil {
-		return fmt.Errorf("error saving to coxpress: %v", err)
+	profiles[0].BatchCorrection = *combat
+	profiles[0].Covariates = *covariates != ""
+	custom, err := ParseProfiles(*profileSpecs)
+	if err != nil {
+		log.Fatalf("Invalid -profile: %v", err)
 	}
-
-	return nil
-}
-
-func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: ./preprocess <dataset_type> <file_path>")
-		fmt.Println("dataset_type: 'rat' or 'golub'")
-		os.Exit(1)
+	profiles = mergeProfiles(profiles, custom)
+	if names := splitList(*profileNames); len(names) > 0 {
+		if profiles, err = selectProfiles(profiles, names); err != nil {
+			log.Fatalf("Invalid -profiles: %v", err)
+		}
+	}
+	options.Profiles = profiles
+	if *excludePath == ExclusionNone {
+		options.Exclusions = nil
+	} else if *excludePath != "" {
+		exclusions, err := ReadExclusionList(*excludePath)
+		if err != nil {
+			log.Fatalf("Error reading exclusion list: %v", err)
+		}
+		options.Exclusions = exclusions
+	}
+	if *excludeAFFX {
+		if options.Exclusions == nil {
+			options.Exclusions = NewExclusionList()
+		}
+		options.Exclusions.AddAFFX()
+	}
+	options.CollapseMethod = *collapseMethod
+	options.MissingValues = MissingValueOptions{MaxMissingFraction: *maxMissing, Imputation: *impute, K: *knnNeighbours}
+	if *maxMissing < 0 || *maxMissing > 1 {
+		log.Fatalf("Invalid -max-missing %v: must be between 0 and 1", *maxMissing)
+	}
+	options.BatchCorrection = BatchCorrectionOptions{ProtectCondition: *protectCondition}
+	options.Covariates = CovariateOptions{Names: splitList(*covariates), Mode: *regressMode}
+	if *regressMode != RegressJoint && *regressMode != RegressWithin {
+		log.Fatalf("Invalid -regress %q: use 'joint' or 'within'", *regressMode)
+	}
+	for _, profile := range options.Profiles {
+		if profile.BatchCorrection && options.SampleSheet == "" {
+			log.Fatalf("Profile %s runs ComBat, which needs -samples with a batch column", profile.Name)
+		}
+		if profile.Covariates && len(options.Covariates.Names) == 0 {
+			log.Fatalf("Profile %s regresses covariates, which needs -covariates", profile.Name)
+		}
+		if profile.Covariates && options.SampleSheet == "" {
+			log.Fatalf("-covariates needs -samples with the covariate columns")
+		}
+		// ComBat and the regression need complete data, so check before
+		// anything runs rather than after the normalization
+		if profile.BatchCorrection && *impute == ImputeNone {
+			log.Fatalf("Profile %s runs ComBat, which needs -impute mean, median or knn (-impute none keeps missing values)", profile.Name)
+		}
+		if profile.Covariates && *impute == ImputeNone {
+			log.Fatalf("Profile %s regresses covariates, which needs -impute mean, median or knn (-impute none keeps missing values)", profile.Name)
+		}
+	}
+	options.SampleQC = SampleQCOptions{Mode: *sampleQC, ZThreshold: *outlierZ}
+	if *sampleQC != SampleQCNone && *sampleQC != SampleQCFlag && *sampleQC != SampleQCRemove {
+		log.Fatalf("Invalid -sample-qc %q: use 'none', 'flag' or 'remove'", *sampleQC)
+	}
+	options.GeneFilter = GeneFilterOptions{MinPresentFraction: *minPresent, MinMean: *minMean,
+		DropConstant: *dropConstant, TopN: *topN, RankBy: *rankBy}
+	if *rankBy != RankByVariance && *rankBy != RankByMAD {
+		log.Fatalf("Invalid -rank-by %q: use 'variance' or 'mad'", *rankBy)
+	}
+	if *platformPath != "" {
+		platform, err := ReadPlatformAnnotation(*platformPath)
+		if err != nil {
+			log.Fatalf("Error reading platform annotation: %v", err)
+		}
+		options.Platform = platform
 	}
 
-	datasetType := os.Args[1]
-	filePath := os.Args[2]
+	options.OutputDir = *outputDir
+	if options.Exports, err = ParseExportFormats(*exportFormats); err != nil {
+		log.Fatalf("Invalid -export: %v", err)
+	}
+	options.Cache = *cache
+	if *cache != diffcoex.CacheNone {
+		if _, err := diffcoex.CacheValueSize(*cache); err != nil {
+			log.Fatalf("Invalid -cache: %v", err)
+		}
+	}
+	options.Config, err = diffcoex.EffectiveConfig(config, "", arguments)
+	if err != nil {
+		log.Fatalf("Error recording config: %v", err)
+	}
 
 	// Create output directories if they don't exist
-	for _, dir := range []string{"output/diffcoex", "output/coxpress"} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("Error creating output directory %s: %v", dir, err)
+	for _, profile := range options.Profiles {
+		if err := os.MkdirAll(filepath.Join(options.OutputDir, profile.Name), 0755); err != nil {
+			log.Fatalf("Error creating output directory %s: %v", profile.Name, err)
 		}
+		fmt.Printf("Profile %s: %s\n", profile.Name, profile)
 	}
 
-	// Process data using both methods
+	// Process data with every profile
 	switch datasetType {
 	case "rat":
-		if err := processRatData(filePath); err != nil {
+		if err := processRatData(filePath, options); err != nil {
 			log.Fatalf("Error processing rat data: %v", err)
 		}
 		fmt.Println("Rat data processing complete! Files saved:")
-		fmt.Println("- output/diffcoex/rat_eker_mutants.csv")
-		fmt.Println("- output/diffcoex/rat_wild_types.csv")
-		fmt.Println("- output/coxpress/rat_eker_mutants.csv")
-		fmt.Println("- output/coxpress/rat_wild_types.csv")
 
 	case "golub":
-		if err := processGolubData(filePath); err != nil {
+		if err := processGolubData(filePath, options); err != nil {
 			log.Fatalf("Error processing Golub data: %v", err)
 		}
 		fmt.Println("Golub data processing complete! Files saved:")
-		fmt.Println("- output/diffcoex/golub_ALL_samples.csv")
-		fmt.Println("- output/diffcoex/golub_AML_samples.csv")
-		fmt.Println("- output/coxpress/golub_ALL_samples.csv")
-		fmt.Println("- output/coxpress/golub_AML_samples.csv")
+
+	case "soft":
+		if _, err := processSoftData(filePath, options); err != nil {
+			log.Fatalf("Error processing SOFT data: %v", err)
+		}
+		fmt.Println("SOFT data processing complete! Files saved:")
+
+	case "series":
+		if options.Characteristic == "" {
+			log.Fatalf("The series dataset type needs -characteristic to split samples into conditions")
+		}
+		if _, err := processSeriesData(filePath, options); err != nil {
+			log.Fatalf("Error processing series matrix: %v", err)
+		}
+		fmt.Println("Series matrix processing complete! Files saved:")
+
+	case "matrix":
+		if options.SampleSheet == "" {
+			log.Fatalf("The matrix dataset type needs -samples to split samples into conditions")
+		}
+		if _, err := processMatrixData(filePath, options); err != nil {
+			log.Fatalf("Error processing expression matrix: %v", err)
+		}
+		fmt.Println("Expression matrix processing complete! Files saved:")
 
 	default:
-		log.Fatalf("Unknown dataset type: %s. Use 'rat' or 'golub'", datasetType)
+		log.Fatalf("Unknown dataset type: %s. Use 'rat', 'golub', 'soft', 'series' or 'matrix'", datasetType)
+	}
+	for _, output := range writtenConditions {
+		for _, file := range output.Files {
+			fmt.Println("- " + file)
+		}
 	}
+
+	// Record the conditions and the config, so the other tools can reuse them
+	for _, pair := range conditionPairs {
+		for _, condition := range pair {
+			if !conditionWritten(condition) {
+				log.Fatalf("Condition %s of condition-pairs was not written", condition)
+			}
+		}
+	}
+	if err := writeConditionManifest(options); err != nil {
+		log.Fatalf("Error writing condition manifest: %v", err)
+	}
+	if err := writeCLSExports(options); err != nil {
+		log.Fatalf("Error writing CLS export: %v", err)
+	}
+	configFile := filepath.Join(options.OutputDir, "config.json")
+	if err := diffcoex.WriteEffectiveConfig(options.Config, configFile); err != nil {
+		log.Fatalf("Error writing config: %v", err)
+	}
+	diffcoex.RecordOutput(configFile)
+
+	if len(diffcoex.ValidationWarnings) > 0 {
+		if err := diffcoex.WriteValidationWarnings(warningsFile); err != nil {
+			log.Fatalf("Error writing validation warnings: %v", err)
+		}
+		diffcoex.RecordOutput(warningsFile)
+		fmt.Printf("%d input problems were found, see %s\n", len(diffcoex.ValidationWarnings), warningsFile)
+	}
+
+	// Record the provenance of every output
+	manifest.SetConfig(options.Config)
+	if err := manifest.AddInputs(*configPath, filePath, options.SampleSheet, *platformPath, *excludePath); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+	if err := manifest.AddInputs(diffcoex.MatrixCachesRead...); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+	if err := manifest.AddOutputs(diffcoex.OutputFiles...); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+	manifest.Counts["conditions"] = len(writtenConditions)
+	manifest.Counts["profiles"] = len(options.Profiles)
+	for _, output := range writtenConditions {
+		manifest.Counts[output.Name+" genes"] = output.Genes
+		manifest.Counts[output.Name+" samples"] = output.Samples
+	}
+	manifestFile := filepath.Join(options.OutputDir, "preprocess_manifest.json")
+	if err := manifest.Write(manifestFile); err != nil {
+		log.Fatalf("Error writing manifest: %v", err)
+	}
+	fmt.Println("Provenance manifest:", manifestFile)
 }
 
-func processRatData(filePath string) error {
+// defaultRatSubsetType is the GDS2901 subset type separating Eker mutants from wild types
+const defaultRatSubsetType = "genotype/variation"
+
+func processRatData(filePath string, options PipelineOptions) error {
 
 	// Read data
-	dataWithGenes, err := ReadData(filePath)
+	soft, err := ReadSoftFile(filePath)
 	if err != nil {
 		return fmt.Errorf("error reading rat data: %v", err)
 	}
+	if err := checkGDS2901Exclusions(soft.Expression, options.Exclusions); err != nil {
+		return err
+	}
 
-	// DiffCoEx preprocessing
-	{
-		// Create a deep copy for DiffCoEx processing
-		diffCoExData := copyDataWithGenes(dataWithGenes)
-
-		// Remove last row and probeset 2475
-		diffCoExData.Data = removeRow(diffCoExData.Data, len(diffCoExData.GeneIDs)-1)
-		diffCoExData.GeneIDs = append(diffCoExData.GeneIDs[:2474], diffCoExData.GeneIDs[2475:]...)
-		diffCoExData.Data = removeRow(diffCoExData.Data, 2474)
+	// Split into Eker mutants and wild types, with descriptive file names
+	split := func(d *DataWithGenes) ([]string, []*DataWithGenes, error) {
+		ekerMutants, wildTypes, err := splitRatConditions(d, soft, options.SubsetType, options.GDS2901Layout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{"eker_mutants", "wild_types"}, []*DataWithGenes{ekerMutants, wildTypes}, nil
+	}
+	fileName := func(name string) string { return outputFileName("rat", name) }
+	_, err = runProfiles(soft.Expression, "rat", split, fileName, options)
+	return err
+}
 
-		// Process data
-		logData := applyLog2(diffCoExData.Data)
-		normData := NormalizeQuantiles(logData)
+// gds2901Samples is the number of samples of GDS2901: 36 Eker mutants
+// followed by 36 wild types
+const gds2901Samples = 72
+
+// splitRatConditions separates Eker mutants from wild types using the GDS
+// subsets of the given type. Files without subset metadata are only split
+// by the GDS2901 column layout (36 Eker samples followed by 36 wild types)
+// when gds2901Layout is set, and only if they have exactly its 72 samples.
+func splitRatConditions(d *DataWithGenes, soft *SoftData, subsetType string, gds2901Layout bool) (*DataWithGenes, *DataWithGenes, error) {
+	if gds2901Layout {
+		if len(d.SampleIDs) != gds2901Samples {
+			return nil, nil, fmt.Errorf("the GDS2901 layout needs %d samples, found %d", gds2901Samples, len(d.SampleIDs))
+		}
+		log.Printf("Splitting samples by the GDS2901 column layout")
+		eker := &DataWithGenes{Data: ExtractEkerSamples(d.Data), GeneIDs: d.GeneIDs, SampleIDs: d.SampleIDs[0:36],
+			Metadata: d.Metadata, ProbeIDs: d.ProbeIDs, GeneSymbols: d.GeneSymbols}
+		wild := &DataWithGenes{Data: ExtractWildSamples(d.Data), GeneIDs: d.GeneIDs, SampleIDs: d.SampleIDs[36:72],
+			Metadata: d.Metadata, ProbeIDs: d.ProbeIDs, GeneSymbols: d.GeneSymbols}
+		return eker, wild, nil
+	}
 
-		// Extract conditions
-		ekerMutants := ExtractEkerSamples(normData)
-		wildTypes := ExtractWildSamples(normData)
+	subsets := soft.SubsetsOfType(subsetType)
+	if len(subsets) == 0 {
+		return nil, nil, fmt.Errorf("no subsets of type %q (available: %s); set -subset-type, or -gds2901-layout for GDS2901 files without subsets",
+			subsetType, strings.Join(soft.SubsetTypes(), ", "))
+	}
+	if len(subsets) != 2 {
+		return nil, nil, fmt.Errorf("expected 2 %q subsets, found %d", subsetType, len(subsets))
+	}
 
-		// Save with gene IDs using descriptive filenames
-		if err := saveToCSV(ekerMutants, diffCoExData.GeneIDs, "output/diffcoex/rat_eker_mutants.csv"); err != nil {
-			return fmt.Errorf("error saving DiffCoEx Eker mutants: %v", err)
-		}
-		if err := saveToCSV(wildTypes, diffCoExData.GeneIDs, "output/diffcoex/rat_wild_types.csv"); err != nil {
-			return fmt.Errorf("error saving DiffCoEx wild types: %v", err)
+	// The wild type subset is the one described as such; the other one is the mutant
+	wildIndex := -1
+	for i, subset := range subsets {
+		if strings.Contains(strings.ToLower(subset.Description), "wild") {
+			wildIndex = i
 		}
 	}
+	if wildIndex == -1 {
+		return nil, nil, fmt.Errorf("no wild type subset among %q subsets", subsetType)
+	}
 
-	// coXpress preprocessing
-	{
-		// Extract conditions directly from raw data
-		ekerMutants := ExtractEkerSamples(dataWithGenes.Data)
-		wildTypes := ExtractWildSamples(dataWithGenes.Data)
+	wild, err := ExtractSamples(d, subsets[wildIndex].SampleIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error extracting wild types: %v", err)
+	}
+	eker, err := ExtractSamples(d, subsets[1-wildIndex].SampleIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error extracting Eker mutants: %v", err)
+	}
+	return eker, wild, nil
+}
 
-		// Save with gene IDs using descriptive filenames
-		if err := saveToCSV(ekerMutants, dataWithGenes.GeneIDs, "output/coxpress/rat_eker_mutants.csv"); err != nil {
-			return fmt.Errorf("error saving coXpress Eker mutants: %v", err)
-		}
-		if err := saveToCSV(wildTypes, dataWithGenes.GeneIDs, "output/coxpress/rat_wild_types.csv"); err != nil {
-			return fmt.Errorf("error saving coXpress wild types: %v", err)
+// processSoftData splits any GDS SOFT file by the subsets of the given type and
+// writes one file per subset, returning the file names
+func processSoftData(filePath string, options PipelineOptions) ([]string, error) {
+	soft, err := ReadSoftFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SOFT data: %v", err)
+	}
+
+	// Name outputs after the dataset, e.g. gds2901_wild_type.csv
+	prefix := inputBaseName(filePath)
+	if dataset := soft.Dataset(); dataset != nil && dataset.ID != "" {
+		prefix = dataset.ID
+	}
+
+	split := func(d *DataWithGenes) ([]string, []*DataWithGenes, error) {
+		return soft.SplitBySubsetType(d, options.SubsetType)
+	}
+	fileName := func(name string) string { return outputFileName(prefix, name) }
+	return runProfiles(soft.Expression, prefix, split, fileName, options)
+}
+
+// processSeriesData splits a GEO series matrix by a sample characteristic and
+// writes one file per characteristic value, returning the file names
+func processSeriesData(filePath string, options PipelineOptions) ([]string, error) {
+	series, err := ReadSeriesMatrix(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading series matrix: %v", err)
+	}
+
+	// Name outputs after the series, e.g. gse1234_liver.csv
+	prefix := inputBaseName(filePath)
+	if accession := series.Series["geo_accession"]; len(accession) > 0 && accession[0] != "" {
+		prefix = accession[0]
+	}
+
+	split := func(d *DataWithGenes) ([]string, []*DataWithGenes, error) {
+		return series.SplitByCharacteristic(d, options.Characteristic)
+	}
+	fileName := func(name string) string { return outputFileName(prefix, name) }
+	return runProfiles(series.Expression, prefix, split, fileName, options)
+}
+
+// processMatrixData splits an expression matrix using a sample sheet and writes
+// one file per condition, returning the file names
+func processMatrixData(filePath string, options PipelineOptions) ([]string, error) {
+	data, err := ReadExpressionMatrix(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading expression matrix: %v", err)
+	}
+
+	sheet, err := ReadSampleSheet(options.SampleSheet)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := inputBaseName(filePath)
+	split := func(d *DataWithGenes) ([]string, []*DataWithGenes, error) {
+		return SplitByCondition(d, sheet, options.Conditions)
+	}
+	fileName := func(name string) string { return outputFileName(prefix, name) }
+	return runProfiles(data, prefix, split, fileName, options)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
+	return items
+}
 
-	return nil
+// inputBaseName returns the file name of a path without directory and extensions
+func inputBaseName(filePath string) string {
+	name := filepath.Base(filePath)
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// outputFileName builds a lowercase CSV file name from a prefix and a group name
+func outputFileName(prefix, name string) string {
+	slug := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, prefix+"_"+name)
+	return slug + ".csv"
 }
 
-func processGolubData(filePath string) error {
+func processGolubData(filePath string, options PipelineOptions) error {
 
 	// Read and split the data
 	allData, amlData, err := ReadGolubData(filePath)
@@ -501,17 +864,19 @@ func processGolubData(filePath string) error {
 		return fmt.Errorf("error reading Golub data: %v", err)
 	}
 
-	// Save ALL samples
-	if err := writeOutput(allData, "golub_ALL_samples.csv"); err != nil {
-		return fmt.Errorf("error saving ALL samples: %v", err)
+	// Collapse and normalize ALL and AML samples together
+	combined, err := combineSamples(allData, amlData)
+	if err != nil {
+		return fmt.Errorf("error combining Golub samples: %v", err)
 	}
-
-	// Save AML samples
-	if err := writeOutput(amlData, "golub_AML_samples.csv"); err != nil {
-		return fmt.Errorf("error saving AML samples: %v", err)
+	_, allCols := allData.Data.Dims()
+	_, amlCols := amlData.Data.Dims()
+	split := func(d *DataWithGenes) ([]string, []*DataWithGenes, error) {
+		return []string{"ALL", "AML"}, splitSamples(d, allCols, amlCols), nil
 	}
-
-	return nil
+	fileName := func(name string) string { return "golub_" + name + "_samples.csv" }
+	_, err = runProfiles(combined, "golub", split, fileName, options)
+	return err
 }
 
 func copyDataWithGenes(d *DataWithGenes) *DataWithGenes {
@@ -521,8 +886,38 @@ func copyDataWithGenes(d *DataWithGenes) *DataWithGenes {
 	newGeneIDs := make([]string, len(d.GeneIDs))
 	copy(newGeneIDs, d.GeneIDs)
 
+	var newSampleIDs []string
+	if d.SampleIDs != nil {
+		newSampleIDs = make([]string, len(d.SampleIDs))
+		copy(newSampleIDs, d.SampleIDs)
+	}
+
 	return &DataWithGenes{
-		Data:    newData,
-		GeneIDs: newGeneIDs,
+		Data:        newData,
+		GeneIDs:     newGeneIDs,
+		SampleIDs:   newSampleIDs,
+		Metadata:    copyMetadata(d.Metadata),
+		ProbeIDs:    copyStrings(d.ProbeIDs),
+		GeneSymbols: copyStrings(d.GeneSymbols),
+	}
+}
+
+// copyStrings returns a copy of a string slice (nil stays nil)
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
+
+// copyMetadata returns a copy of a metadata map (nil stays nil)
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
 	}
+	return copied
 }
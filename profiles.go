@@ -0,0 +1,184 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/*
+	A processing profile is a named set of transforms producing one output
+	directory. Every profile starts from the same matrix, after probe
+	exclusion, probe collapsing and missing value handling, then runs its
+	normalization chain, ComBat and covariate regression, in that order.
+	Profiles are written as the profile name, "=" and comma-separated steps,
+	which are normalization steps or the keywords "combat" and "regress":
+
+		diffcoex=auto-log,quantile,combat
+		coxpress=none
+		scaled=log2,zscore,regress
+
+	Sample QC and the gene filters run on the first profile, and their
+	decisions are applied to the others, so every profile keeps the same
+	samples and genes.
+*/
+
+// Built-in profiles
+const (
+	ProfileDiffCoEx = "diffcoex" // normalized input for DiffCoEx
+	ProfileCoXpress = "coxpress" // unnormalized input for coXpress
+)
+
+// Profile is a named set of transforms applied before the data is split into
+// conditions
+type Profile struct {
+	Name            string
+	Normalization   NormalizerChain
+	BatchCorrection bool // run ComBat after the normalization
+	Covariates      bool // regress out the covariates after ComBat
+}
+
+// String lists the transforms of the profile separated by ";"
+func (p Profile) String() string {
+	steps := []string{p.Normalization.String()}
+	if p.BatchCorrection {
+		steps = append(steps, "combat")
+	}
+	if p.Covariates {
+		steps = append(steps, "regress")
+	}
+	return strings.Join(steps, ";")
+}
+
+// ParseProfile builds a profile from "name=steps"
+func ParseProfile(spec string) (Profile, error) {
+	name, steps, ok := strings.Cut(strings.TrimSpace(spec), "=")
+	name = strings.TrimSpace(name)
+	if !ok {
+		return Profile{}, fmt.Errorf("profile %q is not name=steps", spec)
+	}
+	if !validProfileName(name) {
+		return Profile{}, fmt.Errorf("invalid profile name %q: use letters, digits, '-' and '_'", name)
+	}
+
+	profile := Profile{Name: name}
+	var normalization []string
+	for _, step := range strings.Split(steps, ",") {
+		switch strings.ToLower(strings.TrimSpace(step)) {
+		case "combat":
+			profile.BatchCorrection = true
+		case "regress":
+			profile.Covariates = true
+		default:
+			normalization = append(normalization, step)
+		}
+	}
+	chain, err := ParseNormalizerChain(strings.Join(normalization, ","))
+	if err != nil {
+		return Profile{}, fmt.Errorf("profile %s: %v", name, err)
+	}
+	profile.Normalization = chain
+	return profile, nil
+}
+
+// ParseProfiles builds the profiles of a ";"-separated list
+func ParseProfiles(spec string) ([]Profile, error) {
+	var profiles []Profile
+	for _, item := range strings.Split(spec, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		profile, err := ParseProfile(item)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// validProfileName reports whether a name can be used as a directory name
+func validProfileName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeProfiles replaces the profiles of the same name, and appends the
+// others, in order
+func mergeProfiles(profiles, overrides []Profile) []Profile {
+	merged := append([]Profile{}, profiles...)
+	for _, override := range overrides {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == override.Name {
+				merged[i] = override
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, override)
+		}
+	}
+	return merged
+}
+
+// selectProfiles returns the named profiles, in the given order
+func selectProfiles(profiles []Profile, names []string) ([]Profile, error) {
+	selected := make([]Profile, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, profile := range profiles {
+			if profile.Name == name {
+				selected = append(selected, profile)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// profileOptions returns the options with the batch correction and covariate
+// regression of a profile
+func profileOptions(options PipelineOptions, profile Profile) PipelineOptions {
+	options.BatchCorrection.Enabled = profile.BatchCorrection
+	if !profile.Covariates {
+		options.Covariates.Names = nil
+	}
+	return options
+}
+
+// applyProfile runs the normalization, batch correction and joint covariate
+// regression of a profile on a copy of d
+func applyProfile(d *DataWithGenes, profile Profile, options PipelineOptions, prefix string) (*DataWithGenes, error) {
+	options = profileOptions(options, profile)
+	result, err := correctBatches(profile.Normalization.Apply(d), options, prefix+"_"+profile.Name)
+	if err != nil {
+		return nil, err
+	}
+	result, err = regressCovariatesJoint(result, options, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result.Metadata["profile"] = profile.Name
+	return result, nil
+}
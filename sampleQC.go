@@ -0,0 +1,215 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	Sample QC follows the inter-array correlation (IAC) approach of Oldham's
+	SampleNetwork and the WGCNA tutorials. Within a condition, the samples
+	are correlated over all genes, the correlations are turned into a signed
+	adjacency ((1+r)/2)^2, and each sample's connectivity (sum of its
+	adjacencies) is standardized into Z.K. Samples with Z.K below -threshold
+	are outliers. Samples are also clustered by average linkage on 1-IAC, so
+	the QC table shows where each sample joins the dendrogram.
+*/
+
+// Sample QC modes
+const (
+	SampleQCNone   = "none"   // skip sample QC
+	SampleQCFlag   = "flag"   // write the QC tables and keep every sample
+	SampleQCRemove = "remove" // write the QC tables and drop the outliers
+)
+
+// defaultOutlierZ is the Z.K below which (in absolute value) a sample is an outlier
+const defaultOutlierZ = 2.5
+
+// minimumQCSamples is the number of samples a condition needs for QC
+const minimumQCSamples = 3
+
+// SampleQCOptions controls the sample QC step
+type SampleQCOptions struct {
+	Mode       string
+	ZThreshold float64
+}
+
+// SampleQC holds the QC statistics of one sample
+type SampleQC struct {
+	SampleID     string
+	MeanIAC      float64 // mean correlation with the other samples
+	Connectivity float64 // sum of the adjacencies with the other samples
+	ZK           float64 // standardized connectivity
+	ClusterOrder int     // position in the dendrogram, from 1
+	JoinHeight   float64 // 1-IAC height at which the sample joins a cluster
+	Outlier      bool
+}
+
+// SampleQualityControl computes the QC statistics of the samples of one
+// condition and marks those with a standardized connectivity below
+// -threshold as outliers
+func SampleQualityControl(d *DataWithGenes, threshold float64) ([]SampleQC, error) {
+	_, samples := d.Data.Dims()
+	if samples < minimumQCSamples {
+		return nil, fmt.Errorf("sample QC needs at least %d samples, found %d", minimumQCSamples, samples)
+	}
+
+	iac := sampleCorrelations(d.Data)
+	qc := make([]SampleQC, samples)
+	connectivity := make([]float64, samples)
+	for i := 0; i < samples; i++ {
+		qc[i].SampleID = d.SampleIDs[i]
+		for j := 0; j < samples; j++ {
+			if i == j {
+				continue
+			}
+			adjacency := (1 + iac[i][j]) / 2
+			connectivity[i] += adjacency * adjacency
+			qc[i].MeanIAC += iac[i][j] / float64(samples-1)
+		}
+		qc[i].Connectivity = connectivity[i]
+	}
+
+	mean, sd := nanMeanSD(connectivity)
+	for i := range qc {
+		if sd > 0 {
+			qc[i].ZK = (connectivity[i] - mean) / sd
+		}
+		qc[i].Outlier = qc[i].ZK < -threshold
+	}
+
+	distances := make([][]float64, samples)
+	for i := range distances {
+		distances[i] = make([]float64, samples)
+		for j := range distances[i] {
+			distances[i][j] = 1 - iac[i][j]
+		}
+	}
+	order, heights := averageLinkage(distances)
+	for position, i := range order {
+		qc[i].ClusterOrder = position + 1
+		qc[i].JoinHeight = heights[i]
+	}
+	return qc, nil
+}
+
+// sampleCorrelations returns the Pearson correlations between the columns of
+// data, using the genes observed in both samples
+func sampleCorrelations(data *mat.Dense) [][]float64 {
+	_, samples := data.Dims()
+	columns := make([][]float64, samples)
+	for j := range columns {
+		columns[j] = mat.Col(nil, j, data)
+	}
+	iac := make([][]float64, samples)
+	for i := range iac {
+		iac[i] = make([]float64, samples)
+		iac[i][i] = 1
+	}
+	for i := 0; i < samples; i++ {
+		for j := i + 1; j < samples; j++ {
+			r := pairwiseCorrelation(columns[i], columns[j])
+			iac[i][j], iac[j][i] = r, r
+		}
+	}
+	return iac
+}
+
+// pairwiseCorrelation returns the Pearson correlation of the positions where
+// both x and y are observed (0 if either is constant there)
+func pairwiseCorrelation(x, y []float64) float64 {
+	var sx, sy, sxx, syy, sxy, n float64
+	for k := range x {
+		if isMissing(x[k]) || isMissing(y[k]) {
+			continue
+		}
+		sx += x[k]
+		sy += y[k]
+		n++
+	}
+	if n < 2 {
+		return 0
+	}
+	mx, my := sx/n, sy/n
+	for k := range x {
+		if isMissing(x[k]) || isMissing(y[k]) {
+			continue
+		}
+		dx, dy := x[k]-mx, y[k]-my
+		sxx += dx * dx
+		syy += dy * dy
+		sxy += dx * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return 0
+	}
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+// averageLinkage clusters items by average linkage (UPGMA) on a distance
+// matrix. It returns the leaf order of the dendrogram and, for every item,
+// the height at which it first joins another item or cluster.
+func averageLinkage(distances [][]float64) ([]int, []float64) {
+	n := len(distances)
+	heights := make([]float64, n)
+	clusters := make([][]int, n)
+	for i := range clusters {
+		clusters[i] = []int{i}
+	}
+	for len(clusters) > 1 {
+		// Find the closest pair of clusters
+		bestA, bestB, best := 0, 1, math.Inf(1)
+		for a := 0; a < len(clusters); a++ {
+			for b := a + 1; b < len(clusters); b++ {
+				sum := 0.0
+				for _, i := range clusters[a] {
+					for _, j := range clusters[b] {
+						sum += distances[i][j]
+					}
+				}
+				if d := sum / float64(len(clusters[a])*len(clusters[b])); d < best {
+					bestA, bestB, best = a, b, d
+				}
+			}
+		}
+
+		for _, side := range []int{bestA, bestB} {
+			if len(clusters[side]) == 1 {
+				heights[clusters[side][0]] = best
+			}
+		}
+		clusters[bestA] = append(clusters[bestA], clusters[bestB]...)
+		clusters = append(clusters[:bestB], clusters[bestB+1:]...)
+	}
+	return clusters[0], heights
+}
+
+// writeSampleQC writes the QC table of one condition as a tab-separated file
+func writeSampleQC(qc []SampleQC, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating sample QC table: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, "sample\tmean_iac\tconnectivity\tz_k\tcluster_order\tjoin_height\toutlier")
+	for _, s := range qc {
+		fmt.Fprintf(writer, "%s\t%.6g\t%.6g\t%.6g\t%d\t%.6g\t%t\n", s.SampleID, s.MeanIAC, s.Connectivity, s.ZK,
+			s.ClusterOrder, s.JoinHeight, s.Outlier)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,180 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+	A sample sheet is a tab-separated file with a header row and one row per
+	sample. It must have a sample ID column and a condition column, and may
+	have a batch column. Every other column is kept as a covariate.
+
+		sample	condition	batch	sex
+		GSM101	ALL	1	F
+		GSM102	AML	2	M
+*/
+
+// SampleInfo is one row of a sample sheet
+type SampleInfo struct {
+	SampleID   string
+	Condition  string
+	Batch      string
+	Covariates map[string]string
+}
+
+// SampleSheet holds the sample annotations in file order
+type SampleSheet struct {
+	Samples        []SampleInfo
+	CovariateNames []string
+}
+
+// Accepted header names for the required and optional sample sheet columns
+var (
+	sampleColumnNames    = []string{"sample", "sample_id", "id"}
+	conditionColumnNames = []string{"condition", "group"}
+	batchColumnNames     = []string{"batch"}
+)
+
+// ReadSampleSheet reads a tab-separated sample annotation file
+func ReadSampleSheet(filePath string) (*SampleSheet, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sample sheet: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comma = '\t'
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading sample sheet: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("sample sheet does not contain any samples")
+	}
+
+	// Locate the columns from the header
+	header := records[0]
+	sampleCol := findColumn(header, sampleColumnNames)
+	conditionCol := findColumn(header, conditionColumnNames)
+	batchCol := findColumn(header, batchColumnNames)
+	if sampleCol == -1 || conditionCol == -1 {
+		return nil, fmt.Errorf("sample sheet needs a sample ID column and a condition column")
+	}
+
+	sheet := &SampleSheet{}
+	for j, name := range header {
+		if j != sampleCol && j != conditionCol && j != batchCol {
+			sheet.CovariateNames = append(sheet.CovariateNames, strings.TrimSpace(name))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, record := range records[1:] {
+		if len(record) != len(header) {
+			return nil, fmt.Errorf("sample sheet row %d has %d fields, expected %d", i+2, len(record), len(header))
+		}
+
+		sample := SampleInfo{
+			SampleID:   strings.TrimSpace(record[sampleCol]),
+			Condition:  strings.TrimSpace(record[conditionCol]),
+			Covariates: make(map[string]string),
+		}
+		if batchCol != -1 {
+			sample.Batch = strings.TrimSpace(record[batchCol])
+		}
+		for j, value := range record {
+			if j != sampleCol && j != conditionCol && j != batchCol {
+				sample.Covariates[strings.TrimSpace(header[j])] = strings.TrimSpace(value)
+			}
+		}
+
+		if sample.SampleID == "" || sample.Condition == "" {
+			return nil, fmt.Errorf("sample sheet row %d is missing a sample ID or condition", i+2)
+		}
+		if seen[sample.SampleID] {
+			return nil, fmt.Errorf("sample %s is listed twice in the sample sheet", sample.SampleID)
+		}
+		seen[sample.SampleID] = true
+
+		sheet.Samples = append(sheet.Samples, sample)
+	}
+
+	return sheet, nil
+}
+
+// findColumn returns the index of the first header matching one of the names
+// (case-insensitive), or -1
+func findColumn(header []string, names []string) int {
+	for j, column := range header {
+		for _, name := range names {
+			if strings.EqualFold(strings.TrimSpace(column), name) {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// Conditions returns the distinct conditions in order of first appearance
+func (s *SampleSheet) Conditions() []string {
+	seen := make(map[string]bool)
+	var conditions []string
+	for _, sample := range s.Samples {
+		if !seen[sample.Condition] {
+			seen[sample.Condition] = true
+			conditions = append(conditions, sample.Condition)
+		}
+	}
+	return conditions
+}
+
+// SamplesFor returns the IDs of the samples in a condition, in file order
+func (s *SampleSheet) SamplesFor(condition string) []string {
+	var ids []string
+	for _, sample := range s.Samples {
+		if sample.Condition == condition {
+			ids = append(ids, sample.SampleID)
+		}
+	}
+	return ids
+}
+
+// SplitByCondition returns one DataWithGenes per requested condition. If no
+// conditions are given, every condition of the sample sheet is returned.
+func SplitByCondition(d *DataWithGenes, sheet *SampleSheet, conditions []string) ([]string, []*DataWithGenes, error) {
+	if len(conditions) == 0 {
+		conditions = sheet.Conditions()
+	}
+
+	groups := make([]*DataWithGenes, len(conditions))
+	for i, condition := range conditions {
+		ids := sheet.SamplesFor(condition)
+		if len(ids) == 0 {
+			return nil, nil, fmt.Errorf("condition %q has no samples (available: %s)",
+				condition, strings.Join(sheet.Conditions(), ", "))
+		}
+		group, err := ExtractSamples(d, ids)
+		if err != nil {
+			return nil, nil, fmt.Errorf("condition %s: %v", condition, err)
+		}
+		groups[i] = group
+	}
+
+	return conditions, groups, nil
+}
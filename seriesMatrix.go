@@ -0,0 +1,241 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	GEO Series Matrix files (GSExxx_series_matrix.txt) list one "!Sample_*" row
+	per sample attribute, with one tab-separated value per sample, followed by
+	the expression table between !series_matrix_table_begin and
+	!series_matrix_table_end.
+*/
+
+// SampleAnnotation holds the per-sample metadata of a series matrix
+type SampleAnnotation struct {
+	Title           string
+	Accession       string
+	Characteristics map[string]string // e.g. "tissue: liver" is stored as tissue -> liver
+}
+
+// SeriesMatrix holds the parsed series metadata, sample annotations and expression table
+type SeriesMatrix struct {
+	Series     map[string][]string
+	Samples    []SampleAnnotation
+	Expression *DataWithGenes
+}
+
+// ReadSeriesMatrix reads and parses a GEO series matrix file (optionally gzipped)
+func ReadSeriesMatrix(filePath string) (*SeriesMatrix, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	var input io.Reader = file
+	if strings.HasSuffix(filePath, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("error opening gzip stream: %v", err)
+		}
+		defer gz.Close()
+		input = gz
+	}
+
+	series := &SeriesMatrix{Series: make(map[string][]string)}
+
+	var titles, accessions []string
+	var characteristics [][]string
+	var geneIDs, sampleIDs []string
+	var dataRows [][]float64
+	var inTable bool
+	validator := diffcoex.NewValidator(filePath)
+	lineNumber := 0
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		lineNumber++
+
+		// Skip empty lines
+		if strings.TrimSpace(line) == "" {
+			if inTable && sampleIDs != nil {
+				validator.Add(lineNumber, diffcoex.IssueEmptyRow, "blank line in the data table")
+			}
+			continue
+		}
+		record := strings.Split(line, "\t")
+		for i := range record {
+			record[i] = unquote(record[i])
+		}
+
+		if inTable {
+			if record[0] == "!series_matrix_table_end" {
+				inTable = false
+				continue
+			}
+
+			// The first line of the table is the header
+			if sampleIDs == nil {
+				sampleIDs = append([]string{}, record[1:]...)
+				continue
+			}
+
+			if !validator.CheckFields(lineNumber, record, len(sampleIDs)+1, 1) {
+				continue
+			}
+			validator.CheckID(lineNumber, record[0])
+			geneIDs = append(geneIDs, record[0])
+			rowData := missingRow(len(sampleIDs))
+			for j := 1; j < len(record) && j-1 < len(sampleIDs); j++ {
+				rowData[j-1] = validator.ParseValue(lineNumber, sampleIDs[j-1], record[j])
+			}
+			dataRows = append(dataRows, rowData)
+			continue
+		}
+
+		switch {
+		case record[0] == "!series_matrix_table_begin":
+			inTable = true
+		case record[0] == "!Sample_title":
+			titles = record[1:]
+		case record[0] == "!Sample_geo_accession":
+			accessions = record[1:]
+		case record[0] == "!Sample_characteristics_ch1":
+			characteristics = append(characteristics, record[1:])
+		case strings.HasPrefix(record[0], "!Series_"):
+			key := strings.TrimPrefix(record[0], "!Series_")
+			series.Series[key] = append(series.Series[key], strings.Join(record[1:], "\t"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	if err := validator.Finish(); err != nil {
+		return nil, err
+	}
+
+	// Verify we have data
+	if len(dataRows) == 0 {
+		return nil, fmt.Errorf("no valid data found in file")
+	}
+
+	// Create matrix from data
+	matrix := mat.NewDense(len(dataRows), len(sampleIDs), nil)
+	for i, row := range dataRows {
+		matrix.SetRow(i, row)
+	}
+	series.Expression = &DataWithGenes{
+		Data:      matrix,
+		GeneIDs:   geneIDs,
+		SampleIDs: sampleIDs,
+	}
+
+	// Build the per-sample annotations
+	for i, accession := range accessions {
+		sample := SampleAnnotation{
+			Accession:       accession,
+			Characteristics: make(map[string]string),
+		}
+		if i < len(titles) {
+			sample.Title = titles[i]
+		}
+		for row, values := range characteristics {
+			if i >= len(values) || values[i] == "" {
+				continue
+			}
+			key, value := splitCharacteristic(values[i], row)
+			sample.Characteristics[key] = value
+		}
+		series.Samples = append(series.Samples, sample)
+	}
+
+	return series, nil
+}
+
+// unquote removes the double quotes GEO puts around series matrix fields
+func unquote(field string) string {
+	field = strings.TrimSpace(field)
+	if len(field) >= 2 && strings.HasPrefix(field, "\"") && strings.HasSuffix(field, "\"") {
+		return field[1 : len(field)-1]
+	}
+	return field
+}
+
+// splitCharacteristic splits a "key: value" characteristic. Unlabeled values
+// are keyed by the row they came from.
+func splitCharacteristic(characteristic string, row int) (string, string) {
+	parts := strings.SplitN(characteristic, ":", 2)
+	if len(parts) == 2 {
+		return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+	return fmt.Sprintf("characteristics_ch1_%d", row+1), strings.TrimSpace(characteristic)
+}
+
+// CharacteristicKeys returns the characteristic keys found across all samples, sorted by name
+func (s *SeriesMatrix) CharacteristicKeys() []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, sample := range s.Samples {
+		for key := range sample.Characteristics {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SplitByCharacteristic splits an expression table of this series (usually
+// s.Expression) into one DataWithGenes per distinct value of a sample
+// characteristic, in order of first appearance
+func (s *SeriesMatrix) SplitByCharacteristic(d *DataWithGenes, key string) ([]string, []*DataWithGenes, error) {
+	var names []string
+	members := make(map[string][]string)
+	for _, sample := range s.Samples {
+		value, ok := sample.Characteristics[key]
+		if !ok {
+			continue
+		}
+		if _, seen := members[value]; !seen {
+			names = append(names, value)
+		}
+		members[value] = append(members[value], sample.Accession)
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("no samples have characteristic %q (available: %s)",
+			key, strings.Join(s.CharacteristicKeys(), ", "))
+	}
+
+	groups := make([]*DataWithGenes, len(names))
+	for i, name := range names {
+		group, err := ExtractSamples(d, members[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("group %s: %v", name, err)
+		}
+		groups[i] = group
+	}
+	return names, groups, nil
+}
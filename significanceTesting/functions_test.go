@@ -1,116 +1,243 @@
-// Jason Hyun (jasonhyu)
-// Siddharth Sabata (ssabata)
-// Darrick Lo (ddlo)
-// Katie Wang (kcw2)
-
-// Dec 1, 2024
-
-// NOTE: Generative AI used to produce following code:
-
-package main
-
-import (
-	"bufio"
-	"math"
-	"os"
-	"strconv"
-	"strings"
-	"testing"
-)
-
-func readInputFile(filename string) ([]float64, []float64, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer file.Close()
-
-	var actualCorrs, nullCorrs []float64
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ": ")
-		if len(parts) != 2 {
-			continue
-		}
-		values := strings.Split(parts[1], ", ")
-		for _, v := range values {
-			f, err := strconv.ParseFloat(v, 64)
-			if err != nil {
-				return nil, nil, err
-			}
-			if strings.HasPrefix(parts[0], "actualCorrs") {
-				actualCorrs = append(actualCorrs, f)
-			} else if strings.HasPrefix(parts[0], "nullCorrs") {
-				nullCorrs = append(nullCorrs, f)
-			}
-		}
-	}
-	return actualCorrs, nullCorrs, scanner.Err()
-}
-
-func readOutputFile(filename string) (float64, float64, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return 0, 0, err
-	}
-	defer file.Close()
-
-	var tstat, pval float64
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ": ")
-		if len(parts) != 2 {
-			continue
-		}
-		f, err := strconv.ParseFloat(parts[1], 64)
-		if err != nil {
-			return 0, 0, err
-		}
-		if strings.HasPrefix(parts[0], "t-statistic") {
-			tstat = f
-		} else if strings.HasPrefix(parts[0], "p-value") {
-			pval = f
-		}
-	}
-	return tstat, pval, scanner.Err()
-}
-
-func roundToFourDecimalPlaces(value float64) float64 {
-	return math.Round(value*10000) / 10000
-}
-
-func TestCompareWithNullFromFile(t *testing.T) {
-	tests := []struct {
-		inputFile  string
-		outputFile string
-	}{
-		{"testing/CompareWithNull/Input/input1.txt", "testing/CompareWithNull/Output/output1.txt"},
-		{"testing/CompareWithNull/Input/input2.txt", "testing/CompareWithNull/Output/output2.txt"},
-		{"testing/CompareWithNull/Input/input3.txt", "testing/CompareWithNull/Output/output3.txt"},
-		{"testing/CompareWithNull/Input/input4.txt", "testing/CompareWithNull/Output/output4.txt"},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.inputFile, func(t *testing.T) {
-			actualCorrs, nullCorrs, err := readInputFile(tt.inputFile)
-			if err != nil {
-				t.Fatalf("Failed to read input file: %v", err)
-			}
-
-			expectedT, expectedP, err := readOutputFile(tt.outputFile)
-			if err != nil {
-				t.Fatalf("Failed to read output file: %v", err)
-			}
-
-			tstat, pval := compareWithNull(actualCorrs, nullCorrs)
-			tstat = roundToFourDecimalPlaces(tstat)
-			pval = roundToFourDecimalPlaces(pval)
-
-			if tstat != expectedT || pval != expectedP {
-				t.Errorf("compareWithNull() = (%v, %v), want (%v, %v)", tstat, pval, expectedT, expectedP)
-			}
-		})
-	}
-}
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/stat"
+)
+
+func readInputFile(filename string) ([]float64, []float64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var actualCorrs, nullCorrs []float64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(line, ": ")
+		if len(parts) != 2 {
+			continue
+		}
+		values := strings.Split(parts[1], ", ")
+		for _, v := range values {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, nil, err
+			}
+			if strings.HasPrefix(parts[0], "actualCorrs") {
+				actualCorrs = append(actualCorrs, f)
+			} else if strings.HasPrefix(parts[0], "nullCorrs") {
+				nullCorrs = append(nullCorrs, f)
+			}
+		}
+	}
+	return actualCorrs, nullCorrs, scanner.Err()
+}
+
+func readOutputFile(filename string) (float64, float64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var tstat, pval float64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(line, ": ")
+		if len(parts) != 2 {
+			continue
+		}
+		f, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		if strings.HasPrefix(parts[0], "t-statistic") {
+			tstat = f
+		} else if strings.HasPrefix(parts[0], "p-value") {
+			pval = f
+		}
+	}
+	return tstat, pval, scanner.Err()
+}
+
+func roundToFourDecimalPlaces(value float64) float64 {
+	return math.Round(value*10000) / 10000
+}
+
+// TestCompareSummariesFromFile tests the comparison with the null as the
+// pipeline runs it: each null correlation is summarized on its own and the
+// summaries are merged in order, like the permutations of
+// createNullDistributions
+func TestCompareSummariesFromFile(t *testing.T) {
+	tests := []struct {
+		inputFile  string
+		outputFile string
+	}{
+		{"testing/CompareWithNull/Input/input1.txt", "testing/CompareWithNull/Output/output1.txt"},
+		{"testing/CompareWithNull/Input/input2.txt", "testing/CompareWithNull/Output/output2.txt"},
+		{"testing/CompareWithNull/Input/input3.txt", "testing/CompareWithNull/Output/output3.txt"},
+		{"testing/CompareWithNull/Input/input4.txt", "testing/CompareWithNull/Output/output4.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.inputFile, func(t *testing.T) {
+			actualCorrs, nullCorrs, err := readInputFile(tt.inputFile)
+			if err != nil {
+				t.Fatalf("Failed to read input file: %v", err)
+			}
+
+			expectedT, expectedP, err := readOutputFile(tt.outputFile)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+
+			var null correlationSummary
+			for _, corr := range nullCorrs {
+				null.merge(summarize([]float64{corr}))
+			}
+			tstat, pval := compareSummaries(summarize(actualCorrs), null)
+			tstat = roundToFourDecimalPlaces(tstat)
+			pval = roundToFourDecimalPlaces(pval)
+
+			if tstat != expectedT || pval != expectedP {
+				t.Errorf("compareSummaries() = (%v, %v), want (%v, %v)", tstat, pval, expectedT, expectedP)
+			}
+		})
+	}
+}
+
+func readLoadExpressionDataOutput(filename string) (map[string][]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	expected := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ": ")
+		if len(parts) != 2 {
+			continue
+		}
+		expected[parts[0]] = strings.Split(parts[1], ", ")
+	}
+	return expected, scanner.Err()
+}
+
+func TestLoadExpressionDataFromFile(t *testing.T) {
+	tests := []struct {
+		inputFile  string
+		outputFile string
+	}{
+		{"testing/LoadExpressionData/Input/input1.txt", "testing/LoadExpressionData/Output/output1.txt"},
+		{"testing/LoadExpressionData/Input/input2.txt", "testing/LoadExpressionData/Output/output2.txt"},
+		{"testing/LoadExpressionData/Input/input3.txt", "testing/LoadExpressionData/Output/output3.txt"},
+		{"testing/LoadExpressionData/Input/input4.txt", "testing/LoadExpressionData/Output/output4.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.inputFile, func(t *testing.T) {
+			expected, err := readLoadExpressionDataOutput(tt.outputFile)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+
+			matrix, err := diffcoex.ReadExpressionMatrix(tt.inputFile)
+			if err != nil {
+				t.Fatalf("ReadExpressionMatrix() error: %v", err)
+			}
+			if strings.Join(matrix.SampleIDs, ", ") != strings.Join(expected["samples"], ", ") {
+				t.Errorf("samples = %v, want %v", matrix.SampleIDs, expected["samples"])
+			}
+			if strings.Join(matrix.GeneIDs, ", ") != strings.Join(expected["geneIDs"], ", ") {
+				t.Errorf("genes = %v, want %v", matrix.GeneIDs, expected["geneIDs"])
+			}
+
+			data, err := loadExpressionData(tt.inputFile)
+			if err != nil {
+				t.Fatalf("loadExpressionData() error: %v", err)
+			}
+			numGenes, _ := strconv.Atoi(expected["genes"][0])
+			numValues, _ := strconv.Atoi(expected["values"][0])
+			if len(data) != numGenes {
+				t.Errorf("loaded %d genes, want %d", len(data), numGenes)
+			}
+			for _, gene := range expected["geneIDs"] {
+				if len(data[gene]) != numValues {
+					t.Errorf("gene %s has %d values, want %d", gene, len(data[gene]), numValues)
+				}
+			}
+		})
+	}
+}
+
+// TestCorrelationSummary tests that merged summaries match the summary of all
+// the correlations
+func TestCorrelationSummary(t *testing.T) {
+	x, y := []float64{0.1, 0.5, -0.2}, []float64{0.3, 0.9, 0.4, -0.7}
+	merged := summarize(x)
+	merged.merge(summarize(y))
+	all := append(append([]float64{}, x...), y...)
+	if math.Abs(merged.mean-stat.Mean(all, nil)) > 1e-12 || math.Abs(merged.variance()-stat.Variance(all, nil)) > 1e-12 {
+		t.Errorf("merged summary = %+v", merged)
+	}
+}
+
+// TestNullDistributionsReproducible tests that the null distributions of a
+// seed do not depend on the number of workers
+func TestNullDistributionsReproducible(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	data := make(map[string][]float64)
+	for i := 0; i < 60; i++ {
+		gene := fmt.Sprintf("g%02d", i)
+		data[gene] = make([]float64, 10)
+		for j := range data[gene] {
+			data[gene][j] = r.NormFloat64()
+		}
+	}
+	engine := diffcoex.NewCorrelationEngine(data, diffcoex.CorrelationMethod{Name: diffcoex.CorrelationPearson, MaxPOutliers: 1})
+	store, err := diffcoex.NewCorrelationStore(engine, diffcoex.CacheFloat64, 1<<30, t.TempDir(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	module := []string{"g01", "g07", "g13", "g29", "g42"}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	var results [][4]float64
+	for _, workers := range []int{1, 3, 8} {
+		runtime.GOMAXPROCS(workers)
+		c1T, c1P, c2T, c2P := createNullDistributions(module, store, store, 42)
+		results = append(results, [4]float64{c1T, c1P, c2T, c2P})
+	}
+	for _, result := range results[1:] {
+		if result != results[0] {
+			t.Errorf("null distributions depend on the number of workers: %v and %v", results[0], result)
+		}
+	}
+}
+
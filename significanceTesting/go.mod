@@ -2,4 +2,9 @@ module significanceTesting
 
 go 1.23.0
 
-require gonum.org/v1/gonum v0.15.1 // indirect
+require (
+	diffcoex v0.0.0
+	gonum.org/v1/gonum v0.15.1
+)
+
+replace diffcoex => ../diffcoex
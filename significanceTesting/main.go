@@ -11,32 +11,110 @@ package main
 
 import (
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+
+	"diffcoex"
 )
 
 func main() {
-	// ./significanceTesting moduleMap condition1Data condition2Data
-	// Check if correct number of arguments are provided
-	if len(os.Args) != 4 {
-		fmt.Println("Usage: ./significanceTesting moduleMap condition1Data condition2Data")
+	// ./significanceTesting [options] moduleMap condition1Data condition2Data
+	strict := flag.Bool("strict", false,
+		"fail on any input problem (duplicate IDs, ragged rows, non-numeric, NaN/Inf or empty values)")
+	warningsPath := flag.String("warnings", "",
+		"tab-separated file listing the input problems found in lenient mode (default: <output>/sigTesting/validation_warnings.tsv)")
+	output := flag.String("output", "output",
+		"output directory shared with preprocess; results go to its sigTesting directory")
+	configPath := flag.String("config", "",
+		"JSON config file shared with preprocess; its significance section gives modules, condition1 and condition2")
+	correlation := flag.String("correlation", diffcoex.CorrelationPearson,
+		"correlation measure: 'pearson', 'spearman' (as clustering.R), 'bicor' (biweight midcorrelation) or 'kendall' (tau-b)")
+	maxPOutliers := flag.Float64("max-p-outliers", 1,
+		"bicor only: the largest fraction of each side of the median treated as outliers (1 keeps the plain biweight)")
+	storeMemory := flag.Int64("store-memory", 1024,
+		"largest correlation store of a condition kept in memory, in MB; larger stores are tiled on disk in the output directory")
+	storePrecision := flag.String("store-precision", diffcoex.CacheFloat64,
+		"precision of the correlation stores: 'float64' or 'float32' (half the memory and disk)")
+	minSamples := flag.Int("min-samples", 3,
+		"fewest samples observed in both genes for a pair to have a correlation; missing values are left out pair by pair")
+	seed := flag.Int64("seed", 0,
+		"seed of the random null modules, any value including 0 (default: taken from the clock, and recorded in the manifest)")
+	verifyPath := flag.String("verify", "",
+		"check the input and output files of a provenance manifest against the files on disk, then exit")
+	flag.Usage = func() {
+		fmt.Println("Usage: ./significanceTesting [options] moduleMap condition1Data condition2Data")
+		fmt.Println("       ./significanceTesting -config <config.json> [options]")
+		fmt.Println("       ./significanceTesting -verify <output>/sigTesting/significance_manifest.json")
 		fmt.Println("Example: ./significanceTesting data/golub/golub_diffcoex.csv data/golub/aml_samples.csv data/golub/all_samples.csv")
-		os.Exit(1)
+		fmt.Println("Conditions written by preprocess can also be given by name, e.g. AML ALL")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *verifyPath != "" {
+		os.Exit(diffcoex.RunVerify(*verifyPath))
+	}
+	manifest := diffcoex.NewManifest("significanceTesting")
+
+	// Read the settings missing from the command line from the config
+	config := diffcoex.Config{}
+	arguments := map[string]string{}
+	if *configPath != "" {
+		var err error
+		if config, err = diffcoex.ReadConfig(*configPath); err != nil {
+			log.Fatal("Error reading config:", err)
+		}
+		if arguments, err = diffcoex.ApplyConfig(config, "significance", []string{"modules", "condition1", "condition2"}); err != nil {
+			log.Fatal("Invalid config:", err)
+		}
+		pairs, err := config.ConditionPairs()
+		if err != nil {
+			log.Fatal("Invalid config:", err)
+		}
+		if len(pairs) > 0 && arguments["condition1"] == "" && arguments["condition2"] == "" {
+			arguments["condition1"], arguments["condition2"] = pairs[0][0], pairs[0][1]
+		}
 	}
 
 	// Get file paths from command line arguments
-	moduleMapPath := os.Args[1]
-	condition1Path := os.Args[2]
-	condition2Path := os.Args[3]
+	if flag.NArg() == 3 {
+		arguments["modules"], arguments["condition1"], arguments["condition2"] = flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	} else if flag.NArg() != 0 || arguments["modules"] == "" || arguments["condition1"] == "" || arguments["condition2"] == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	moduleMapPath := arguments["modules"]
+	condition1Path := diffcoex.ResolveCondition(arguments["condition1"], *output)
+	condition2Path := diffcoex.ResolveCondition(arguments["condition2"], *output)
+	diffcoex.StrictValidation = *strict
 
 	// Create output/sigTesting directory if it doesn't exist
-	outputDir := "output/sigTesting"
+	outputDir := filepath.Join(*output, "sigTesting")
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		log.Fatal("Error creating output directory:", err)
 	}
+	warningsFile := *warningsPath
+	if warningsFile == "" {
+		warningsFile = filepath.Join(outputDir, "validation_warnings.tsv")
+	}
+	if !diffcoex.FlagGiven("seed") {
+		*seed = diffcoex.NewSeed()
+	}
+	nullSeed = *seed
+	method, err := diffcoex.ParseCorrelationMethod(*correlation, *maxPOutliers, *minSamples)
+	if err != nil {
+		log.Fatal("Invalid -correlation:", err)
+	}
+	if *storePrecision != diffcoex.CacheFloat64 && *storePrecision != diffcoex.CacheFloat32 {
+		log.Fatalf("Invalid -store-precision %q: use 'float64' or 'float32'", *storePrecision)
+	}
+	runConfig, err := diffcoex.EffectiveConfig(config, "significance", arguments)
+	if err != nil {
+		log.Fatal("Error recording config:", err)
+	}
 
 	// Load module assignments
 	moduleMap, err := loadModules(moduleMapPath)
@@ -55,36 +133,94 @@ func main() {
 		log.Fatal("Error loading condition 2 data:", err)
 	}
 
+	if len(diffcoex.ValidationWarnings) > 0 {
+		if err := diffcoex.WriteValidationWarnings(warningsFile); err != nil {
+			log.Fatal("Error writing validation warnings:", err)
+		}
+		diffcoex.RecordOutput(warningsFile)
+		fmt.Printf("%d input problems were found, see %s\n", len(diffcoex.ValidationWarnings), warningsFile)
+	}
+
+	// Standardize every gene once for the correlations
+	condition1 := diffcoex.NewCorrelationEngine(condition1Data, method)
+	condition2 := diffcoex.NewCorrelationEngine(condition2Data, method)
+	fmt.Println("Correlation:", method)
+
+	// Compute the correlations of every pair of genes once per condition
+	fmt.Println("Computing correlation stores...")
+	store1, err := diffcoex.NewCorrelationStore(condition1, *storePrecision, *storeMemory<<20, outputDir, "condition1_correlations")
+	if err != nil {
+		log.Fatal("Error computing condition 1 correlations:", err)
+	}
+	store2, err := diffcoex.NewCorrelationStore(condition2, *storePrecision, *storeMemory<<20, outputDir, "condition2_correlations")
+	if err != nil {
+		log.Fatal("Error computing condition 2 correlations:", err)
+	}
+
 	fmt.Println("Writing null distribution results...")
-	writeNullDistributionResults(moduleMap, condition1Data, condition2Data)
+	writeNullDistributionResults(outputDir, moduleMap, store1, store2)
 
 	fmt.Println("Writing module correlation results...")
-	writeModuleCorrelationResults(moduleMap, condition1Data, condition2Data)
+	writeModuleCorrelationResults(outputDir, moduleMap, store1, store2)
+
+	for _, store := range []*diffcoex.CorrelationStore{store1, store2} {
+		if err := store.Close(); err != nil {
+			log.Fatal("Error closing correlation store:", err)
+		}
+	}
+
+	// Record the config next to the results so that the run can be repeated
+	configFile := filepath.Join(outputDir, "config.json")
+	if err := diffcoex.WriteEffectiveConfig(runConfig, configFile); err != nil {
+		log.Fatal("Error writing config:", err)
+	}
+	diffcoex.RecordOutput(configFile)
+
+	// Record the provenance of the results
+	manifest.SetConfig(runConfig)
+	if err := manifest.AddInputs(*configPath, moduleMapPath, condition1Path, condition2Path); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
+	if err := manifest.AddInputs(diffcoex.MatrixCachesRead...); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
+	if err := manifest.AddOutputs(diffcoex.OutputFiles...); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
+	manifest.Counts["modules"] = len(getUniqueModules(moduleMap))
+	manifest.Counts["module genes"] = len(moduleMap)
+	manifest.Counts["condition1 genes"], manifest.Counts["condition1 samples"] = expressionDims(condition1Data)
+	manifest.Counts["condition2 genes"], manifest.Counts["condition2 samples"] = expressionDims(condition2Data)
+	manifest.Seeds["null"] = nullSeed
+	if err := manifest.Write(filepath.Join(outputDir, "significance_manifest.json")); err != nil {
+		log.Fatal("Error writing manifest:", err)
+	}
 
 	fmt.Println("Done!")
 }
 
-func writeNullDistributionResults(moduleMap map[string]string, condition1Data, condition2Data map[string][]float64) {
+func writeNullDistributionResults(outputDir string, moduleMap map[string]string, condition1, condition2 *diffcoex.CorrelationStore) {
 	// Use path/filepath.Join for proper path construction
-	outputPath := filepath.Join("output", "sigTesting", "null_distribution_results.csv")
+	outputPath := filepath.Join(outputDir, "null_distribution_results.csv")
 	outputFile, err := os.Create(outputPath)
 	if err != nil {
 		log.Fatal("Cannot create null distribution output file:", err)
 	}
 	defer outputFile.Close()
+	diffcoex.RecordOutput(outputPath)
 
 	writer := csv.NewWriter(outputFile)
 	defer writer.Flush()
 
-	// Write header
-	header := []string{"Module", "Size", "C1_T-Stat", "C1_P-Value", "C2_T-Stat", "C2_P-Value"}
+	// Write header, with the correlation measure of every row
+	header := []string{"Module", "Size", "C1_T-Stat", "C1_P-Value", "C2_T-Stat", "C2_P-Value", "Correlation"}
 	if err := writer.Write(header); err != nil {
 		log.Fatal("Error writing header:", err)
 	}
 
 	// Analyze each module and write results
 	for module := range getUniqueModules(moduleMap) {
-		stats := analyzeModuleNullDistribution(module, moduleMap, condition1Data, condition2Data)
+		stats := analyzeModuleNullDistribution(module, moduleMap, condition1, condition2)
 
 		row := []string{
 			stats.Name,
@@ -93,6 +229,7 @@ func writeNullDistributionResults(moduleMap map[string]string, condition1Data, c
 			strconv.FormatFloat(stats.C1NullPValue, 'f', 6, 64),
 			strconv.FormatFloat(stats.C2NullTStatistic, 'f', 6, 64),
 			strconv.FormatFloat(stats.C2NullPValue, 'f', 6, 64),
+			condition1.Method().String(),
 		}
 
 		if err := writer.Write(row); err != nil {
@@ -101,33 +238,38 @@ func writeNullDistributionResults(moduleMap map[string]string, condition1Data, c
 	}
 }
 
-func writeModuleCorrelationResults(moduleMap map[string]string, condition1Data, condition2Data map[string][]float64) {
+func writeModuleCorrelationResults(outputDir string, moduleMap map[string]string, condition1, condition2 *diffcoex.CorrelationStore) {
 	// Use path/filepath.Join for proper path construction
-	outputPath := filepath.Join("output", "sigTesting", "module_correlation_results.csv")
+	outputPath := filepath.Join(outputDir, "module_correlation_results.csv")
 	outputFile, err := os.Create(outputPath)
 	if err != nil {
 		log.Fatal("Cannot create module correlation output file:", err)
 	}
 	defer outputFile.Close()
+	diffcoex.RecordOutput(outputPath)
 
 	writer := csv.NewWriter(outputFile)
 	defer writer.Flush()
 
-	// Write header
-	header := []string{"Module", "Size", "T-Statistic", "P-Value"}
+	// Write header, with the correlation measure of every row and the mean
+	// number of samples of the module correlations in each condition
+	header := []string{"Module", "Size", "T-Statistic", "P-Value", "Correlation", "C1_Mean_N", "C2_Mean_N"}
 	if err := writer.Write(header); err != nil {
 		log.Fatal("Error writing header:", err)
 	}
 
 	// Analyze each module and write results
 	for module := range getUniqueModules(moduleMap) {
-		stats := analyzeModule(module, moduleMap, condition1Data, condition2Data)
+		stats := analyzeModule(module, moduleMap, condition1, condition2)
 
 		row := []string{
 			stats.Name,
 			strconv.Itoa(stats.Size),
 			strconv.FormatFloat(stats.TStatistic, 'f', 6, 64),
 			strconv.FormatFloat(stats.PValue, 'f', 6, 64),
+			condition1.Method().String(),
+			strconv.FormatFloat(stats.C1Samples, 'f', 2, 64),
+			strconv.FormatFloat(stats.C2Samples, 'f', 2, 64),
 		}
 
 		if err := writer.Write(row); err != nil {
@@ -135,3 +277,13 @@ func writeModuleCorrelationResults(moduleMap map[string]string, condition1Data,
 		}
 	}
 }
+
+// expressionDims returns the number of genes and samples of expression data
+func expressionDims(data map[string][]float64) (int, int) {
+	samples := 0
+	for _, values := range data {
+		samples = len(values)
+		break
+	}
+	return len(data), samples
+}
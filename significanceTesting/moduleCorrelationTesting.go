@@ -13,10 +13,8 @@ import (
 	"encoding/csv"
 	"math"
 	"os"
-	"runtime"
-	"strconv"
-	"sync"
 
+	"diffcoex"
 	"gonum.org/v1/gonum/stat"
 )
 
@@ -31,6 +29,8 @@ type ModuleStats struct {
 	TStatistic float64
 	PValue     float64
 	Size       int
+	C1Samples  float64 // mean number of samples of the correlations
+	C2Samples  float64
 }
 
 func loadModules(filename string) (map[string]string, error) {
@@ -59,47 +59,26 @@ func loadModules(filename string) (map[string]string, error) {
 }
 
 func loadExpressionData(filename string) (map[string][]float64, error) {
-	file, err := os.Open(filename)
+	matrix, err := diffcoex.ReadExpressionMatrix(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
 	data := make(map[string][]float64)
-
-	// Skip header if it exists
-	_, err = reader.Read()
-	if err != nil {
-		return nil, err
-	}
-
-	for {
-		record, err := reader.Read()
-		if err != nil {
-			break
-		}
-
-		geneName := record[0]
-		values := make([]float64, 0)
-
-		// Convert string values to float64, starting from column 1
-		for _, val := range record[1:] {
-			f, err := strconv.ParseFloat(val, 64)
-			if err != nil {
-				continue
+	for i, geneName := range matrix.GeneIDs {
+		// Keep the values aligned by sample, with NaN where they did not
+		// parse, and only the genes with a value
+		for _, f := range matrix.Values[i] {
+			if !math.IsNaN(f) {
+				data[geneName] = matrix.Values[i]
+				break
 			}
-			values = append(values, f)
-		}
-
-		if len(values) > 0 {
-			data[geneName] = values
 		}
 	}
 	return data, nil
 }
 
-func analyzeModule(moduleName string, moduleMap map[string]string, condition1Data, condition2Data map[string][]float64) ModuleStats {
+func analyzeModule(moduleName string, moduleMap map[string]string, condition1, condition2 *diffcoex.CorrelationStore) ModuleStats {
 	// Get genes in this module
 	var moduleGenes []string
 	for gene, module := range moduleMap {
@@ -108,9 +87,9 @@ func analyzeModule(moduleName string, moduleMap map[string]string, condition1Dat
 		}
 	}
 
-	// Get correlation values for both conditions
-	condition1Corrs := getModuleCorrelations(moduleGenes, condition1Data)
-	condition2Corrs := getModuleCorrelations(moduleGenes, condition2Data)
+	// Look up correlation values for both conditions
+	condition1Corrs, condition1Samples := condition1.ModuleCorrelations(moduleGenes)
+	condition2Corrs, condition2Samples := condition2.ModuleCorrelations(moduleGenes)
 
 	// Calculate t-statistic and p-value manually
 	tstat, pval := calculateTTest(condition1Corrs, condition2Corrs)
@@ -120,99 +99,22 @@ func analyzeModule(moduleName string, moduleMap map[string]string, condition1Dat
 		TStatistic: tstat,
 		PValue:     pval,
 		Size:       len(moduleGenes),
+		C1Samples:  meanSamples(condition1Samples),
+		C2Samples:  meanSamples(condition2Samples),
 	}
 }
 
-func getModuleCorrelations(genes []string, expressionData map[string][]float64) []float64 {
-	// Find minimum sample size across all genes in the dataset
-	minSamples := -1
-	for _, expr := range expressionData {
-		if minSamples == -1 || len(expr) < minSamples {
-			minSamples = len(expr)
-		}
+// meanSamples returns the mean number of samples of correlations, or 0 if
+// there are none
+func meanSamples(samples []int) float64 {
+	if len(samples) == 0 {
+		return 0
 	}
-
-	// Calculate total number of correlations needed
-	numGenes := len(genes)
-	numCorrelations := (numGenes * (numGenes - 1)) / 2
-
-	// Create channels for parallel processing
-	results := make(chan float64, numCorrelations)
-	numWorkers := runtime.GOMAXPROCS(0)
-	var wg sync.WaitGroup
-
-	// Calculate how many gene pairs each worker should handle
-	pairsPerWorker := numCorrelations / numWorkers
-	if pairsPerWorker < 1 {
-		pairsPerWorker = 1
+	total := 0
+	for _, n := range samples {
+		total += n
 	}
-
-	// Launch workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		startIdx := w * pairsPerWorker
-		endIdx := (w + 1) * pairsPerWorker
-		if w == numWorkers-1 {
-			endIdx = numCorrelations
-		}
-
-		go func(start, end int) {
-			defer wg.Done()
-
-			// Calculate which gene pairs this worker should process
-			for idx := start; idx < end; idx++ {
-				// Convert linear index to i,j coordinates
-				i, j := getGeneIndices(idx)
-				if i >= len(genes) || j >= len(genes) {
-					continue
-				}
-
-				gene1 := genes[i]
-				gene2 := genes[j]
-
-				// Get expression values
-				expr1, ok1 := expressionData[gene1]
-				expr2, ok2 := expressionData[gene2]
-
-				if ok1 && ok2 {
-					// Use samples up to the minimum sample size
-					expr1 = expr1[:minSamples]
-					expr2 = expr2[:minSamples]
-
-					// Calculate correlation
-					corr := stat.Correlation(expr1, expr2, nil)
-
-					// Only send if correlation is valid
-					if !math.IsNaN(corr) {
-						results <- corr
-					}
-				}
-			}
-		}(startIdx, endIdx)
-	}
-
-	// Close results channel when all workers are done
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	// Collect results
-	var correlations []float64
-	for corr := range results {
-		correlations = append(correlations, corr)
-	}
-
-	return correlations
-}
-
-// Helper function to convert linear index to i,j coordinates
-func getGeneIndices(idx int) (i, j int) {
-	// Convert linear index back to i,j coordinates
-	// This is the inverse of the triangular number formula
-	i = int(math.Floor((-1 + math.Sqrt(1+8*float64(idx))) / 2))
-	j = idx - (i * (i + 1) / 2)
-	return i, j + i + 1
+	return float64(total) / float64(len(samples))
 }
 
 func calculateTTest(x, y []float64) (tstat, pval float64) {
@@ -10,13 +10,14 @@
 package main
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"runtime"
+	"sort"
 	"sync"
-	"time"
 
-	"gonum.org/v1/gonum/stat"
+	"diffcoex"
 )
 
 /*
@@ -25,8 +26,18 @@ import (
    and compare the actual module's correlation pattern against these random modules.
    If the p-value is below 0.05, we can say that the module's correlation pattern
    is significantly different from random expectation in that condition.
+   Every random module is drawn from a seed derived from nullSeed and its
+   permutation index, and the permutations are merged in order, so the same
+   -seed gives the same null distributions whatever the number of cores.
+   The correlations of the random modules are looked up in the correlation
+   store of the condition, and each permutation keeps only their count, mean
+   and variance, so large modules do not hold a thousand modules of
+   correlations.
 */
 
+// nullSeed is the seed of the null distributions of the run
+var nullSeed int64
+
 type NullDistributionStats struct {
 	Name             string
 	Size             int
@@ -36,84 +47,54 @@ type NullDistributionStats struct {
 	C2NullPValue     float64
 }
 
-func createNullDistributions(moduleGenes []string, condition1Data, condition2Data map[string][]float64) (float64, float64, float64, float64) {
+func createNullDistributions(moduleGenes []string, condition1, condition2 *diffcoex.CorrelationStore, seed int64) (float64, float64, float64, float64) {
 	const numPermutations = 1000
 
-	// Get all gene names from each condition
-	var c1Genes, c2Genes []string
-	for gene := range condition1Data {
-		c1Genes = append(c1Genes, gene)
-	}
-	for gene := range condition2Data {
-		c2Genes = append(c2Genes, gene)
-	}
+	// Get all gene names from each condition, in sorted order
+	c1Genes := condition1.Genes()
+	c2Genes := condition2.Genes()
 
 	moduleSize := len(moduleGenes)
 
-	// Calculate actual correlations for both conditions
-	actualC1Corrs := getModuleCorrelations(moduleGenes, condition1Data)
-	actualC2Corrs := getModuleCorrelations(moduleGenes, condition2Data)
+	// Look up actual correlations for both conditions
+	actualC1Corrs, _ := condition1.ModuleCorrelations(moduleGenes)
+	actualC2Corrs, _ := condition2.ModuleCorrelations(moduleGenes)
 
-	// Create channels for parallel processing
-	c1Results := make(chan []float64, numPermutations)
-	c2Results := make(chan []float64, numPermutations)
-
-	// Create worker pool
+	// Draw the random modules of both conditions on a worker pool. Each
+	// permutation keeps only the summary of its null correlations, so they
+	// are never all held at once.
+	c1Summaries := make([]correlationSummary, numPermutations)
+	c2Summaries := make([]correlationSummary, numPermutations)
 	numWorkers := runtime.GOMAXPROCS(0)
 	var wg sync.WaitGroup
-
-	// Launch workers for condition 1
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-			permutationsPerWorker := numPermutations / numWorkers
-			for i := 0; i < permutationsPerWorker; i++ {
-				// Randomly sample genes for null module
-				nullGenes := sampleGenes(c1Genes, moduleSize, r)
-				nullCorrs := getModuleCorrelations(nullGenes, condition1Data)
-				c1Results <- nullCorrs
-			}
-		}()
-	}
-
-	// Launch workers for condition 2
 	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
-		go func() {
+		go func(w int) {
 			defer wg.Done()
-			r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-			permutationsPerWorker := numPermutations / numWorkers
-			for i := 0; i < permutationsPerWorker; i++ {
-				nullGenes := sampleGenes(c2Genes, moduleSize, r)
-				nullCorrs := getModuleCorrelations(nullGenes, condition2Data)
-				c2Results <- nullCorrs
+			for i := w; i < numPermutations; i += numWorkers {
+				// Randomly sample genes for the null modules of permutation i
+				r := rand.New(rand.NewSource(diffcoex.DeriveSeed(seed, fmt.Sprintf("condition1/%d", i))))
+				nullCorrs, _ := condition1.ModuleCorrelations(sampleGenes(c1Genes, moduleSize, r))
+				c1Summaries[i] = summarize(nullCorrs)
+
+				r = rand.New(rand.NewSource(diffcoex.DeriveSeed(seed, fmt.Sprintf("condition2/%d", i))))
+				nullCorrs, _ = condition2.ModuleCorrelations(sampleGenes(c2Genes, moduleSize, r))
+				c2Summaries[i] = summarize(nullCorrs)
 			}
-		}()
+		}(w)
 	}
+	wg.Wait()
 
-	// Close results channels when all workers are done
-	go func() {
-		wg.Wait()
-		close(c1Results)
-		close(c2Results)
-	}()
-
-	// Collect results
-	var c1NullCorrs, c2NullCorrs []float64
-	for corrs := range c1Results {
-		c1NullCorrs = append(c1NullCorrs, corrs...)
-	}
-	for corrs := range c2Results {
-		c2NullCorrs = append(c2NullCorrs, corrs...)
+	// Merge the summaries in permutation order
+	var c1Null, c2Null correlationSummary
+	for i := 0; i < numPermutations; i++ {
+		c1Null.merge(c1Summaries[i])
+		c2Null.merge(c2Summaries[i])
 	}
 
 	// Calculate t-statistics and p-values comparing actual vs null distributions
-	c1Tstat, c1Pval := compareWithNull(actualC1Corrs, c1NullCorrs)
-	c2Tstat, c2Pval := compareWithNull(actualC2Corrs, c2NullCorrs)
+	c1Tstat, c1Pval := compareSummaries(summarize(actualC1Corrs), c1Null)
+	c2Tstat, c2Pval := compareSummaries(summarize(actualC2Corrs), c2Null)
 
 	return c1Tstat, c1Pval, c2Tstat, c2Pval
 }
@@ -127,31 +108,64 @@ func sampleGenes(genes []string, size int, r *rand.Rand) []string {
 	return sampled
 }
 
-func compareWithNull(actualCorrs, nullCorrs []float64) (float64, float64) {
+// correlationSummary is the count, mean and sum of squared deviations of a
+// set of correlations
+type correlationSummary struct {
+	n, mean, m2 float64
+}
+
+// summarize returns the summary of correlations
+func summarize(values []float64) correlationSummary {
+	var s correlationSummary
+	for _, v := range values {
+		s.n++
+		delta := v - s.mean
+		s.mean += delta / s.n
+		s.m2 += delta * (v - s.mean)
+	}
+	return s
+}
+
+// merge adds the correlations of another summary, as in Chan et al.'s
+// parallel variance
+func (s *correlationSummary) merge(other correlationSummary) {
+	if other.n == 0 {
+		return
+	}
+	n := s.n + other.n
+	delta := other.mean - s.mean
+	s.mean += delta * other.n / n
+	s.m2 += other.m2 + delta*delta*s.n*other.n/n
+	s.n = n
+}
+
+// variance returns the sample variance of the correlations
+func (s correlationSummary) variance() float64 {
+	return s.m2 / (s.n - 1)
+}
+
+// compareSummaries compares the mean of the actual correlations with the
+// mean of the null correlations
+func compareSummaries(actual, null correlationSummary) (float64, float64) {
 	// Check if we have enough data
-	if len(actualCorrs) < 2 || len(nullCorrs) < 2 {
+	if actual.n < 2 || null.n < 2 {
 		return 0, 1
 	}
 
-	meanActual := stat.Mean(actualCorrs, nil)
-	meanNull := stat.Mean(nullCorrs, nil)
-	varActual := stat.Variance(actualCorrs, nil)
-	varNull := stat.Variance(nullCorrs, nil)
+	varActual := actual.variance()
+	varNull := null.variance()
 
 	if varActual == 0 || varNull == 0 {
 		return 0, 1
 	}
 
-	nActual := float64(len(actualCorrs))
-	nNull := float64(len(nullCorrs))
-
-	se := math.Sqrt((varActual / nActual) + (varNull / nNull))
+	se := math.Sqrt((varActual / actual.n) + (varNull / null.n))
 
 	if se == 0 {
 		return 0, 1
 	}
 
-	tstat := (meanActual - meanNull) / se
+	tstat := (actual.mean - null.mean) / se
 
 	// Calculate p-value
 	z := math.Abs(tstat)
@@ -160,7 +174,7 @@ func compareWithNull(actualCorrs, nullCorrs []float64) (float64, float64) {
 	return tstat, pval
 }
 
-func analyzeModuleNullDistribution(moduleName string, moduleMap map[string]string, condition1Data, condition2Data map[string][]float64) NullDistributionStats {
+func analyzeModuleNullDistribution(moduleName string, moduleMap map[string]string, condition1, condition2 *diffcoex.CorrelationStore) NullDistributionStats {
 	// Get genes in this module
 	var moduleGenes []string
 	for gene, module := range moduleMap {
@@ -168,9 +182,11 @@ func analyzeModuleNullDistribution(moduleName string, moduleMap map[string]strin
 			moduleGenes = append(moduleGenes, gene)
 		}
 	}
+	sort.Strings(moduleGenes)
 
 	// Calculate t-statistics and p-values for each condition vs its null distribution
-	c1NullTstat, c1Pval, c2NullTstat, c2Pval := createNullDistributions(moduleGenes, condition1Data, condition2Data)
+	c1NullTstat, c1Pval, c2NullTstat, c2Pval := createNullDistributions(moduleGenes, condition1, condition2,
+		diffcoex.DeriveSeed(nullSeed, moduleName))
 
 	return NullDistributionStats{
 		Name:             moduleName,
@@ -0,0 +1,331 @@
+// Jason Hyun (jasonhyu)
+// Siddharth Sabata (ssabata)
+// Darrick Lo (ddlo)
+// Katie Wang (kcw2)
+
+// Dec 1, 2024
+
+// NOTE: Generative AI used to produce following code:
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"diffcoex"
+	"gonum.org/v1/gonum/mat"
+)
+
+/*
+	GEO SOFT files describe a dataset as a list of entities ("^DATASET = GDS2901",
+	"^SUBSET = GDS2901_1", ...), each followed by "!key = value" attributes.
+	The subsets are what define the experimental groups, so we keep them instead
+	of relying on fixed column ranges.
+*/
+
+// SoftEntity is one "^TYPE = ID" block of a SOFT file and its attributes
+type SoftEntity struct {
+	Type       string
+	ID         string
+	Attributes map[string][]string
+}
+
+// SoftSubset is a named group of samples from a GDS subset block
+type SoftSubset struct {
+	ID          string
+	Type        string
+	Description string
+	SampleIDs   []string
+}
+
+// SoftData holds the parsed metadata and expression table of a SOFT file
+type SoftData struct {
+	Entities           []*SoftEntity
+	Subsets            []SoftSubset
+	ColumnDescriptions map[string]string
+	Expression         *DataWithGenes
+}
+
+// Attribute returns the first value of an attribute, or "" if it is missing
+func (e *SoftEntity) Attribute(key string) string {
+	if values := e.Attributes[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ReadSoftFile parses a GDS SOFT file, keeping dataset, platform and subset
+// metadata along with the expression table
+func ReadSoftFile(filePath string) (*SoftData, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	soft := &SoftData{ColumnDescriptions: make(map[string]string)}
+
+	var current *SoftEntity
+	var geneIDs []string
+	var sampleIDs []string
+	var dataRows [][]float64
+	var inTable bool
+	var numCols int
+	validator := diffcoex.NewValidator(filePath)
+	lineNumber := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		lineNumber++
+
+		// Skip empty lines
+		if strings.TrimSpace(line) == "" {
+			if inTable && numCols > 0 {
+				validator.Add(lineNumber, diffcoex.IssueEmptyRow, "blank line in the data table")
+			}
+			continue
+		}
+
+		if inTable {
+			if strings.HasPrefix(line, "!dataset_table_end") {
+				inTable = false
+				continue
+			}
+			record := strings.Split(line, "\t")
+
+			// The first line of the table is the header
+			if numCols == 0 {
+				numCols = len(record) - 2 // Subtract ID and description columns
+				sampleIDs = append(sampleIDs, record[2:]...)
+				continue
+			}
+
+			// Ensure we have at least ID, description, and one data point
+			if !validator.CheckFields(lineNumber, record, numCols+2, 2) || len(record) < 3 {
+				continue
+			}
+			validator.CheckID(lineNumber, record[0])
+			geneIDs = append(geneIDs, record[0])
+			rowData := missingRow(numCols)
+			for j := 2; j < len(record) && j-2 < numCols; j++ {
+				rowData[j-2] = validator.ParseValue(lineNumber, sampleIDs[j-2], record[j])
+			}
+			dataRows = append(dataRows, rowData)
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "^"):
+			// New entity, e.g. "^SUBSET = GDS2901_1"
+			key, value := splitSoftLine(line[1:])
+			current = &SoftEntity{
+				Type:       strings.ToUpper(key),
+				ID:         value,
+				Attributes: make(map[string][]string),
+			}
+			soft.Entities = append(soft.Entities, current)
+
+		case strings.HasPrefix(line, "!dataset_table_begin"):
+			inTable = true
+
+		case strings.HasPrefix(line, "!"):
+			key, value := splitSoftLine(line[1:])
+			if current == nil {
+				current = &SoftEntity{Attributes: make(map[string][]string)}
+				soft.Entities = append(soft.Entities, current)
+			}
+			current.Attributes[key] = append(current.Attributes[key], value)
+
+		case strings.HasPrefix(line, "#"):
+			// Column descriptions, e.g. "#GSM1234 = Value for GSM1234"
+			key, value := splitSoftLine(line[1:])
+			soft.ColumnDescriptions[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	if err := validator.Finish(); err != nil {
+		return nil, err
+	}
+
+	// Verify we have data
+	if len(dataRows) == 0 {
+		return nil, fmt.Errorf("no valid data found in file")
+	}
+
+	// Create matrix from data
+	matrix := mat.NewDense(len(dataRows), numCols, nil)
+	for i, row := range dataRows {
+		matrix.SetRow(i, row)
+	}
+	soft.Expression = &DataWithGenes{
+		Data:      matrix,
+		GeneIDs:   geneIDs,
+		SampleIDs: sampleIDs,
+	}
+
+	// Collect the subset blocks
+	for _, entity := range soft.Entities {
+		if entity.Type != "SUBSET" {
+			continue
+		}
+		subset := SoftSubset{
+			ID:          entity.ID,
+			Type:        entity.Attribute("subset_type"),
+			Description: entity.Attribute("subset_description"),
+		}
+		for _, ids := range entity.Attributes["subset_sample_id"] {
+			for _, id := range strings.Split(ids, ",") {
+				if id = strings.TrimSpace(id); id != "" {
+					subset.SampleIDs = append(subset.SampleIDs, id)
+				}
+			}
+		}
+		soft.Subsets = append(soft.Subsets, subset)
+	}
+
+	return soft, nil
+}
+
+// splitSoftLine splits a "key = value" SOFT line into its key and value
+func splitSoftLine(line string) (string, string) {
+	parts := strings.SplitN(line, "=", 2)
+	key := strings.TrimSpace(parts[0])
+	if len(parts) == 1 {
+		return key, ""
+	}
+	return key, strings.TrimSpace(parts[1])
+}
+
+// Dataset returns the ^DATASET entity, or nil if the file has none
+func (s *SoftData) Dataset() *SoftEntity {
+	return s.entity("DATASET")
+}
+
+// Platform returns the ^PLATFORM entity. GDS files usually only reference
+// their platform through "!dataset_platform*" attributes, in which case an
+// entity is built from those.
+func (s *SoftData) Platform() *SoftEntity {
+	if platform := s.entity("PLATFORM"); platform != nil {
+		return platform
+	}
+
+	dataset := s.Dataset()
+	if dataset == nil || dataset.Attribute("dataset_platform") == "" {
+		return nil
+	}
+	platform := &SoftEntity{
+		Type:       "PLATFORM",
+		ID:         dataset.Attribute("dataset_platform"),
+		Attributes: make(map[string][]string),
+	}
+	for key, values := range dataset.Attributes {
+		if strings.HasPrefix(key, "dataset_platform") {
+			platformKey := "platform" + strings.TrimPrefix(key, "dataset_platform")
+			platform.Attributes[platformKey] = values
+		}
+	}
+	return platform
+}
+
+func (s *SoftData) entity(entityType string) *SoftEntity {
+	for _, entity := range s.Entities {
+		if entity.Type == entityType {
+			return entity
+		}
+	}
+	return nil
+}
+
+// SubsetTypes returns the distinct subset types in the file, sorted by name
+func (s *SoftData) SubsetTypes() []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, subset := range s.Subsets {
+		if !seen[subset.Type] {
+			seen[subset.Type] = true
+			types = append(types, subset.Type)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// SubsetsOfType returns the subsets with the given type (case-insensitive),
+// in file order
+func (s *SoftData) SubsetsOfType(subsetType string) []SoftSubset {
+	var subsets []SoftSubset
+	for _, subset := range s.Subsets {
+		if strings.EqualFold(subset.Type, subsetType) {
+			subsets = append(subsets, subset)
+		}
+	}
+	return subsets
+}
+
+// SplitBySubsetType splits an expression table read from this file (usually
+// s.Expression, or a normalized copy of it) into one DataWithGenes per
+// subset of the given type, keyed by subset description
+func (s *SoftData) SplitBySubsetType(d *DataWithGenes, subsetType string) ([]string, []*DataWithGenes, error) {
+	subsets := s.SubsetsOfType(subsetType)
+	if len(subsets) == 0 {
+		return nil, nil, fmt.Errorf("no subsets of type %q (available: %s)",
+			subsetType, strings.Join(s.SubsetTypes(), ", "))
+	}
+
+	names := make([]string, len(subsets))
+	groups := make([]*DataWithGenes, len(subsets))
+	for i, subset := range subsets {
+		group, err := ExtractSamples(d, subset.SampleIDs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("subset %s (%s): %v", subset.ID, subset.Description, err)
+		}
+		names[i] = subset.Description
+		groups[i] = group
+	}
+	return names, groups, nil
+}
+
+// ExtractSamples returns the columns of d matching the given sample IDs, in
+// the order they are listed
+func ExtractSamples(d *DataWithGenes, sampleIDs []string) (*DataWithGenes, error) {
+	if len(sampleIDs) == 0 {
+		return nil, fmt.Errorf("no samples to extract")
+	}
+
+	columnIndex := make(map[string]int, len(d.SampleIDs))
+	for j, id := range d.SampleIDs {
+		columnIndex[id] = j
+	}
+
+	rows, _ := d.Data.Dims()
+	result := mat.NewDense(rows, len(sampleIDs), nil)
+	for j, id := range sampleIDs {
+		col, ok := columnIndex[id]
+		if !ok {
+			return nil, fmt.Errorf("sample %s not found in expression table", id)
+		}
+		result.SetCol(j, mat.Col(nil, col, d.Data))
+	}
+
+	geneIDs := make([]string, len(d.GeneIDs))
+	copy(geneIDs, d.GeneIDs)
+	ids := make([]string, len(sampleIDs))
+	copy(ids, sampleIDs)
+
+	return &DataWithGenes{
+		Data:        result,
+		GeneIDs:     geneIDs,
+		SampleIDs:   ids,
+		Metadata:    copyMetadata(d.Metadata),
+		ProbeIDs:    copyStrings(d.ProbeIDs),
+		GeneSymbols: copyStrings(d.GeneSymbols),
+	}, nil
+}